@@ -0,0 +1,171 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Responses larger than this are not cached
+const maxCachedBodyBytes = 1 << 20
+
+// A response cached by its validators
+type cachedResponse struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// The bodies of GetWithCache are cached by URL
+type responseCache struct {
+	mutex     sync.Mutex
+	responses map[string]cachedResponse
+}
+
+func (c *responseCache) get(url string) (cachedResponse, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, found := c.responses[url]
+	return cached, found
+}
+
+func (c *responseCache) put(url string, cached cachedResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.responses == nil {
+		c.responses = make(map[string]cachedResponse)
+	}
+	c.responses[url] = cached
+}
+
+func (c *responseCache) remove(url string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.responses, url)
+}
+
+// Returns the body of a GET request. The request is conditional if the endpoint has been fetched
+// before with an ETag or a Last-Modified header. If the server answers 304 Not Modified, the cached
+// body is returned and changed is false.
+func (c *ApiClient) GetWithCache(ctx context.Context, endpoint string) (body []byte, changed bool, err error) {
+	logger := Log(ctx)
+	req, resp, err := c.do(ctx, endpoint, func(url string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create GET request for %s Error: %v", url, err)
+		}
+		if cached, found := c.cache.get(url); found {
+			if len(cached.etag) > 0 {
+				req.Header.Set("If-None-Match", cached.etag)
+			}
+			if len(cached.lastModified) > 0 {
+				req.Header.Set("If-Modified-Since", cached.lastModified)
+			}
+		}
+		return req, nil
+	})
+	if err != nil {
+		err := fmt.Errorf("Failed to GET response from %s! Error: %v", c.makeApiUrl(endpoint), err)
+		logger.Error(err)
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	url := req.URL.String()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		cached, found := c.cache.get(url)
+		if found {
+			apiNotModified.Inc()
+			io.Copy(ioutil.Discard, resp.Body)
+			return cached.body, false, nil
+		}
+		// Nothing was asked for, so the server should not have said so
+		err = fmt.Errorf("API client's GET %s got %s without a cached response", url, resp.Status)
+		logger.Error(err)
+		return nil, false, err
+	case http.StatusOK:
+	default:
+		err = &StatusError{
+			StatusCode: resp.StatusCode,
+			message:    fmt.Sprintf("API client's GET %s failed! Server response: %v", url, dumpResponse(resp)),
+		}
+		logger.Error(err)
+		return nil, false, err
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("Failed to read response of %s! Error: %v", url, err)
+		logger.Error(err)
+		return nil, false, err
+	}
+	cached := cachedResponse{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+	}
+	if (len(cached.etag) > 0 || len(cached.lastModified) > 0) && len(body) <= maxCachedBodyBytes {
+		c.cache.put(url, cached)
+	} else {
+		c.cache.remove(url)
+	}
+	return body, true, nil
+}
+
+// The client shared by every caller. It keeps the state of the connections to the Insight Server:
+// the failed endpoints, the discovered servers, the PAC file and the client certificate.
+var sharedApiClient = struct {
+	sync.Mutex
+	client *ApiClient
+}{}
+
+// Returns the API client shared by the callers for the config in the installation folder
+func SharedApiClient(baseFolder string) (*ApiClient, error) {
+	config, err := ParseAgentConfig(baseFolder)
+	if err != nil {
+		log.Error("Failed to parse config file! Error: ", err)
+		return nil, err
+	}
+
+	return SharedApiClientWithConfig(config)
+}
+
+// Returns the API client shared by the callers, so that connections, cached responses and the
+// state of the endpoints are reused. It is created again only if the settings of the client change
+// in the config. The callers pass the current config, so that they never use an outdated client.
+func SharedApiClientWithConfig(config Config) (*ApiClient, error) {
+	sharedApiClient.Lock()
+	defer sharedApiClient.Unlock()
+
+	previous := sharedApiClient.client
+	if previous != nil && sameClientConfig(previous.config, config) {
+		return previous, nil
+	}
+	client, err := newApiClient(config, previous)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		log.Info("Insight API client settings changed. Creating a new client.")
+		// Requests in progress are not affected
+		if transport, ok := previous.httpClient.Transport.(interface {
+			CloseIdleConnections()
+		}); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+	sharedApiClient.client = client
+	return client, nil
+}
+
+func sameClientConfig(a, b Config) bool {
+	return a.LicenseKey == b.LicenseKey && a.baseFolder == b.baseFolder && a.filePath == b.filePath &&
+		reflect.DeepEqual(a.Webservice, b.Webservice)
+}
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ApiCacheTestSuite struct {
+	suite.Suite
+	server    *httptest.Server
+	apiClient *ApiClient
+	handler   func(w http.ResponseWriter, r *http.Request)
+	requests  []*http.Request
+}
+
+func TestApiCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(ApiCacheTestSuite))
+}
+
+func (suite *ApiCacheTestSuite) SetupTest() {
+	suite.requests = nil
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.requests = append(suite.requests, r)
+		suite.handler(w, r)
+	}))
+
+	var config Config
+	config.Webservice.Endpoint = suite.server.URL
+	config.Webservice.Retry.MaxAttempts = 1
+	var err error
+	suite.apiClient, err = NewApiClientWithConfig(config)
+	suite.Require().NoError(err)
+}
+
+func (suite *ApiCacheTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *ApiCacheTestSuite) TestGetWithCache_etag() {
+	version := "1.0"
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + version + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(version))
+	}
+
+	body, changed, err := suite.apiClient.GetWithCache(context.Background(), "/agent/version")
+	suite.Require().NoError(err)
+	suite.True(changed)
+	suite.Equal("1.0", string(body))
+
+	body, changed, err = suite.apiClient.GetWithCache(context.Background(), "/agent/version")
+	suite.Require().NoError(err)
+	suite.False(changed)
+	suite.Equal("1.0", string(body))
+	suite.Equal(`"1.0"`, suite.requests[1].Header.Get("If-None-Match"))
+
+	version = "1.1"
+	body, changed, err = suite.apiClient.GetWithCache(context.Background(), "/agent/version")
+	suite.Require().NoError(err)
+	suite.True(changed)
+	suite.Equal("1.1", string(body))
+}
+
+func (suite *ApiCacheTestSuite) TestGetWithCache_lastModified() {
+	modified := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") == modified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", modified)
+		w.Write([]byte("{}"))
+	}
+
+	_, changed, err := suite.apiClient.GetWithCache(context.Background(), "/command?hostname=a")
+	suite.Require().NoError(err)
+	suite.True(changed)
+	body, changed, err := suite.apiClient.GetWithCache(context.Background(), "/command?hostname=a")
+	suite.Require().NoError(err)
+	suite.False(changed)
+	suite.Equal("{}", string(body))
+
+	// Cached by URL
+	_, changed, err = suite.apiClient.GetWithCache(context.Background(), "/command?hostname=b")
+	suite.Require().NoError(err)
+	suite.True(changed)
+}
+
+func (suite *ApiCacheTestSuite) TestGetWithCache_withoutValidators() {
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}
+
+	suite.apiClient.GetWithCache(context.Background(), "/agent/version")
+	_, changed, err := suite.apiClient.GetWithCache(context.Background(), "/agent/version")
+	suite.Require().NoError(err)
+	suite.True(changed)
+	suite.Empty(suite.requests[1].Header.Get("If-None-Match"))
+	suite.Empty(suite.requests[1].Header.Get("If-Modified-Since"))
+}
+
+func (suite *ApiCacheTestSuite) TestGetWithCache_errors() {
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	_, _, err := suite.apiClient.GetWithCache(context.Background(), "/agent/version")
+	suite.Error(err)
+
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	_, _, err = suite.apiClient.GetWithCache(context.Background(), "/updates/manifest")
+	suite.True(IsNotFound(err))
+}
+
+func (suite *ApiCacheTestSuite) TestSharedApiClient() {
+	var config Config
+	config.LicenseKey = "key"
+	config.Webservice.Endpoint = suite.server.URL
+	config.Webservice.Endpoints = []string{"https://standby.example.com"}
+
+	first, err := SharedApiClientWithConfig(config)
+	suite.Require().NoError(err)
+	second, err := SharedApiClientWithConfig(config)
+	suite.Require().NoError(err)
+	suite.True(first == second)
+
+	config.Webservice.Endpoints = []string{"https://other.example.com"}
+	third, err := SharedApiClientWithConfig(config)
+	suite.Require().NoError(err)
+	suite.False(first == third)
+
+	config.LicenseKey = "new-key"
+	fourth, err := SharedApiClientWithConfig(config)
+	suite.Require().NoError(err)
+	suite.False(third == fourth)
+}
@@ -2,7 +2,10 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,9 +13,9 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,9 +25,38 @@ import (
 
 const InsightApiVersion = "v1"
 
+// Returned when the Insight Server responds with an unexpected status code
+type StatusError struct {
+	StatusCode int
+	message    string
+}
+
+func (e *StatusError) Error() string {
+	return e.message
+}
+
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
 type ApiClient struct {
 	httpClient *http.Client
 	config     Config
+	retry      RetryPolicy
+	endpoints  *endpointSelector
+	// Nil if DNS discovery is not enabled
+	discovery *serverDiscoverer
+	// Nil if they are not configured
+	certLoader *clientCertLoader
+	pac        *pacFile
+	cache      responseCache
+
+	// These are replaceable for testing
+	random func(int64) int64
+	sleep  func(context.Context, time.Duration) error
+	// Nil for the system roots
+	roots *x509.CertPool
 }
 
 func NewApiClient(baseFolder string) (*ApiClient, error) {
@@ -38,6 +70,16 @@ func NewApiClient(baseFolder string) (*ApiClient, error) {
 }
 
 func NewApiClientWithConfig(config Config) (*ApiClient, error) {
+	return newApiClient(config, nil)
+}
+
+// Creates a client for the config. The client takes over the failed and discovered endpoints,
+// the PAC file and the client certificate of the previous one, if their settings did not change.
+func newApiClient(config Config, previous *ApiClient) (*ApiClient, error) {
+	if previous == nil {
+		previous = &ApiClient{}
+	}
+
 	// This is a copy of http.DefaultTransport, but certificate check is disabled.
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
@@ -53,58 +95,87 @@ func NewApiClientWithConfig(config Config) (*ApiClient, error) {
 	}
 
 	wsConfig := config.Webservice
+	var certLoader *clientCertLoader
+	if wsConfig.ClientCertificate.enabled() {
+		certLoader = newClientCertLoader(wsConfig.ClientCertificate, config.baseFolder)
+		if certLoader.sameAs(previous.certLoader) {
+			certLoader = previous.certLoader
+		}
+		transport.TLSClientConfig.GetClientCertificate = certLoader.GetClientCertificate
+	}
+	var discovery *serverDiscoverer
+	if wsConfig.Discovery.enabled() {
+		discovery = newServerDiscoverer(wsConfig.Discovery)
+		if discovery.sameAs(previous.discovery) {
+			discovery = previous.discovery
+		}
+		transport.TLSClientConfig.VerifyConnection = discovery.verifyConnection
+	}
+	endpoints := newEndpointSelector(wsConfig.endpointList(), wsConfig.Failover.retryInterval())
+	if endpoints.sameAs(previous.endpoints) {
+		endpoints = previous.endpoints
+	}
+	var pac *pacFile
+	var roundTripper http.RoundTripper = transport
 	if wsConfig.UseProxy {
-		if len(wsConfig.ProxyAddress) == 0 {
-			err := fmt.Errorf("Missing proxy address from config file, but UseProxy is set!")
-			log.Error(err)
-			return nil, err
+		if len(wsConfig.Proxy.PacFile) > 0 {
+			pac = newPacFile(wsConfig.Proxy.PacFile, config.baseFolder)
+			if pac.sameAs(previous.pac) {
+				pac = previous.pac
+			}
 		}
-		proxyUrl, err := url.Parse(wsConfig.ProxyAddress)
+		resolver, err := newProxyResolver(wsConfig, pac)
 		if err != nil {
-			log.Errorf("Could not parse proxy settings: %s from %s. Error message: %s",
-				wsConfig.ProxyAddress, insight_server.AgentConfigFileName, err)
+			log.Errorf("Could not parse proxy settings from %s. Error message: %s",
+				insight_server.AgentConfigFileName, err)
 			return nil, err
 		}
-		transport.Proxy = http.ProxyURL(proxyUrl)
+		roundTripper = resolver.configure(transport)
 	}
 
 	innerClient := &http.Client{
 		// Timeout can be really important, because the default is
 		// to wait forever, which can make our application to hang
 		Timeout:   time.Second * 30,
-		Transport: transport,
+		Transport: roundTripper,
 	}
 
 	return &ApiClient{
 		httpClient: innerClient,
 		config:     config,
+		retry:      config.Webservice.Retry.withDefaults(),
+		endpoints:  endpoints,
+		discovery:  discovery,
+		certLoader: certLoader,
+		pac:        pac,
+		random:     newLockedRandom().Int63n,
+		sleep:      sleepContext,
 	}, nil
 }
 
-func (c *ApiClient) Get(endpoint string) (*http.Response, error) {
+func (c *ApiClient) Get(ctx context.Context, endpoint string) (*http.Response, error) {
+	logger := Log(ctx)
 	url := c.makeApiUrl(endpoint)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		err = fmt.Errorf("Failed to create GET request for %s Error: %v", url, err)
-		log.Error(err)
-		return nil, err
-	}
-
-	// Automatically add the token based authorization header
-	req.Header.Add("Authorization", fmt.Sprintf("Token %s", c.config.LicenseKey))
-
-	resp, err := c.httpClient.Do(req)
+	_, resp, err := c.do(ctx, endpoint, func(url string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create GET request for %s Error: %v", url, err)
+		}
+		return req, nil
+	})
 	if err != nil {
 		err := fmt.Errorf("Failed to GET response from %s! Error: %v", url, err)
-		log.Error(err)
+		logger.Error(err)
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		dump := dumpResponse(resp)
-		err = fmt.Errorf("API client's GET %s failed! Server response: %v",
-			url, dump)
-		log.Error(err)
+		err = &StatusError{
+			StatusCode: resp.StatusCode,
+			message:    fmt.Sprintf("API client's GET %s failed! Server response: %v", url, dump),
+		}
+		logger.Error(err)
 		// Make sure that the response gets closed in this case too
 		resp.Body.Close()
 		return nil, err
@@ -113,53 +184,209 @@ func (c *ApiClient) Get(endpoint string) (*http.Response, error) {
 	return resp, nil
 }
 
-func (c *ApiClient) DownloadFile(endpoint, destinationPath string) error {
-	resp, err := c.Get(endpoint)
+// Sends the request created by newRequest for the URL of the endpoint, and sends it again
+// according to the retry policy if it failed with a network error or a temporary server error.
+// Retries go to the next Insight Server address right away if the current one seems to be down.
+// The last request and response are returned, so the response is not necessarily successful.
+func (c *ApiClient) do(ctx context.Context, endpoint string, newRequest func(url string) (*http.Request, error)) (*http.Request, *http.Response, error) {
+	logger := Log(ctx)
+	if c.discovery != nil {
+		c.endpoints.setDiscovered(c.discovery.discover(ctx).endpoints)
+	}
+	for attempt := 1; ; attempt++ {
+		baseUrl := c.endpoints.current(ctx)
+		req, err := newRequest(c.makeUrl(baseUrl, endpoint))
+		if err != nil {
+			return nil, nil, err
+		}
+		req = req.WithContext(ctx)
+
+		// Automatically add the token based authorization header
+		req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.config.LicenseKey))
+
+		start := time.Now()
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			apiRequestDuration.Observe(time.Since(start).Seconds(), req.Method, "error")
+		} else {
+			apiRequestDuration.Observe(time.Since(start).Seconds(), req.Method, strconv.Itoa(resp.StatusCode))
+		}
+		failover := false
+		if isEndpointFailure(resp, err) {
+			failover = c.endpoints.failed(baseUrl)
+		} else {
+			c.endpoints.succeeded(baseUrl)
+			if resp.StatusCode < 300 {
+				c.checkMigration(ctx, baseUrl, resp)
+			}
+		}
+
+		if attempt >= c.retry.MaxAttempts || ctx.Err() != nil || !isRetryable(req, resp, err) {
+			return req, resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if resp != nil {
+			reason = resp.Status
+		}
+		if failover {
+			if resp != nil {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			logger.Warningf("%s %s failed (attempt %d of %d): %s. Trying the next Insight Server address.",
+				req.Method, req.URL, attempt, c.retry.MaxAttempts, reason)
+			apiRetries.Inc(req.Method)
+			continue
+		}
+
+		delay := c.retry.backoff(attempt, c.random)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > c.retry.MaxDelay {
+					logger.Warningf("%s %s failed with %s and the server asked to retry after %v. Giving up for now.",
+						req.Method, req.URL, reason, retryAfter)
+					return req, resp, err
+				}
+				delay = retryAfter
+			}
+			// Drain the body so that the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		logger.Warningf("%s %s failed (attempt %d of %d): %s. Retrying in %v.",
+			req.Method, req.URL, attempt, c.retry.MaxAttempts, reason, delay)
+		apiRetries.Inc(req.Method)
+		if err := c.sleep(ctx, delay); err != nil {
+			return req, nil, err
+		}
+	}
+}
+
+// Waits for the given duration, unless the context gets cancelled earlier
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ApiClient) DownloadFile(ctx context.Context, endpoint, destinationPath string) error {
+	logger := Log(ctx)
+	start := time.Now()
+	resp, err := c.Get(ctx, endpoint)
 	if err != nil {
+		downloadFailures.Inc("request")
 		return err
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
+	downloadedBytes.Add(float64(len(body)))
 	if err != nil {
-		log.Errorf("Failed to read response contents of URL: %s. Error message: %s", endpoint, err)
+		downloadFailures.Inc("read")
+		logger.Errorf("Failed to read response contents of URL: %s. Error message: %s", endpoint, err)
 		return err
 	}
 
 	// Save the update into the updates folder
 	err = os.MkdirAll(filepath.Dir(destinationPath), 0777)
 	if err != nil {
-		log.Errorf("Failed to create folders for path: '%s' Error: %v", destinationPath, err)
+		downloadFailures.Inc("write")
+		logger.Errorf("Failed to create folders for path: '%s' Error: %v", destinationPath, err)
 		return err
 	}
 
 	err = ioutil.WriteFile(destinationPath, body, 0777)
 	if err != nil {
-		log.Errorf("Failed to save file: %s! Error message: %s", destinationPath, err)
+		downloadFailures.Inc("write")
+		logger.Errorf("Failed to save file: %s! Error message: %s", destinationPath, err)
 		return err
 	}
+	downloadDuration.Observe(time.Since(start).Seconds())
 	return nil
 }
 
-func (c *ApiClient) UploadFile(endpoint, sourcePath string) error {
-	url := c.makeApiUrl(endpoint)
-	req, err := newfileUploadRequest(url, insight_server.UploadFileParam, sourcePath)
+func (c *ApiClient) UploadFile(ctx context.Context, endpoint, sourcePath string) error {
+	logger := Log(ctx)
+	// The same key is sent with every retry, so that the server may recognize repeated uploads
+	idempotencyKey, err := newIdempotencyKey()
 	if err != nil {
-		log.Errorf("Failed to upload file: '%s' Error: %v", sourcePath, err)
+		logger.Errorf("Failed to generate idempotency key for uploading file: '%s' Error: %v", sourcePath, err)
+		return err
+	}
+	req, resp, err := c.do(ctx, endpoint, func(url string) (*http.Request, error) {
+		req, err := newfileUploadRequest(url, insight_server.UploadFileParam, sourcePath)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		return req, nil
+	})
+	if req == nil {
+		logger.Errorf("Failed to upload file: '%s' Error: %v", sourcePath, err)
 		return err
 	}
-	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		dump := dumpRequest(req)
 		err = fmt.Errorf("Client do request failed! Error message: %v\n\tRequest: %v", err, dump)
-		log.Error(err)
+		logger.Error(err)
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		dump := dumpResponse(resp)
 		err = fmt.Errorf("Upload failed for file: %s. Server response: %v", sourcePath, dump)
-		log.Error(err)
+		logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+// Sends the payload as JSON in a POST request
+func (c *ApiClient) PostJSON(ctx context.Context, endpoint string, payload interface{}) error {
+	logger := Log(ctx)
+	url := c.makeApiUrl(endpoint)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Errorf("Failed to serialize payload for %s! Error: %v", url, err)
+		return err
+	}
+	// POST requests are only retried if they have an idempotency key
+	idempotencyKey, err := newIdempotencyKey()
+	if err != nil {
+		logger.Errorf("Failed to generate idempotency key for %s! Error: %v", url, err)
+		return err
+	}
+	_, resp, err := c.do(ctx, endpoint, func(url string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create POST request for %s Error: %v", url, err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		return req, nil
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed to POST to %s! Error: %v", url, err)
+		logger.Error(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		dump := dumpResponse(resp)
+		err = &StatusError{
+			StatusCode: resp.StatusCode,
+			message:    fmt.Sprintf("API client's POST %s failed! Server response: %v", url, dump),
+		}
+		logger.Error(err)
 		return err
 	}
 	return nil
@@ -197,25 +424,46 @@ func newfileUploadRequest(uri string, paramName, path string) (*http.Request, er
 }
 
 func (c *ApiClient) makeApiUrl(endpoint string) string {
-	url := c.config.Webservice.Endpoint
+	return c.makeUrl(c.endpoints.current(context.Background()), endpoint)
+}
+
+// The discovered servers may use another API version
+func (c *ApiClient) makeUrl(baseUrl, endpoint string) string {
+	apiVersion := InsightApiVersion
+	if c.discovery != nil {
+		if discovered := c.discovery.apiVersionFor(baseUrl); len(discovered) > 0 {
+			apiVersion = discovered
+		}
+	}
+	url := baseUrl
 	if !strings.HasPrefix(endpoint, "/api/") {
-		url = fmt.Sprint(url, "/api/", InsightApiVersion)
+		url = fmt.Sprint(url, "/api/", apiVersion)
 	}
 	return fmt.Sprint(url, endpoint)
 }
 
+// Bodies of error responses are cut at this length in dumps
+const maxDumpBodyBytes = 4096
+
+// Dumps the response for error messages with the secrets redacted and the body truncated
 func dumpResponse(resp *http.Response) string {
-	dump, err := httputil.DumpResponse(resp, true)
+	dump, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return Redact(fmt.Sprintf("Response dump failed! Error: %v\n\tRaw response: %v", err, resp))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDumpBodyBytes+1))
 	if err != nil {
-		return fmt.Sprintf("Response dump failed! Error: %v\n\tRaw response: %v", err, resp)
+		return Redact(fmt.Sprintf("%s(failed to read body: %v)", dump, err))
 	}
-	return string(dump)
+	return Redact(string(dump) + Truncate(string(body), maxDumpBodyBytes))
 }
 
+// Dumps the request for error messages with the secrets redacted. The body is left out, as it
+// may be a huge file or a config with secrets in it.
 func dumpRequest(req *http.Request) string {
-	dump, err := httputil.DumpRequestOut(req, true)
+	dump, err := httputil.DumpRequestOut(req, false)
 	if err != nil {
-		return fmt.Sprintf("Request dump failed! Error: %v\n\tRaw request: %v", err, req)
+		return Redact(fmt.Sprintf("Request dump failed! Error: %v\n\tRaw request: %v %v", err, req.Method, req.URL))
 	}
-	return string(dump)
+	return Redact(fmt.Sprintf("%s(body of %d bytes left out)", dump, req.ContentLength))
 }
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+const AuditLogFileName = "audit.log"
+
+// Longer lines are not read as audit entries
+const maxAuditEntrySize = 1024 * 1024
+
+// An entry of the audit log. Every entry contains the hash of the previous one, so removing or
+// changing an entry in the middle of the log breaks the chain.
+type AuditEntry struct {
+	Seq         int64             `json:"seq"`
+	Time        time.Time         `json:"time"`
+	Action      string            `json:"action"`
+	Initiator   string            `json:"initiator"`
+	OperationId string            `json:"operationId,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	PrevHash    string            `json:"prevHash"`
+	Hash        string            `json:"hash"`
+}
+
+// The hash of the entry with an empty Hash field
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	entryBytes, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(entryBytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// An append-only, hash-chained log of the actions. It is never rotated. Both the watchdog service
+// and the command line append to it, so the last entry is read under an exclusive file lock before
+// every append instead of being cached. Nothing is appended after an invalid last entry.
+type AuditLog struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// Opens the audit log and checks that its last entry can be continued. The log is created by
+// the first entry.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &AuditLog{path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return nil, err
+	}
+	defer unlockFile(file)
+
+	if _, _, err := readLastAuditEntry(file); err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path}, nil
+}
+
+// Returns the sequence number and hash of the last entry, which the next entry continues. Only the
+// end of the log is read. The last entry has to be complete and unmodified, otherwise the chain
+// cannot be continued.
+func readLastAuditEntry(file *os.File) (int64, string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, "", nil
+	}
+
+	var lastLine []byte
+	for chunk := int64(4096); ; chunk *= 2 {
+		if chunk > size {
+			chunk = size
+		}
+		tail := make([]byte, chunk)
+		if _, err := file.ReadAt(tail, size-chunk); err != nil {
+			return 0, "", err
+		}
+		if tail[len(tail)-1] != '\n' {
+			return 0, "", fmt.Errorf("The last entry of the audit log is incomplete")
+		}
+		start := bytes.LastIndexByte(tail[:len(tail)-1], '\n')
+		if start >= 0 || chunk == size {
+			lastLine = tail[start+1 : len(tail)-1]
+			break
+		}
+		if chunk > maxAuditEntrySize {
+			return 0, "", fmt.Errorf("The last entry of the audit log is longer than %d bytes", maxAuditEntrySize)
+		}
+	}
+
+	var entry AuditEntry
+	if err := json.Unmarshal(lastLine, &entry); err != nil {
+		return 0, "", fmt.Errorf("The last entry of the audit log is invalid: %v", err)
+	}
+	hash, err := entry.computeHash()
+	if err != nil {
+		return 0, "", err
+	}
+	if hash != entry.Hash {
+		return 0, "", fmt.Errorf("The last entry #%d of the audit log has been modified", entry.Seq)
+	}
+	return entry.Seq, entry.Hash, nil
+}
+
+func newAuditScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditEntrySize)
+	return scanner
+}
+
+// Appends an entry to the audit log. The details are key/value pairs. The hash of the entry is
+// logged too, so that the normal logs, which are shipped off the host, reveal a truncated audit log.
+func (a *AuditLog) Record(ctx context.Context, action, initiator string, actionErr error, details ...string) error {
+	entry := AuditEntry{
+		Time:        time.Now().UTC(),
+		Action:      action,
+		Initiator:   initiator,
+		OperationId: OperationId(ctx),
+	}
+	if len(details) > 0 {
+		entry.Details = make(map[string]string)
+		for i := 0; i+1 < len(details); i += 2 {
+			entry.Details[details[i]] = Redact(details[i+1])
+		}
+	}
+	if actionErr != nil {
+		entry.Error = Redact(actionErr.Error())
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	file, err := os.OpenFile(a.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return err
+	}
+	defer unlockFile(file)
+
+	seq, lastHash, err := readLastAuditEntry(file)
+	if err != nil {
+		return fmt.Errorf("Refusing to append to the audit log %s! Error: %v", a.path, err)
+	}
+	entry.Seq = seq + 1
+	entry.PrevHash = lastHash
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(entryBytes, '\n')); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	Log(ctx).With("action", action, "initiator", initiator, "audit_seq", entry.Seq, "audit_hash", entry.Hash).
+		Info("Recorded audit entry")
+	return nil
+}
+
+// Checks the hash chain of the audit log. Returns the number of entries and the first problem found.
+func VerifyAuditLog(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var count int64
+	prevHash := ""
+	line := 0
+	scanner := newAuditScanner(file)
+	for scanner.Scan() {
+		line++
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, fmt.Errorf("Line %d is not a valid audit entry: %v", line, err)
+		}
+		if entry.Seq != count+1 {
+			return count, fmt.Errorf("Line %d: expected entry #%d, found #%d", line, count+1, entry.Seq)
+		}
+		if entry.PrevHash != prevHash {
+			return count, fmt.Errorf("Line %d: entry #%d does not follow the previous entry", line, entry.Seq)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return count, err
+		}
+		if hash != entry.Hash {
+			return count, fmt.Errorf("Line %d: entry #%d has been modified", line, entry.Seq)
+		}
+		count++
+		prevHash = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	log.Debugf("Verified %d audit entries in %s", count, path)
+	return count, nil
+}
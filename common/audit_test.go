@@ -0,0 +1,133 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditTestSuite struct {
+	suite.Suite
+	folder string
+	path   string
+}
+
+func TestAuditTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditTestSuite))
+}
+
+func (suite *AuditTestSuite) SetupTest() {
+	var err error
+	suite.folder, err = ioutil.TempDir("", "audit")
+	suite.Require().NoError(err)
+	suite.path = filepath.Join(suite.folder, AuditLogFileName)
+}
+
+func (suite *AuditTestSuite) TearDownTest() {
+	os.RemoveAll(suite.folder)
+}
+
+func (suite *AuditTestSuite) record(count int) {
+	auditLog, err := OpenAuditLog(suite.path)
+	suite.Require().NoError(err)
+	ctx := WithOperationId(context.Background(), "abc")
+	for i := 0; i < count; i++ {
+		suite.Require().NoError(auditLog.Record(ctx, "agent-restart", "watchdog", nil, "reason", "test"))
+	}
+}
+
+func (suite *AuditTestSuite) TestVerify() {
+	suite.record(2)
+	// The chain continues after reopening the log
+	suite.record(1)
+
+	auditLog, err := OpenAuditLog(suite.path)
+	suite.Require().NoError(err)
+	suite.NoError(auditLog.Record(context.Background(), "config-applied", "server", errors.New("failed"),
+		"before", "1", "after", "2"))
+
+	count, err := VerifyAuditLog(suite.path)
+	suite.NoError(err)
+	suite.Equal(int64(4), count)
+}
+
+func (suite *AuditTestSuite) TestVerify_modified() {
+	suite.record(3)
+	content, err := ioutil.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	modified := bytes.Replace(content, []byte(`"reason":"test"`), []byte(`"reason":"fake"`), 1)
+	suite.Require().NoError(ioutil.WriteFile(suite.path, modified, 0600))
+
+	count, err := VerifyAuditLog(suite.path)
+	suite.Error(err)
+	suite.Equal(int64(0), count)
+}
+
+func (suite *AuditTestSuite) TestVerify_removed() {
+	suite.record(3)
+	content, err := ioutil.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	suite.Require().NoError(ioutil.WriteFile(suite.path, append(lines[0], lines[2]...), 0600))
+
+	count, err := VerifyAuditLog(suite.path)
+	suite.Error(err)
+	suite.Equal(int64(1), count)
+}
+
+func (suite *AuditTestSuite) TestVerify_twoWriters() {
+	// The watchdog service and the command line append to the same log
+	service, err := OpenAuditLog(suite.path)
+	suite.Require().NoError(err)
+	cli, err := OpenAuditLog(suite.path)
+	suite.Require().NoError(err)
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(service.Record(context.Background(), "agent-restart", "watchdog", nil))
+		suite.Require().NoError(cli.Record(context.Background(), "agent-stop", "cli:admin", nil))
+	}
+
+	count, err := VerifyAuditLog(suite.path)
+	suite.NoError(err)
+	suite.Equal(int64(6), count)
+}
+
+func (suite *AuditTestSuite) TestRecord_refusesInvalidLastEntry() {
+	suite.record(2)
+	auditLog, err := OpenAuditLog(suite.path)
+	suite.Require().NoError(err)
+	content, err := ioutil.ReadFile(suite.path)
+	suite.Require().NoError(err)
+
+	for _, corrupted := range [][]byte{
+		append(content, []byte(`{"seq":3`)...),
+		append(content, []byte("not an entry\n")...),
+		bytes.Replace(content, []byte(`"seq":2`), []byte(`"seq":5`), 1),
+	} {
+		suite.Require().NoError(ioutil.WriteFile(suite.path, corrupted, 0600))
+		suite.Error(auditLog.Record(context.Background(), "agent-restart", "watchdog", nil))
+		_, err = OpenAuditLog(suite.path)
+		suite.Error(err)
+		after, err := ioutil.ReadFile(suite.path)
+		suite.Require().NoError(err)
+		suite.Equal(corrupted, after)
+	}
+}
+
+func (suite *AuditTestSuite) TestRecord_longEntries() {
+	auditLog, err := OpenAuditLog(suite.path)
+	suite.Require().NoError(err)
+	long := string(bytes.Repeat([]byte("x"), 10000))
+	for i := 0; i < 3; i++ {
+		suite.Require().NoError(auditLog.Record(context.Background(), "config-applied", "server", nil, "config", long))
+	}
+
+	count, err := VerifyAuditLog(suite.path)
+	suite.NoError(err)
+	suite.Equal(int64(3), count)
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+	"golang.org/x/crypto/pkcs12"
+)
+
+const (
+	defaultCertExpiryWarning = 30 * 24 * time.Hour
+	// The expiry warning is repeated this often
+	certExpiryWarningInterval = 24 * time.Hour
+)
+
+// The client certificate is presented to the Insight Server for mutual TLS authentication. Either
+// CertFile and KeyFile (PEM) or Pkcs12File (with Pkcs12Password) have to be given. Relative paths
+// are relative to the installation folder.
+type ClientCertificate struct {
+	CertFile       string `yaml:"CertFile"`
+	KeyFile        string `yaml:"KeyFile"`
+	Pkcs12File     string `yaml:"Pkcs12File"`
+	Pkcs12Password string `yaml:"Pkcs12Password"`
+	// A warning is logged if the certificate expires within this time, 30 days by default
+	ExpiryWarning time.Duration `yaml:"ExpiryWarning"`
+}
+
+func (c ClientCertificate) enabled() bool {
+	return len(c.CertFile) > 0 || len(c.Pkcs12File) > 0
+}
+
+// Loads the client certificate again whenever its files change, so that a renewed certificate
+// is used without a restart
+type clientCertLoader struct {
+	config ClientCertificate
+	paths  []string
+
+	mutex       sync.Mutex
+	cert        *tls.Certificate
+	modTimes    []time.Time
+	lastWarning time.Time
+}
+
+func newClientCertLoader(config ClientCertificate, baseFolder string) *clientCertLoader {
+	var paths []string
+	for _, path := range []string{config.CertFile, config.KeyFile, config.Pkcs12File} {
+		if len(path) == 0 {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseFolder, path)
+		}
+		paths = append(paths, path)
+	}
+	return &clientCertLoader{config: config, paths: paths}
+}
+
+// Whether the other loader loads the same files in the same way, so that it can be kept
+func (l *clientCertLoader) sameAs(other *clientCertLoader) bool {
+	return other != nil && l.config == other.config && reflect.DeepEqual(l.paths, other.paths)
+}
+
+// Implements tls.Config.GetClientCertificate. If the certificate cannot be loaded, the previous
+// one is kept, or no certificate is presented.
+func (l *clientCertLoader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.reloadIfChanged(); err != nil {
+		log.Error("Failed to load client certificate! Error: ", err)
+	}
+	if l.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	l.warnIfExpiring(time.Now())
+	return l.cert, nil
+}
+
+func (l *clientCertLoader) reloadIfChanged() error {
+	modTimes := make([]time.Time, len(l.paths))
+	changed := l.cert == nil
+	for i, path := range l.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+		if i >= len(l.modTimes) || !modTimes[i].Equal(l.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	cert, err := loadClientCertificate(l.paths, l.config)
+	if err != nil {
+		return err
+	}
+	if l.cert != nil {
+		log.Info("Reloaded client certificate from ", l.paths)
+	}
+	l.cert = cert
+	l.modTimes = modTimes
+	// Warn about the new certificate right away
+	l.lastWarning = time.Time{}
+	return nil
+}
+
+func (l *clientCertLoader) warnIfExpiring(now time.Time) {
+	if l.cert.Leaf == nil || now.Sub(l.lastWarning) < certExpiryWarningInterval {
+		return
+	}
+	expiryWarning := l.config.ExpiryWarning
+	if expiryWarning <= 0 {
+		expiryWarning = defaultCertExpiryWarning
+	}
+	notAfter := l.cert.Leaf.NotAfter
+	if notAfter.Sub(now) > expiryWarning {
+		return
+	}
+	l.lastWarning = now
+	if notAfter.Before(now) {
+		log.Errorf("Client certificate %s expired at %s!", l.cert.Leaf.Subject.CommonName, notAfter.Format(time.RFC3339))
+		return
+	}
+	log.Warningf("Client certificate %s expires at %s! Renew it in time.", l.cert.Leaf.Subject.CommonName,
+		notAfter.Format(time.RFC3339))
+}
+
+// Loads the certificate and its key from PEM files or from a PKCS#12 file
+func loadClientCertificate(paths []string, config ClientCertificate) (*tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	if len(config.Pkcs12File) > 0 {
+		cert, err = loadPkcs12(paths[len(paths)-1], config.Pkcs12Password)
+	} else {
+		if len(paths) != 2 {
+			return nil, fmt.Errorf("Both CertFile and KeyFile are needed for the client certificate")
+		}
+		cert, err = tls.LoadX509KeyPair(paths[0], paths[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func loadPkcs12(path, password string) (tls.Certificate, error) {
+	pfxBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	blocks, err := pkcs12.ToPEM(pfxBytes, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Failed to decode %s! Error: %v", path, err)
+	}
+	// The certificate of the key comes first, followed by the rest of the chain
+	var certPem, keyPem []byte
+	for _, block := range blocks {
+		if block.Type == "CERTIFICATE" {
+			if _, isKeyCert := block.Headers["localKeyId"]; isKeyCert {
+				certPem = append(pem.EncodeToMemory(block), certPem...)
+				continue
+			}
+			certPem = append(certPem, pem.EncodeToMemory(block)...)
+		} else {
+			keyPem = append(keyPem, pem.EncodeToMemory(block)...)
+		}
+	}
+	return tls.X509KeyPair(certPem, keyPem)
+}
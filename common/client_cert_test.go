@@ -0,0 +1,141 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// A self-signed certificate with CN pkcs12-client valid for 100 years, protected by "secret"
+const testPkcs12 = "MIIDigIBAzCCA1AGCSqGSIb3DQEHAaCCA0EEggM9MIIDOTCCAi8GCSqGSIb3DQEHBqCCAiAwggIcAgEAMIICFQYJKoZIhvcNAQcB" +
+	"MBwGCiqGSIb3DQEMAQYwDgQIhUxJwlqiAxgCAggAgIIB6Aj+Q2TGrmKVmLD4n4cYH+/KT+UZoWR/g5cDx0Ebz8GsnQfWqwV2Ej55" +
+	"Byz80O26JHHbWTfHPzfTiD7cXte0XKpuw2hiMikAuHkmk6Nn+zftTDo5/vY03tvMad1GjG7kskEqibSccF2T/kam42J3HRW4026p" +
+	"0EofwkRlfcih89gzNTa5lybgDduvMZ99+y8SpOP9hBZXtwbnCxURgwgkkzCjaGfmif03d4D21hx4Q8WLOfL8IXB5ag0XNzvieTui" +
+	"fG/Clnc944qV5ZXpV9w/YiuawldPKcD9RB6YfWZlk9x5oB7qOnK6pIS2gOmxRemiMUAw7jvXhaEkA2NGEV++iyUkOlZ/PoVOgsDr" +
+	"vkxMzN4pfLkdI5HTsBEe0yI8vjTuAOq0kSSPVY2K1/2iwwMvNmlcE8LyyG8J6J68jPFuuwPKjxOaZHeZnJkp0Gai7OHJ6rVWElSl" +
+	"HNHIHlV/VEjmpOSS6pPnuzV29jvo7IiFwPnrz16frykzue/1fr0vfgzTFv3NcK/X6/PAGdLv3aOir6bRj/mICdP04ssHuZ0OEQOb" +
+	"xZmJKs25X9+D+OaMWE2CD2AhG+9nUBOpbIx3TXs9cxibC7H6UuYQxVwD8B4GcYyObKOqHDkat6wo4QXjEhP8STL+35p+V9XsMIIB" +
+	"AgYJKoZIhvcNAQcBoIH0BIHxMIHuMIHrBgsqhkiG9w0BDAoBAqCBtDCBsTAcBgoqhkiG9w0BDAEDMA4ECFJ/hm7gQ7rtAgIIAASB" +
+	"kH2uP55G4seQxCpQDngB2hwD0BUa82LXhKwEY8vMEWcc4HxMZPIYGlngJWfJblx893cih9hg9mekh7FJIyezHbUj8RegFR2t8/f7" +
+	"Ewd9afskL7RBChe60FEHXGWsXyl/VVmi16xcrLnrZHB0hyuM7OLzDq4AjVH6o9HWqeB32PAkuPRqqefO+83eij5fFOQQRDElMCMG" +
+	"CSqGSIb3DQEJFTEWBBRtKBVbiG3AnnZu6T1PWKNqLBsWUjAxMCEwCQYFKw4DAhoFAAQULBPAtqUM4gGGSKWa28vuGwSKT4kECITs" +
+	"WKQ208IyAgIIAA=="
+
+type ClientCertTestSuite struct {
+	suite.Suite
+	folder string
+}
+
+func TestClientCertTestSuite(t *testing.T) {
+	suite.Run(t, new(ClientCertTestSuite))
+}
+
+func (suite *ClientCertTestSuite) SetupTest() {
+	var err error
+	suite.folder, err = ioutil.TempDir("", "client-cert")
+	suite.Require().NoError(err)
+}
+
+func (suite *ClientCertTestSuite) TearDownTest() {
+	os.RemoveAll(suite.folder)
+}
+
+// Writes a self-signed certificate and its key into cert.pem and key.pem
+func (suite *ClientCertTestSuite) writeCertificate(commonName string, notAfter time.Time, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	suite.Require().NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	suite.Require().NoError(err)
+
+	certPath := filepath.Join(suite.folder, "cert.pem")
+	keyPath := filepath.Join(suite.folder, "key.pem")
+	suite.Require().NoError(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600))
+	suite.Require().NoError(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	suite.Require().NoError(os.Chtimes(certPath, modTime, modTime))
+	suite.Require().NoError(os.Chtimes(keyPath, modTime, modTime))
+}
+
+func (suite *ClientCertTestSuite) TestApiClient_presentsCertificate() {
+	var clientNames []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientNames = append(clientNames, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	now := time.Now()
+	suite.writeCertificate("first", now.Add(365*24*time.Hour), now.Add(-time.Hour))
+	config := Config{baseFolder: suite.folder}
+	config.Webservice.Endpoint = server.URL
+	config.Webservice.ClientCertificate = ClientCertificate{CertFile: "cert.pem", KeyFile: "key.pem"}
+
+	client, err := NewApiClientWithConfig(config)
+	suite.Require().NoError(err)
+	resp, err := client.Get(context.Background(), "/ping")
+	suite.Require().NoError(err)
+	resp.Body.Close()
+
+	// A renewed certificate is used by new connections without a new client
+	suite.writeCertificate("second", now.Add(365*24*time.Hour), now)
+	client.httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	resp, err = client.Get(context.Background(), "/ping")
+	suite.Require().NoError(err)
+	resp.Body.Close()
+
+	suite.Equal([]string{"first", "second"}, clientNames)
+}
+
+func (suite *ClientCertTestSuite) TestWarnIfExpiring() {
+	now := time.Now()
+	suite.writeCertificate("expiring", now.Add(24*time.Hour), now)
+	loader := newClientCertLoader(ClientCertificate{CertFile: "cert.pem", KeyFile: "key.pem"}, suite.folder)
+	cert, err := loader.GetClientCertificate(nil)
+	suite.Require().NoError(err)
+	suite.Equal("expiring", cert.Leaf.Subject.CommonName)
+	suite.False(loader.lastWarning.IsZero())
+
+	loader.lastWarning = time.Time{}
+	loader.config.ExpiryWarning = time.Hour
+	loader.warnIfExpiring(now)
+	suite.True(loader.lastWarning.IsZero())
+}
+
+func (suite *ClientCertTestSuite) TestLoadPkcs12() {
+	pfx, err := base64.StdEncoding.DecodeString(testPkcs12)
+	suite.Require().NoError(err)
+	path := filepath.Join(suite.folder, "client.p12")
+	suite.Require().NoError(ioutil.WriteFile(path, pfx, 0600))
+
+	cert, err := loadClientCertificate([]string{path}, ClientCertificate{Pkcs12File: path, Pkcs12Password: "secret"})
+	suite.Require().NoError(err)
+	suite.Equal("pkcs12-client", cert.Leaf.Subject.CommonName)
+
+	_, err = loadClientCertificate([]string{path}, ClientCertificate{Pkcs12File: path, Pkcs12Password: "wrong"})
+	suite.Error(err)
+}
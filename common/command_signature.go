@@ -0,0 +1,157 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/yaml.v2"
+)
+
+// The command signing settings are kept next to Config.yml, but not in it, so that GET-CONFIG
+// cannot replace the key or accept unsigned commands
+const CommandSigningFileName = "CommandSigning.yml"
+
+// Remote commands have to be signed with the private key of ServerPublicKey (base64 encoded
+// Ed25519). Unsigned commands are only accepted if AllowUnsigned is set for legacy servers.
+type CommandSigning struct {
+	ServerPublicKey string `yaml:"ServerPublicKey"`
+	AllowUnsigned   bool   `yaml:"AllowUnsigned"`
+}
+
+// Reads the command signing settings from the Config folder. Hosts upgraded from a version without
+// signed commands have no such file, so every remote command is rejected on them until it is
+// created. The returned error tells why commands are rejected, and the settings are usable anyway.
+func LoadCommandSigning(baseFolder string) (CommandSigning, error) {
+	path := filepath.Join(baseFolder, "Config", CommandSigningFileName)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return CommandSigning{}, fmt.Errorf("There is no %s, so every remote command is rejected, including GET-CONFIG! "+
+			"Create it with the ServerPublicKey of the Insight Server, or with AllowUnsigned: true for legacy servers.", path)
+	}
+	if err != nil {
+		return CommandSigning{}, fmt.Errorf("Failed to read %s, so every remote command is rejected! Error: %v", path, err)
+	}
+
+	var signing CommandSigning
+	if err := yaml.Unmarshal(content, &signing); err != nil {
+		return CommandSigning{}, fmt.Errorf("Invalid %s, so every remote command is rejected! Error: %v", path, err)
+	}
+	if len(signing.ServerPublicKey) > 0 {
+		if _, err := ParseCommandPublicKey(signing.ServerPublicKey); err != nil {
+			return CommandSigning{AllowUnsigned: signing.AllowUnsigned},
+				fmt.Errorf("Signed remote commands are rejected, as the key in %s is invalid! Error: %v", path, err)
+		}
+	} else if !signing.AllowUnsigned {
+		return signing, fmt.Errorf("There is no ServerPublicKey in %s, so every remote command is rejected!", path)
+	}
+	return signing, nil
+}
+
+// The fields of a remote command covered by its signature
+type SignedCommandFields struct {
+	Id       string            `json:"id"`
+	Hostname string            `json:"hostname"`
+	Command  string            `json:"command"`
+	Params   map[string]string `json:"params"`
+	Expires  string            `json:"expires"`
+}
+
+// The signed message is the JSON object of the fields in this order, without whitespace, with
+// the params sorted by key and with a null params if there are none. This is what json.Marshal
+// produces.
+func (f SignedCommandFields) Payload() ([]byte, error) {
+	if len(f.Params) == 0 {
+		f.Params = nil
+	}
+	return json.Marshal(f)
+}
+
+// Parses a base64 encoded Ed25519 public key
+func ParseCommandPublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid command public key! Error: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid command public key size: %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Checks the base64 encoded Ed25519 signature of the command fields
+func VerifyCommandSignature(publicKey ed25519.PublicKey, fields SignedCommandFields, signature string) error {
+	if len(signature) == 0 {
+		return fmt.Errorf("Command %s is not signed", fields.Id)
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature of command %s! Error: %v", fields.Id, err)
+	}
+	payload, err := fields.Payload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, payload, signatureBytes) {
+		return fmt.Errorf("Signature of command %s is invalid", fields.Id)
+	}
+	return nil
+}
+
+// Remembers the IDs of the signed commands performed until they expire, so that they are not
+// performed again. The IDs are kept in a file, so that restarting the watchdog does not help replays.
+type CommandReplayGuard struct {
+	mutex sync.Mutex
+	path  string
+	// Expiry of the commands by ID
+	performed map[string]time.Time
+}
+
+// Loads the performed commands. A missing or broken file is reported, but an empty guard is returned.
+func NewCommandReplayGuard(path string) (*CommandReplayGuard, error) {
+	guard := &CommandReplayGuard{path: path, performed: make(map[string]time.Time)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return guard, nil
+	}
+	if err != nil {
+		return guard, err
+	}
+	if err := json.Unmarshal(content, &guard.performed); err != nil {
+		guard.performed = make(map[string]time.Time)
+		return guard, fmt.Errorf("Invalid performed commands file: %s Error: %v", path, err)
+	}
+	return guard, nil
+}
+
+// Returns true if the command has been performed already
+func (g *CommandReplayGuard) Performed(id string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	_, found := g.performed[id]
+	return found
+}
+
+// Remembers the command until it expires and forgets the expired ones
+func (g *CommandReplayGuard) Remember(id string, expires time.Time, now time.Time) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for performedId, performedExpires := range g.performed {
+		if performedExpires.Before(now) {
+			delete(g.performed, performedId)
+		}
+	}
+	g.performed[id] = expires
+
+	content, err := json.Marshal(g.performed)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(g.path, content, 0600)
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ed25519"
+)
+
+type CommandSignatureTestSuite struct {
+	suite.Suite
+	publicKey  ed25519.PublicKey
+	privateKey ed25519.PrivateKey
+}
+
+func TestCommandSignatureTestSuite(t *testing.T) {
+	suite.Run(t, new(CommandSignatureTestSuite))
+}
+
+func (suite *CommandSignatureTestSuite) SetupTest() {
+	var err error
+	suite.publicKey, suite.privateKey, err = ed25519.GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+}
+
+func (suite *CommandSignatureTestSuite) sign(fields SignedCommandFields) string {
+	payload, err := fields.Payload()
+	suite.Require().NoError(err)
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(suite.privateKey, payload))
+}
+
+func (suite *CommandSignatureTestSuite) TestPayload() {
+	fields := SignedCommandFields{Id: "1", Hostname: "host", Command: "SET-LOG-LEVEL",
+		Params: map[string]string{"level": "debug", "expiry": "1h"}, Expires: "2026-10-19T12:00:00Z"}
+	payload, err := fields.Payload()
+	suite.NoError(err)
+	suite.Equal(`{"id":"1","hostname":"host","command":"SET-LOG-LEVEL","params":{"expiry":"1h","level":"debug"},`+
+		`"expires":"2026-10-19T12:00:00Z"}`, string(payload))
+
+	fields = SignedCommandFields{Id: "2", Command: "stop", Params: map[string]string{}}
+	payload, err = fields.Payload()
+	suite.NoError(err)
+	suite.Equal(`{"id":"2","hostname":"","command":"stop","params":null,"expires":""}`, string(payload))
+}
+
+func (suite *CommandSignatureTestSuite) TestVerifyCommandSignature() {
+	publicKey, err := ParseCommandPublicKey(base64.StdEncoding.EncodeToString(suite.publicKey))
+	suite.Require().NoError(err)
+
+	fields := SignedCommandFields{Id: "1", Hostname: "host", Command: "stop", Expires: "2026-10-19T12:00:00Z"}
+	signature := suite.sign(fields)
+	suite.NoError(VerifyCommandSignature(publicKey, fields, signature))
+
+	suite.Error(VerifyCommandSignature(publicKey, fields, ""))
+	suite.Error(VerifyCommandSignature(publicKey, fields, "not base64"))
+	fields.Command = "start"
+	suite.Error(VerifyCommandSignature(publicKey, fields, signature))
+
+	_, err = ParseCommandPublicKey("c2hvcnQ=")
+	suite.Error(err)
+}
+
+func (suite *CommandSignatureTestSuite) TestCommandReplayGuard() {
+	folder, err := ioutil.TempDir("", "replay")
+	suite.Require().NoError(err)
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, "performed.json")
+
+	now := time.Now()
+	guard, err := NewCommandReplayGuard(path)
+	suite.Require().NoError(err)
+	suite.False(guard.Performed("1"))
+	suite.NoError(guard.Remember("1", now.Add(-time.Second), now.Add(-time.Minute)))
+	suite.NoError(guard.Remember("2", now.Add(time.Hour), now))
+	suite.True(guard.Performed("2"))
+
+	// Kept after a restart, but the expired commands are forgotten
+	guard, err = NewCommandReplayGuard(path)
+	suite.Require().NoError(err)
+	suite.True(guard.Performed("2"))
+	suite.False(guard.Performed("1"))
+}
+
+func (suite *CommandSignatureTestSuite) writeCommandSigning(baseFolder, content string) {
+	suite.Require().NoError(os.MkdirAll(filepath.Join(baseFolder, "Config"), 0755))
+	path := filepath.Join(baseFolder, "Config", CommandSigningFileName)
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+func (suite *CommandSignatureTestSuite) TestLoadCommandSigning() {
+	baseFolder, err := ioutil.TempDir("", "signing")
+	suite.Require().NoError(err)
+	defer os.RemoveAll(baseFolder)
+
+	// Every host upgraded from a version without signed commands is like this
+	signing, err := LoadCommandSigning(baseFolder)
+	suite.Error(err)
+	suite.Contains(err.Error(), CommandSigningFileName)
+	suite.Equal(CommandSigning{}, signing)
+
+	encodedKey := base64.StdEncoding.EncodeToString(suite.publicKey)
+	suite.writeCommandSigning(baseFolder, "ServerPublicKey: "+encodedKey+"\n")
+	signing, err = LoadCommandSigning(baseFolder)
+	suite.NoError(err)
+	suite.Equal(CommandSigning{ServerPublicKey: encodedKey}, signing)
+
+	suite.writeCommandSigning(baseFolder, "AllowUnsigned: true\n")
+	signing, err = LoadCommandSigning(baseFolder)
+	suite.NoError(err)
+	suite.Equal(CommandSigning{AllowUnsigned: true}, signing)
+
+	suite.writeCommandSigning(baseFolder, "ServerPublicKey: c2hvcnQ=\nAllowUnsigned: true\n")
+	signing, err = LoadCommandSigning(baseFolder)
+	suite.Error(err)
+	suite.Equal(CommandSigning{AllowUnsigned: true}, signing)
+
+	suite.writeCommandSigning(baseFolder, "ServerPublicKey: [\n")
+	signing, err = LoadCommandSigning(baseFolder)
+	suite.Error(err)
+	suite.Equal(CommandSigning{}, signing)
+}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	log "github.com/palette-software/go-log-targets"
 
@@ -12,14 +13,138 @@ import (
 )
 
 type Config struct {
-	LicenseKey string     `yaml:"LicenseKey"`
-	Webservice Webservice `yaml:"Webservice"`
+	LicenseKey string         `yaml:"LicenseKey"`
+	Webservice Webservice     `yaml:"Webservice"`
+	Watchdog   WatchdogConfig `yaml:"Watchdog"`
+
+	// The installation folder, which relative paths in the config are relative to
+	baseFolder string
+	// The config file, which the new address of a moved Insight Server is saved into
+	filePath string
 }
 
 type Webservice struct {
-	Endpoint     string `yaml:"Endpoint"`
-	UseProxy     bool   `yaml:"UseProxy"`
-	ProxyAddress string `yaml:"ProxyAddress"`
+	Endpoint string `yaml:"Endpoint"`
+	// Fallback endpoints, which are tried in order if Endpoint is not reachable
+	Endpoints         []string          `yaml:"Endpoints"`
+	Failover          Failover          `yaml:"Failover"`
+	Discovery         Discovery         `yaml:"Discovery"`
+	UseProxy          bool              `yaml:"UseProxy"`
+	ProxyAddress      string            `yaml:"ProxyAddress"`
+	Proxy             ProxyConfig       `yaml:"Proxy"`
+	Retry             RetryPolicy       `yaml:"Retry"`
+	ClientCertificate ClientCertificate `yaml:"ClientCertificate"`
+}
+
+// Settings which are only used by the watchdog and the manager. The agent ignores this section.
+type WatchdogConfig struct {
+	Logging        Logging        `yaml:"Logging"`
+	StatusApi      StatusApi      `yaml:"StatusApi"`
+	Metrics        Metrics        `yaml:"Metrics"`
+	Updates        Updates        `yaml:"Updates"`
+	CrashLoop      CrashLoop      `yaml:"CrashLoop"`
+	HealthChecks   HealthChecks   `yaml:"HealthChecks"`
+	ResourceLimits ResourceLimits `yaml:"ResourceLimits"`
+}
+
+// If no sinks are configured, logs are written into the log file and sent to Palette's Splunk
+type Logging struct {
+	Sinks []LogSink `yaml:"Sinks"`
+	// Regular expressions of additional secrets to be redacted from every log sink
+	RedactPatterns []string `yaml:"RedactPatterns"`
+}
+
+// Type is one of file, splunk, syslog or http. The rest of the settings depend on the type.
+type LogSink struct {
+	Type string `yaml:"Type"`
+	// Minimum level of the log lines sent to the sink, debug by default
+	Level string `yaml:"Level"`
+	// Address and Token of the Splunk HTTP Event Collector, Palette's Splunk by default.
+	// For syslog, Address is the host:port of the server.
+	Address string `yaml:"Address"`
+	Token   string `yaml:"Token"`
+	// Syslog network (udp or tcp) and the tag (app name) of the messages
+	Network string `yaml:"Network"`
+	Tag     string `yaml:"Tag"`
+	// The http sink POSTs the log lines as a JSON array to Url with the extra Headers
+	Url     string            `yaml:"Url"`
+	Headers map[string]string `yaml:"Headers"`
+}
+
+// The status API listens only on the loopback interface. POST endpoints require the token of
+// Config\StatusApi.token in an "Authorization: Token <token>" header and are disabled without it.
+type StatusApi struct {
+	Enabled bool `yaml:"Enabled"`
+	Port    int  `yaml:"Port"`
+}
+
+// Prometheus metrics are served on http://<ListenAddress>:<Port>/metrics
+// ListenAddress defaults to the loopback interface.
+type Metrics struct {
+	Enabled       bool   `yaml:"Enabled"`
+	ListenAddress string `yaml:"ListenAddress"`
+	Port          int    `yaml:"Port"`
+}
+
+type Updates struct {
+	// If set, agent updates are taken from this local folder or network share instead
+	// of the Insight Server
+	OfflineFolder string `yaml:"OfflineFolder"`
+	// Updates marked as not mandatory in the update manifest are only installed if this is set
+	InstallOptional bool `yaml:"InstallOptional"`
+}
+
+// The agent is in a crash loop if the alive check had to restart it MaxRestarts times within Window
+type CrashLoop struct {
+	MaxRestarts int           `yaml:"MaxRestarts"`
+	Window      time.Duration `yaml:"Window"`
+	MaxBackoff  time.Duration `yaml:"MaxBackoff"`
+	// Number of agent log lines to send with the crash loop alert
+	AgentLogLines int `yaml:"AgentLogLines"`
+	// Reinstall the previous agent version in case of a crash loop
+	Rollback bool `yaml:"Rollback"`
+}
+
+// Health checks of the running agent. A check is enabled if its settings are given. The agent
+// is restarted if any of the checks fail FailureThreshold times in a row.
+type HealthChecks struct {
+	FailureThreshold int             `yaml:"FailureThreshold"`
+	Heartbeat        HeartbeatCheck  `yaml:"Heartbeat"`
+	Http             HttpCheck       `yaml:"Http"`
+	LastUpload       LastUploadCheck `yaml:"LastUpload"`
+}
+
+// The agent is expected to touch File at least every MaxAge. Relative paths are relative
+// to the installation folder.
+type HeartbeatCheck struct {
+	File   string        `yaml:"File"`
+	MaxAge time.Duration `yaml:"MaxAge"`
+}
+
+// The agent is expected to respond with a 2xx status code on Url
+type HttpCheck struct {
+	Url     string        `yaml:"Url"`
+	Timeout time.Duration `yaml:"Timeout"`
+}
+
+// The Insight Server is expected to have received data from this host within MaxAge
+type LastUploadCheck struct {
+	MaxAge time.Duration `yaml:"MaxAge"`
+}
+
+// The resource usage of the agent process is sampled every SampleInterval. The agent is
+// restarted if it exceeds any of the non-zero limits in Tolerance consecutive samples.
+type ResourceLimits struct {
+	Enabled        bool          `yaml:"Enabled"`
+	SampleInterval time.Duration `yaml:"SampleInterval"`
+	// Samples are logged at most this often, limit breaches are always logged
+	LogInterval time.Duration `yaml:"LogInterval"`
+	MaxMemoryMB int           `yaml:"MaxMemoryMB"`
+	// Percent of a single core, averaged between two samples
+	MaxCpuPercent float64 `yaml:"MaxCpuPercent"`
+	// Open handles on Windows, open file descriptors on Linux
+	MaxHandles int `yaml:"MaxHandles"`
+	Tolerance  int `yaml:"Tolerance"`
 }
 
 func ParseConfig(configFilePath string) (Config, error) {
@@ -38,6 +163,16 @@ func ParseConfig(configFilePath string) (Config, error) {
 		return config, err
 	}
 
+	// The config is in the Config folder of the installation
+	baseFolder := filepath.Dir(filepath.Dir(configFilePath))
+	config.baseFolder = baseFolder
+	config.filePath = configFilePath
+	config.LicenseKey, err = ResolveLicenseKey(config.LicenseKey, baseFolder)
+	if err != nil {
+		log.Error("Error resolving license key: ", err)
+		return config, err
+	}
+
 	return config, nil
 }
 
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigTestSuite struct {
+	suite.Suite
+	baseFolder string
+}
+
+func TestConfigTestSuite(t *testing.T) {
+	suite.Run(t, new(ConfigTestSuite))
+}
+
+func (suite *ConfigTestSuite) SetupTest() {
+	var err error
+	suite.baseFolder, err = ioutil.TempDir("", "config")
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.baseFolder, "Config"), 0755))
+}
+
+func (suite *ConfigTestSuite) TearDownTest() {
+	os.RemoveAll(suite.baseFolder)
+}
+
+func (suite *ConfigTestSuite) parse(content string) Config {
+	configPath := filepath.Join(suite.baseFolder, "Config", "Config.yml")
+	suite.Require().NoError(ioutil.WriteFile(configPath, []byte(content), 0600))
+	config, err := ParseConfig(configPath)
+	suite.Require().NoError(err)
+	return config
+}
+
+func (suite *ConfigTestSuite) TestParseConfig_resourceLimits() {
+	config := suite.parse(`
+Watchdog:
+  ResourceLimits:
+    Enabled: true
+    SampleInterval: 1m
+    MaxMemoryMB: 2048
+    MaxCpuPercent: 90
+`)
+	suite.True(config.Watchdog.ResourceLimits.Enabled)
+	suite.Equal(time.Minute, config.Watchdog.ResourceLimits.SampleInterval)
+	suite.Equal(2048, config.Watchdog.ResourceLimits.MaxMemoryMB)
+	suite.Equal(90.0, config.Watchdog.ResourceLimits.MaxCpuPercent)
+}
+
+func (suite *ConfigTestSuite) TestParseConfig_resourceLimitsDisabledByDefault() {
+	config := suite.parse(`
+Watchdog:
+  ResourceLimits:
+    MaxMemoryMB: 1024
+`)
+	suite.False(config.Watchdog.ResourceLimits.Enabled)
+}
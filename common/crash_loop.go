@@ -0,0 +1,84 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Keeps track of the agent restarts performed by the watchdog. If there are too many restarts
+// within the sliding window, the agent is considered to be in a crash loop, and further restarts
+// are backed off exponentially.
+type CrashLoopDetector struct {
+	MaxRestarts int
+	Window      time.Duration
+	// The first backoff lasts this long, every following one doubles it up to MaxBackoff
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+
+	mutex        sync.Mutex
+	restarts     []time.Time
+	backoffLevel uint
+	backoffUntil time.Time
+}
+
+// Returns whether restarts are backed off at the given time, and until when
+func (d *CrashLoopDetector) InBackoff(now time.Time) (bool, time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return now.Before(d.backoffUntil), d.backoffUntil
+}
+
+// Records a restart and returns true if it means that the agent is in a crash loop.
+// In that case a new backoff period is started.
+func (d *CrashLoopDetector) RecordRestart(now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.restarts = append(d.restarts, now)
+	d.dropExpired(now)
+	if len(d.restarts) < d.MaxRestarts {
+		return false
+	}
+
+	backoff := d.BaseBackoff << d.backoffLevel
+	if backoff > d.MaxBackoff || backoff <= 0 {
+		backoff = d.MaxBackoff
+	} else {
+		d.backoffLevel++
+	}
+	d.backoffUntil = now.Add(backoff)
+	// Start counting again after the backoff
+	d.restarts = nil
+	return true
+}
+
+// Should be called when the agent is found running. If it has been running for a whole
+// window without restarts, the backoff starts from the beginning again next time.
+func (d *CrashLoopDetector) RecordRunning(now time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.dropExpired(now)
+	if len(d.restarts) == 0 && now.After(d.backoffUntil.Add(d.Window)) {
+		d.backoffLevel = 0
+	}
+}
+
+// Returns the number of restarts within the current window
+func (d *CrashLoopDetector) Restarts(now time.Time) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.dropExpired(now)
+	return len(d.restarts)
+}
+
+func (d *CrashLoopDetector) dropExpired(now time.Time) {
+	windowStart := now.Add(-d.Window)
+	kept := d.restarts[:0]
+	for _, restart := range d.restarts {
+		if restart.After(windowStart) {
+			kept = append(kept, restart)
+		}
+	}
+	d.restarts = kept
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CrashLoopDetectorTestSuite struct {
+	suite.Suite
+	detector *CrashLoopDetector
+	now      time.Time
+}
+
+func (suite *CrashLoopDetectorTestSuite) SetupTest() {
+	suite.detector = &CrashLoopDetector{
+		MaxRestarts: 3,
+		Window:      30 * time.Minute,
+		BaseBackoff: 5 * time.Minute,
+		MaxBackoff:  15 * time.Minute,
+	}
+	suite.now = time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func TestCrashLoopDetectorTestSuite(t *testing.T) {
+	suite.Run(t, new(CrashLoopDetectorTestSuite))
+}
+
+func (suite *CrashLoopDetectorTestSuite) restartEvery(interval time.Duration, count int) bool {
+	crashLoop := false
+	for i := 0; i < count; i++ {
+		suite.now = suite.now.Add(interval)
+		crashLoop = suite.detector.RecordRestart(suite.now)
+	}
+	return crashLoop
+}
+
+func (suite *CrashLoopDetectorTestSuite) TestRestartsOutsideWindow() {
+	suite.False(suite.restartEvery(20*time.Minute, 10))
+	inBackoff, _ := suite.detector.InBackoff(suite.now)
+	suite.False(inBackoff)
+}
+
+func (suite *CrashLoopDetectorTestSuite) TestCrashLoop() {
+	suite.False(suite.restartEvery(5*time.Minute, 2))
+	suite.True(suite.restartEvery(5*time.Minute, 1))
+
+	inBackoff, until := suite.detector.InBackoff(suite.now)
+	suite.True(inBackoff)
+	suite.Equal(suite.now.Add(5*time.Minute), until)
+	suite.Equal(0, suite.detector.Restarts(suite.now))
+}
+
+func (suite *CrashLoopDetectorTestSuite) TestExponentialBackoff() {
+	var backoffs []time.Duration
+	for i := 0; i < 4; i++ {
+		suite.True(suite.restartEvery(time.Minute, 3))
+		_, until := suite.detector.InBackoff(suite.now)
+		backoffs = append(backoffs, until.Sub(suite.now))
+	}
+	suite.Equal([]time.Duration{5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 15 * time.Minute}, backoffs)
+}
+
+func (suite *CrashLoopDetectorTestSuite) TestBackoffResetsAfterStableWindow() {
+	suite.True(suite.restartEvery(time.Minute, 3))
+	suite.True(suite.restartEvery(time.Minute, 3))
+
+	suite.now = suite.now.Add(time.Hour)
+	suite.detector.RecordRunning(suite.now)
+
+	suite.True(suite.restartEvery(time.Minute, 3))
+	_, until := suite.detector.InBackoff(suite.now)
+	suite.Equal(5*time.Minute, until.Sub(suite.now))
+}
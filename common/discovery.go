@@ -0,0 +1,430 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The service whose SRV and TXT records describe the Insight Servers of a domain
+const discoveryService = "_palette-insight._tcp."
+
+const (
+	// Used if the TTL of the records is unknown
+	defaultDiscoveryTTL = 5 * time.Minute
+	// The records are looked up at least this often and at most this often
+	minDiscoveryTTL = 30 * time.Second
+	maxDiscoveryTTL = 24 * time.Hour
+	// A failed lookup is retried after this time, while the previous servers are kept
+	discoveryRetryInterval = time.Minute
+	dnsQueryTimeout        = 5 * time.Second
+)
+
+// Finds the Insight Servers by DNS. The servers of the SRV records of _palette-insight._tcp.<Domain>
+// are tried before Endpoint and Endpoints. The TXT records may set the API version (api=v1) and the
+// SHA-256 pin of a CA certificate in the chain of the servers (ca-pin=sha256/<base64 of the public key>),
+// which has to issue the certificates of the servers.
+type Discovery struct {
+	Domain string `yaml:"Domain"`
+	// host:port of the DNS server to ask. By default the system resolver is used, which does not
+	// tell the TTL of the records, so they are cached for DefaultTTL.
+	DnsServer string `yaml:"DnsServer"`
+	// 5 minutes by default
+	DefaultTTL time.Duration `yaml:"DefaultTTL"`
+}
+
+func (d Discovery) enabled() bool {
+	return len(d.Domain) > 0
+}
+
+// The result of a lookup
+type discoveredServers struct {
+	endpoints  []string
+	apiVersion string
+	// SHA-256 hash of the public key of a certificate in the chain of the servers
+	caPin []byte
+}
+
+// Looks up the records when they expire, and keeps the previous servers if the lookup fails
+type serverDiscoverer struct {
+	config Discovery
+
+	mutex   sync.Mutex
+	servers discoveredServers
+	expires time.Time
+
+	// Replaceable for testing
+	now    func() time.Time
+	random func(int64) int64
+}
+
+func newServerDiscoverer(config Discovery) *serverDiscoverer {
+	return &serverDiscoverer{config: config, now: time.Now, random: newLockedRandom().Int63n}
+}
+
+// Whether the other discoverer looks up the same records, so that it can be kept
+func (d *serverDiscoverer) sameAs(other *serverDiscoverer) bool {
+	return other != nil && d.config == other.config
+}
+
+// Returns the discovered servers, looking them up again if the records have expired
+func (d *serverDiscoverer) discover(ctx context.Context) discoveredServers {
+	logger := Log(ctx)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	if now.Before(d.expires) {
+		return d.servers
+	}
+	servers, ttl, err := d.lookup(ctx)
+	if err != nil {
+		logger.Errorf("Failed to discover Insight Servers of %s! Error: %v", d.config.Domain, err)
+		d.expires = now.Add(discoveryRetryInterval)
+		return d.servers
+	}
+	if ttl < minDiscoveryTTL {
+		ttl = minDiscoveryTTL
+	} else if ttl > maxDiscoveryTTL {
+		ttl = maxDiscoveryTTL
+	}
+	if fmt.Sprint(servers) != fmt.Sprint(d.servers) {
+		logger.Infof("Discovered Insight Servers of %s: %v", d.config.Domain, servers.endpoints)
+	}
+	d.servers = servers
+	d.expires = now.Add(ttl)
+	return servers
+}
+
+// Returns the pin if the host is a discovered server, or nil
+func (d *serverDiscoverer) caPinFor(host string) []byte {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, endpoint := range d.servers.endpoints {
+		if strings.EqualFold(endpointHost(endpoint), host) {
+			return d.servers.caPin
+		}
+	}
+	return nil
+}
+
+// Returns the API version of the discovered servers, or an empty string for other endpoints
+func (d *serverDiscoverer) apiVersionFor(endpoint string) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if indexOf(d.servers.endpoints, endpoint) < 0 {
+		return ""
+	}
+	return d.servers.apiVersion
+}
+
+func endpointHost(endpoint string) string {
+	hostPort := strings.TrimPrefix(endpoint, "https://")
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort
+	}
+	return host
+}
+
+func (d *serverDiscoverer) lookup(ctx context.Context) (discoveredServers, time.Duration, error) {
+	name := discoveryService + strings.TrimSuffix(d.config.Domain, ".") + "."
+	var srvs []*net.SRV
+	var txts []string
+	ttl := d.config.DefaultTTL
+	if ttl <= 0 {
+		ttl = defaultDiscoveryTTL
+	}
+
+	if len(d.config.DnsServer) > 0 {
+		var err error
+		srvs, txts, ttl, err = lookupWithTTL(ctx, d.config.DnsServer, name)
+		if err != nil {
+			return discoveredServers{}, 0, err
+		}
+	} else {
+		var err error
+		_, srvs, err = net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil && !isNotFound(err) {
+			return discoveredServers{}, 0, err
+		}
+		txts, err = net.DefaultResolver.LookupTXT(ctx, name)
+		if err != nil && !isNotFound(err) {
+			return discoveredServers{}, 0, err
+		}
+	}
+
+	servers := discoveredServers{apiVersion: InsightApiVersion}
+	for _, srv := range orderSrv(srvs, d.random) {
+		host := strings.TrimSuffix(srv.Target, ".")
+		if len(host) == 0 {
+			// "." means that the service is not available in the domain
+			continue
+		}
+		servers.endpoints = append(servers.endpoints, "https://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	for _, txt := range txts {
+		for _, field := range strings.Fields(txt) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch strings.ToLower(parts[0]) {
+			case "api":
+				apiVersion, err := parseApiVersion(parts[1])
+				if err != nil {
+					return discoveredServers{}, 0, err
+				}
+				servers.apiVersion = apiVersion
+			case "ca-pin":
+				pin, err := parseCaPin(parts[1])
+				if err != nil {
+					return discoveredServers{}, 0, err
+				}
+				servers.caPin = pin
+			}
+		}
+	}
+	return servers, ttl, nil
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// The API version is put into the path of the requests after /api/, so it has to keep them there
+func parseApiVersion(value string) (string, error) {
+	apiPath := "/api/" + value
+	if len(value) == 0 || strings.ContainsAny(value, `?#%:\`) || strings.Contains(value, "..") ||
+		path.Clean(apiPath) != apiPath {
+		return "", fmt.Errorf("Invalid API version: %s", value)
+	}
+	return value, nil
+}
+
+func parseCaPin(value string) ([]byte, error) {
+	if !strings.HasPrefix(strings.ToLower(value), "sha256/") {
+		return nil, fmt.Errorf("Unsupported CA pin: %s", value)
+	}
+	pin, err := base64.StdEncoding.DecodeString(value[len("sha256/"):])
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("Invalid CA pin: %s", value)
+	}
+	return pin, nil
+}
+
+// Orders the records by priority, and randomly by weight within the same priority (RFC 2782)
+func orderSrv(records []*net.SRV, random func(int64) int64) []*net.SRV {
+	remaining := append([]*net.SRV(nil), records...)
+	var ordered []*net.SRV
+	for len(remaining) > 0 {
+		priority := remaining[0].Priority
+		for _, srv := range remaining {
+			if srv.Priority < priority {
+				priority = srv.Priority
+			}
+		}
+		var group, rest []*net.SRV
+		for _, srv := range remaining {
+			if srv.Priority == priority {
+				group = append(group, srv)
+			} else {
+				rest = append(rest, srv)
+			}
+		}
+		for len(group) > 0 {
+			total := int64(0)
+			for _, srv := range group {
+				total += int64(srv.Weight)
+			}
+			chosen := 0
+			if total > 0 {
+				pick := random(total)
+				for i, srv := range group {
+					if pick < int64(srv.Weight) {
+						chosen = i
+						break
+					}
+					pick -= int64(srv.Weight)
+				}
+			}
+			ordered = append(ordered, group[chosen])
+			group = append(group[:chosen], group[chosen+1:]...)
+		}
+		remaining = rest
+	}
+	return ordered
+}
+
+// Verifies the chain presented by a discovered server up to the pinned certificate, which has to
+// be in the chain. Implements tls.Config.VerifyConnection, as the certificates of the Insight
+// Servers are not verified otherwise, so a pinned certificate merely included in the chain proves
+// nothing by itself.
+func (d *serverDiscoverer) verifyConnection(state tls.ConnectionState) error {
+	pin := d.caPinFor(state.ServerName)
+	if pin == nil {
+		return nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("%s presented no certificate", state.ServerName)
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	pinned := false
+	for _, cert := range state.PeerCertificates {
+		if hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo); string(hash[:]) == string(pin) {
+			roots.AddCert(cert)
+			pinned = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("No certificate of %s matches the discovered CA pin", state.ServerName)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Errorf("The certificate of %s is not issued by the pinned CA! Error: %v", state.ServerName, err)
+	}
+	return nil
+}
+
+var errDnsTruncated = errors.New("DNS response truncated")
+
+// Queries the SRV and TXT records from the DNS server. The returned TTL is the lowest of the records.
+func lookupWithTTL(ctx context.Context, server, name string) ([]*net.SRV, []string, time.Duration, error) {
+	ttl := uint32(maxDiscoveryTTL / time.Second)
+	srvAnswers, err := queryDns(ctx, server, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	txtAnswers, err := queryDns(ctx, server, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var srvs []*net.SRV
+	var txts []string
+	for _, answer := range append(srvAnswers, txtAnswers...) {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.SRVResource:
+			srvs = append(srvs, &net.SRV{Target: body.Target.String(), Port: body.Port,
+				Priority: body.Priority, Weight: body.Weight})
+		case *dnsmessage.TXTResource:
+			txts = append(txts, strings.Join(body.TXT, ""))
+		default:
+			continue
+		}
+		if answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+	if len(srvs) == 0 && len(txts) == 0 {
+		// Nothing to expire, the records may be added any time
+		ttl = uint32(defaultDiscoveryTTL / time.Second)
+	}
+	return srvs, txts, time.Duration(ttl) * time.Second, nil
+}
+
+// Sends the query over UDP, and over TCP if the response did not fit. A missing name is no error.
+func queryDns(ctx context.Context, server, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	questionName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: questionName, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	answers, err := exchangeDns(ctx, "udp", server, packed, id)
+	if err == errDnsTruncated {
+		answers, err = exchangeDns(ctx, "tcp", server, packed, id)
+	}
+	return answers, err
+}
+
+func exchangeDns(ctx context.Context, network, server string, query []byte, id uint16) ([]dnsmessage.Resource, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	response := make([]byte, 65535)
+	var length int
+	if network == "tcp" {
+		// Messages are prefixed by their length over TCP
+		prefixed := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(prefixed, uint16(len(query)))
+		copy(prefixed[2:], query)
+		if _, err := conn.Write(prefixed); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, response[:2]); err != nil {
+			return nil, err
+		}
+		length = int(binary.BigEndian.Uint16(response))
+		if _, err := io.ReadFull(conn, response[:length]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		if length, err = conn.Read(response); err != nil {
+			return nil, err
+		}
+	}
+
+	var message dnsmessage.Message
+	if err := message.Unpack(response[:length]); err != nil {
+		return nil, err
+	}
+	switch {
+	case message.Header.ID != id:
+		return nil, fmt.Errorf("DNS response to another query")
+	case message.Header.Truncated:
+		return nil, errDnsTruncated
+	case message.Header.RCode == dnsmessage.RCodeNameError:
+		return nil, nil
+	case message.Header.RCode != dnsmessage.RCodeSuccess:
+		return nil, fmt.Errorf("DNS query failed: %v", message.Header.RCode)
+	}
+	return message.Answers, nil
+}
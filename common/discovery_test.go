@@ -0,0 +1,395 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type DiscoveryTestSuite struct {
+	suite.Suite
+	dns *testDnsServer
+}
+
+func TestDiscoveryTestSuite(t *testing.T) {
+	suite.Run(t, new(DiscoveryTestSuite))
+}
+
+func (suite *DiscoveryTestSuite) SetupTest() {
+	suite.dns = newTestDnsServer(suite.T())
+}
+
+func (suite *DiscoveryTestSuite) TearDownTest() {
+	suite.dns.Close()
+}
+
+const testDiscoveryName = "_palette-insight._tcp.example.com."
+
+func (suite *DiscoveryTestSuite) TestLookupWithTTL() {
+	suite.dns.setRecords(300, []*net.SRV{
+		{Target: "backup.example.com.", Port: 443, Priority: 20, Weight: 0},
+		{Target: "insight.example.com.", Port: 8443, Priority: 10, Weight: 0},
+	}, "api=v2", "ca-pin=sha256/"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	suite.dns.mutex.Lock()
+	suite.dns.txtTTL = 120
+	suite.dns.mutex.Unlock()
+
+	discoverer := &serverDiscoverer{config: Discovery{Domain: "example.com", DnsServer: suite.dns.address()},
+		random: func(n int64) int64 { return 0 }}
+	servers, ttl, err := discoverer.lookup(context.Background())
+	suite.Require().NoError(err)
+	suite.Equal([]string{"https://insight.example.com:8443", "https://backup.example.com:443"}, servers.endpoints)
+	suite.Equal("v2", servers.apiVersion)
+	suite.Equal(make([]byte, 32), servers.caPin)
+	suite.Equal(120*time.Second, ttl)
+}
+
+func (suite *DiscoveryTestSuite) TestLookupWithTTL_overTcp() {
+	suite.dns.setRecords(60, []*net.SRV{{Target: "insight.example.com.", Port: 443}})
+	suite.dns.mutex.Lock()
+	suite.dns.truncate = true
+	suite.dns.mutex.Unlock()
+
+	srvs, _, ttl, err := lookupWithTTL(context.Background(), suite.dns.address(), testDiscoveryName)
+	suite.Require().NoError(err)
+	suite.Len(srvs, 1)
+	suite.Equal(time.Minute, ttl)
+}
+
+func (suite *DiscoveryTestSuite) TestLookupWithTTL_missingName() {
+	srvs, txts, ttl, err := lookupWithTTL(context.Background(), suite.dns.address(), "_palette-insight._tcp.other.com.")
+	suite.NoError(err)
+	suite.Empty(srvs)
+	suite.Empty(txts)
+	suite.Equal(defaultDiscoveryTTL, ttl)
+}
+
+func (suite *DiscoveryTestSuite) TestDiscover_cachesUntilTTL() {
+	suite.dns.setRecords(600, []*net.SRV{{Target: "insight.example.com.", Port: 443}})
+	now := time.Now()
+	discoverer := &serverDiscoverer{config: Discovery{Domain: "example.com", DnsServer: suite.dns.address()},
+		now: func() time.Time { return now }, random: func(n int64) int64 { return 0 }}
+
+	suite.Equal([]string{"https://insight.example.com:443"}, discoverer.discover(context.Background()).endpoints)
+	now = now.Add(9 * time.Minute)
+	discoverer.discover(context.Background())
+	suite.Equal(2, suite.dns.queryCount())
+
+	// The previous servers are kept while the DNS server is down
+	suite.dns.Close()
+	now = now.Add(2 * time.Minute)
+	suite.Equal([]string{"https://insight.example.com:443"}, discoverer.discover(context.Background()).endpoints)
+}
+
+func (suite *DiscoveryTestSuite) TestLookupWithTTL_invalidApiVersion() {
+	suite.dns.setRecords(300, []*net.SRV{{Target: "insight.example.com.", Port: 443}}, "api=../../admin")
+	discoverer := &serverDiscoverer{config: Discovery{Domain: "example.com", DnsServer: suite.dns.address()},
+		random: func(n int64) int64 { return 0 }}
+	_, _, err := discoverer.lookup(context.Background())
+	suite.Error(err)
+}
+
+func (suite *DiscoveryTestSuite) TestParseApiVersion() {
+	for _, valid := range []string{"v1", "v2", "v2/beta"} {
+		version, err := parseApiVersion(valid)
+		suite.NoError(err, valid)
+		suite.Equal(valid, version)
+	}
+	for _, invalid := range []string{"", "..", "v1/../../admin", "v1/", "/v1", "v1//beta", "./v1", "v1?admin=1",
+		"v1#x", "https://evil.example.com", "v1%2F..", `v1\..`} {
+		_, err := parseApiVersion(invalid)
+		suite.Error(err, invalid)
+	}
+}
+
+func (suite *DiscoveryTestSuite) TestOrderSrv() {
+	records := []*net.SRV{
+		{Target: "c", Priority: 2},
+		{Target: "a", Priority: 1, Weight: 1},
+		{Target: "b", Priority: 1, Weight: 3},
+	}
+	targets := func(ordered []*net.SRV) []string {
+		var result []string
+		for _, srv := range ordered {
+			result = append(result, srv.Target)
+		}
+		return result
+	}
+	suite.Equal([]string{"a", "b", "c"}, targets(orderSrv(records, func(n int64) int64 { return 0 })))
+	suite.Equal([]string{"b", "a", "c"}, targets(orderSrv(records, func(n int64) int64 { return n - 1 })))
+}
+
+// Issues a certificate for localhost with the key of the parent, or a self-signed one if the parent is nil
+func (suite *DiscoveryTestSuite) issueCertificate(commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	suite.Require().NoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{"localhost"}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	suite.Require().NoError(err)
+	cert, err := x509.ParseCertificate(certDer)
+	suite.Require().NoError(err)
+	return cert, key
+}
+
+// Starts a TLS server which presents the chain
+func newChainServer(handler http.Handler, key *ecdsa.PrivateKey, chain ...*x509.Certificate) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	certificate := tls.Certificate{PrivateKey: key}
+	for _, cert := range chain {
+		certificate.Certificate = append(certificate.Certificate, cert.Raw)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	return server
+}
+
+// Sends a request to the server discovered at localhost with the pin and TXT records
+func (suite *DiscoveryTestSuite) getDiscovered(server *httptest.Server, txts ...string) error {
+	// SRV targets are host names
+	_, portText, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portText)
+	suite.dns.setRecords(60, []*net.SRV{{Target: "localhost.", Port: uint16(port)}}, txts...)
+
+	var config Config
+	config.Webservice.Discovery = Discovery{Domain: "example.com", DnsServer: suite.dns.address()}
+	config.Webservice.Retry.MaxAttempts = 1
+	client, err := NewApiClientWithConfig(config)
+	suite.Require().NoError(err)
+	resp, err := client.Get(context.Background(), "/ping")
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func (suite *DiscoveryTestSuite) TestSharedApiClient_keepsDiscoveredServers() {
+	caCert, caKey := suite.issueCertificate("Insight CA", true, nil, nil)
+	serverCert, serverKey := suite.issueCertificate("localhost", false, caCert, caKey)
+	server := newChainServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), serverKey, serverCert, caCert)
+	defer server.Close()
+	_, portText, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portText)
+	suite.dns.setRecords(600, []*net.SRV{{Target: "localhost.", Port: uint16(port)}}, caPinRecord(caCert))
+
+	var config Config
+	config.LicenseKey = "key"
+	config.Webservice.Discovery = Discovery{Domain: "example.com", DnsServer: suite.dns.address()}
+	get := func() {
+		client, err := SharedApiClientWithConfig(config)
+		suite.Require().NoError(err)
+		resp, err := client.Get(context.Background(), "/ping")
+		suite.Require().NoError(err)
+		resp.Body.Close()
+	}
+	get()
+	queries := suite.dns.queryCount()
+
+	// The records are not looked up again with the unchanged config, nor with a new license key
+	get()
+	config.LicenseKey = "new-key"
+	get()
+	suite.Equal(queries, suite.dns.queryCount())
+}
+
+func caPinRecord(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "ca-pin=sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func (suite *DiscoveryTestSuite) TestApiClient_usesDiscoveredServer() {
+	caCert, caKey := suite.issueCertificate("Insight CA", true, nil, nil)
+	serverCert, serverKey := suite.issueCertificate("localhost", false, caCert, caKey)
+	var paths []string
+	server := newChainServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}), serverKey, serverCert, caCert)
+	defer server.Close()
+
+	suite.Require().NoError(suite.getDiscovered(server, "api=v2 "+caPinRecord(caCert)))
+	suite.Equal([]string{"/api/v2/ping"}, paths)
+}
+
+func (suite *DiscoveryTestSuite) TestApiClient_rejectsPinMismatch() {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	suite.Error(suite.getDiscovered(server, "ca-pin=sha256/"+base64.StdEncoding.EncodeToString(make([]byte, 32))))
+}
+
+func (suite *DiscoveryTestSuite) TestApiClient_rejectsForgedChain() {
+	caCert, _ := suite.issueCertificate("Insight CA", true, nil, nil)
+	// Anyone can send the pinned certificate after a certificate of their own
+	forgedCert, forgedKey := suite.issueCertificate("localhost", false, nil, nil)
+	server := newChainServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Fail("The forged server should not get requests")
+	}), forgedKey, forgedCert, caCert)
+	defer server.Close()
+
+	suite.Error(suite.getDiscovered(server, caPinRecord(caCert)))
+}
+
+// Answers the SRV and TXT queries of testDiscoveryName over UDP and TCP. Other names do not exist.
+type testDnsServer struct {
+	udp net.PacketConn
+	tcp net.Listener
+
+	mutex    sync.Mutex
+	srvs     []*net.SRV
+	txts     []string
+	srvTTL   uint32
+	txtTTL   uint32
+	truncate bool
+	queries  int
+}
+
+func newTestDnsServer(t *testing.T) *testDnsServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testDnsServer{udp: udp, tcp: tcp}
+	go server.serveUdp()
+	go server.serveTcp()
+	return server
+}
+
+func (s *testDnsServer) address() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testDnsServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *testDnsServer) setRecords(ttl uint32, srvs []*net.SRV, txts ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.srvs, s.txts, s.srvTTL, s.txtTTL = srvs, txts, ttl, ttl
+}
+
+func (s *testDnsServer) queryCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queries
+}
+
+func (s *testDnsServer) serveUdp() {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := s.respond(buffer[:n], true); response != nil {
+			s.udp.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *testDnsServer) serveTcp() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			prefix := make([]byte, 2)
+			if _, err := io.ReadFull(conn, prefix); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(prefix))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			response := s.respond(query, false)
+			binary.BigEndian.PutUint16(prefix, uint16(len(response)))
+			conn.Write(append(prefix, response...))
+		}()
+	}
+}
+
+func (s *testDnsServer) respond(packet []byte, overUdp bool) []byte {
+	var query dnsmessage.Message
+	if err := query.Unpack(packet); err != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries++
+
+	question := query.Questions[0]
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.Header.ID, Response: true, RecursionAvailable: true},
+		Questions: query.Questions,
+	}
+	if question.Name.String() != testDiscoveryName {
+		response.Header.RCode = dnsmessage.RCodeNameError
+	} else if overUdp && s.truncate {
+		response.Header.Truncated = true
+	} else {
+		switch question.Type {
+		case dnsmessage.TypeSRV:
+			for _, srv := range s.srvs {
+				response.Answers = append(response.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeSRV,
+						Class: dnsmessage.ClassINET, TTL: s.srvTTL},
+					Body: &dnsmessage.SRVResource{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port,
+						Target: dnsmessage.MustNewName(srv.Target)},
+				})
+			}
+		case dnsmessage.TypeTXT:
+			for _, txt := range s.txts {
+				response.Answers = append(response.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeTXT,
+						Class: dnsmessage.ClassINET, TTL: s.txtTTL},
+					Body: &dnsmessage.TXTResource{TXT: []string{txt}},
+				})
+			}
+		}
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return packed
+}
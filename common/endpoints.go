@@ -0,0 +1,441 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A failed endpoint is skipped for this long by default, then the preferred endpoints are tried again
+const defaultEndpointRetryAfter = 5 * time.Minute
+
+// The Insight Server sends its new address in this header when it has moved
+const canonicalEndpointHeader = "X-Insight-Canonical-Endpoint"
+
+// The new address is saved only after this many successful responses in a row have sent it
+const migrationConfirmations = 3
+
+// Controls switching between Endpoint and the fallback Endpoints
+type Failover struct {
+	// A failed endpoint is not tried again for this long, 5 minutes by default
+	RetryAfter time.Duration `yaml:"RetryAfter"`
+	// Ignore the new address sent by the Insight Server instead of using it
+	IgnoreMigration bool `yaml:"IgnoreMigration"`
+	// Save the new address into the config file, if both addresses have a trusted certificate.
+	// Otherwise it is used only until the client is created again.
+	PersistMigration bool `yaml:"PersistMigration"`
+}
+
+// Returns Endpoint followed by the fallback Endpoints, without duplicates
+func (w Webservice) endpointList() []string {
+	var endpoints []string
+	for _, endpoint := range append([]string{w.Endpoint}, w.Endpoints...) {
+		endpoint = strings.TrimRight(strings.TrimSpace(endpoint), "/")
+		if len(endpoint) > 0 && indexOf(endpoints, endpoint) < 0 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Chooses the first endpoint in order which has not failed recently. Once the failed endpoints
+// may be tried again, requests go back to the preferred one.
+type endpointSelector struct {
+	retryAfter time.Duration
+	// The endpoints in the config, which are not changed by a migration
+	fromConfig []string
+
+	mutex sync.Mutex
+	// The discovered endpoints come before the configured ones
+	configured []string
+	discovered []string
+	downUntil  map[string]time.Time
+	active     string
+	migratedTo string
+	// The new address sent by the Insight Server, and the number of responses in a row which sent it
+	migrationCandidate string
+	migrationVotes     int
+
+	// Replaceable for testing
+	now func() time.Time
+}
+
+func (f Failover) retryInterval() time.Duration {
+	if f.RetryAfter <= 0 {
+		return defaultEndpointRetryAfter
+	}
+	return f.RetryAfter
+}
+
+func newEndpointSelector(endpoints []string, retryAfter time.Duration) *endpointSelector {
+	active := ""
+	if len(endpoints) > 0 {
+		active = endpoints[0]
+	}
+	return &endpointSelector{
+		retryAfter: retryAfter,
+		fromConfig: endpoints,
+		configured: endpoints,
+		downUntil:  make(map[string]time.Time),
+		active:     active,
+		now:        time.Now,
+	}
+}
+
+// Whether the other selector chooses from the same endpoints, so that it can be kept
+func (s *endpointSelector) sameAs(other *endpointSelector) bool {
+	return other != nil && s.retryAfter == other.retryAfter && reflect.DeepEqual(s.fromConfig, other.fromConfig)
+}
+
+// Returns the endpoint to send the next request to. If every endpoint has failed recently, the
+// one which may be tried again first is returned.
+func (s *endpointSelector) current(ctx context.Context) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	chosen := ""
+	for _, endpoint := range s.endpoints() {
+		if !now.Before(s.downUntil[endpoint]) {
+			chosen = endpoint
+			break
+		}
+		if len(chosen) == 0 || s.downUntil[endpoint].Before(s.downUntil[chosen]) {
+			chosen = endpoint
+		}
+	}
+	if chosen != s.active {
+		Log(ctx).Warningf("Switching from Insight Server %s to %s", s.active, chosen)
+		endpointSwitches.Inc()
+		s.active = chosen
+	}
+	return chosen
+}
+
+// Returns true if there is another endpoint which has not failed recently
+func (s *endpointSelector) failed(endpoint string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	endpoints := s.endpoints()
+	if len(endpoints) < 2 {
+		return false
+	}
+	now := s.now()
+	s.downUntil[endpoint] = now.Add(s.retryAfter)
+	for _, other := range endpoints {
+		if !now.Before(s.downUntil[other]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *endpointSelector) succeeded(endpoint string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.downUntil, endpoint)
+}
+
+// Counts the successful responses in a row which sent the same new endpoint. An empty endpoint
+// starts counting again. Returns true once the endpoint is confirmed, unless it has been migrated to.
+func (s *endpointSelector) confirmMigration(endpoint string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if endpoint != s.migrationCandidate {
+		s.migrationCandidate = endpoint
+		s.migrationVotes = 0
+	}
+	if len(endpoint) == 0 {
+		return false
+	}
+	s.migrationVotes++
+	return s.migrationVotes >= migrationConfirmations && s.migratedTo != endpoint
+}
+
+// Makes the new endpoint the preferred one. Returns false if it has already been done.
+func (s *endpointSelector) migrate(endpoint string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.migratedTo == endpoint {
+		return false
+	}
+	s.migratedTo = endpoint
+	configured := []string{endpoint}
+	for _, previous := range s.configured {
+		if previous != endpoint {
+			configured = append(configured, previous)
+		}
+	}
+	s.configured = configured
+	return true
+}
+
+// Sets the endpoints found by DNS discovery
+func (s *endpointSelector) setDiscovered(endpoints []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.discovered = endpoints
+}
+
+func (s *endpointSelector) endpoints() []string {
+	endpoints := append([]string(nil), s.discovered...)
+	for _, endpoint := range s.configured {
+		if len(endpoint) > 0 && indexOf(endpoints, endpoint) < 0 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		// Requests fail with a meaningful error instead of a panic
+		endpoints = []string{""}
+	}
+	return endpoints
+}
+
+// An endpoint is considered down if it cannot be reached or its gateway reports it unavailable
+func isEndpointFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Checks whether the Insight Server sent its new address, and uses it once enough responses have
+// sent it and the new address responds too. It is saved into the config file only if that is
+// enabled and both addresses were reached over verified TLS connections.
+func (c *ApiClient) checkMigration(ctx context.Context, endpoint string, resp *http.Response) {
+	logger := Log(ctx)
+	if c.config.Webservice.Failover.IgnoreMigration {
+		return
+	}
+	newEndpoint := strings.TrimRight(strings.TrimSpace(resp.Header.Get(canonicalEndpointHeader)), "/")
+	if len(newEndpoint) == 0 || newEndpoint == endpoint {
+		c.endpoints.confirmMigration("")
+		return
+	}
+	if err := validateMigration(endpoint, newEndpoint); err != nil {
+		logger.Errorf("Ignoring the new address sent by Insight Server %s! Error: %v", endpoint, err)
+		return
+	}
+	if !c.endpoints.confirmMigration(newEndpoint) {
+		return
+	}
+	probeTls, err := c.probeEndpoint(ctx, newEndpoint)
+	if err != nil {
+		logger.Errorf("Ignoring the new address %s sent by Insight Server %s, as it does not respond! Error: %v",
+			newEndpoint, endpoint, err)
+		// Confirmed again by the next responses
+		c.endpoints.confirmMigration("")
+		return
+	}
+	if !c.endpoints.migrate(newEndpoint) {
+		return
+	}
+
+	logger.Warningf("Insight Server %s moved to %s", endpoint, newEndpoint)
+	if !c.config.Webservice.Failover.PersistMigration || len(c.config.filePath) == 0 {
+		return
+	}
+	if err := c.verifyTls(resp.TLS, endpoint); err != nil {
+		logger.Errorf("Not saving the new Insight Server address, as %s is not trusted! Error: %v", endpoint, err)
+		return
+	}
+	if err := c.verifyTls(probeTls, newEndpoint); err != nil {
+		logger.Errorf("Not saving the new Insight Server address, as it is not trusted! Error: %v", err)
+		return
+	}
+	if err := MigrateEndpoint(c.config.filePath, newEndpoint); err != nil {
+		logger.Errorf("Failed to save the new Insight Server address into %s! Error: %v", c.config.filePath, err)
+		return
+	}
+	logger.Info("Saved the new Insight Server address into ", c.config.filePath)
+}
+
+// Makes sure that the endpoint is an Insight Server which accepts the license key. Returns the
+// TLS state of the connection, which is nil for plain HTTP.
+func (c *ApiClient) probeEndpoint(ctx context.Context, endpoint string) (*tls.ConnectionState, error) {
+	req, err := http.NewRequest("GET", c.makeUrl(endpoint, "/license"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.config.LicenseKey))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("GET %s responded with %s", req.URL, resp.Status)
+	}
+	return resp.TLS, nil
+}
+
+// The API client does not check the certificates, so the certificate of the endpoint is verified
+// against the trusted roots here
+func (c *ApiClient) verifyTls(state *tls.ConnectionState, endpoint string) error {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("%s is not reached over HTTPS", endpoint)
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       endpointUrl.Hostname(),
+		Roots:         c.roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// The new address has to be an absolute URL, and an HTTPS server may not move to plain HTTP
+func validateMigration(endpoint, newEndpoint string) error {
+	newUrl, err := url.Parse(newEndpoint)
+	if err != nil {
+		return err
+	}
+	if newUrl.Scheme != "http" && newUrl.Scheme != "https" || len(newUrl.Host) == 0 {
+		return fmt.Errorf("Invalid endpoint: %s", newEndpoint)
+	}
+	if newUrl.User != nil || len(newUrl.RawQuery) > 0 || len(newUrl.Fragment) > 0 {
+		return fmt.Errorf("The endpoint may not contain credentials, query or fragment: %s", newEndpoint)
+	}
+	if strings.HasPrefix(endpoint, "https://") && newUrl.Scheme != "https" {
+		return fmt.Errorf("Refusing to move from HTTPS to %s", newEndpoint)
+	}
+	return nil
+}
+
+// Makes the new endpoint the Endpoint of the config file, and keeps the previous ones as fallbacks.
+// The file is replaced only if the edited config parses as expected.
+func MigrateEndpoint(configPath, newEndpoint string) error {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	var config Config
+	if err := yaml.Unmarshal(configBytes, &config); err != nil {
+		return err
+	}
+	var fallbacks []string
+	for _, endpoint := range config.Webservice.endpointList() {
+		if endpoint != newEndpoint {
+			fallbacks = append(fallbacks, endpoint)
+		}
+	}
+
+	edited, err := ReplaceEndpoints(configBytes, newEndpoint, fallbacks)
+	if err != nil {
+		return err
+	}
+	tempPath := configPath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, edited, info.Mode().Perm()); err != nil {
+		return err
+	}
+	// The file may have existed, and the umask applies to a new one
+	if err := os.Chmod(tempPath, info.Mode().Perm()); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, configPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+var (
+	endpointLinePattern  = regexp.MustCompile(`(?m)^([ \t]+)Endpoint[ \t]*:[^\r\n]*(\r?\n|$)`)
+	endpointsLinePattern = regexp.MustCompile(`(?m)^([ \t]+)Endpoints[ \t]*:[^\r\n]*(\r?\n|$)`)
+	listItemLinePattern  = regexp.MustCompile(`^([ \t]*)-[^\r\n]*(\r?\n|$)`)
+)
+
+// Sets the Endpoint and the Endpoints of the Webservice section of a YAML config. The rest of the
+// file, including the comments, is kept as it is.
+func ReplaceEndpoints(configBytes []byte, endpoint string, fallbacks []string) ([]byte, error) {
+	// Remove the previous Endpoints with its block list items
+	if match := endpointsLinePattern.FindSubmatchIndex(configBytes); match != nil {
+		indent := match[3] - match[2]
+		end := match[1]
+		for {
+			item := listItemLinePattern.FindSubmatchIndex(configBytes[end:])
+			if item == nil || item[1] == 0 || item[3]-item[2] < indent {
+				break
+			}
+			end += item[1]
+		}
+		configBytes = append(append([]byte{}, configBytes[:match[0]]...), configBytes[end:]...)
+	}
+
+	match := endpointLinePattern.FindSubmatchIndex(configBytes)
+	if match == nil {
+		return nil, fmt.Errorf("No Webservice Endpoint in the config")
+	}
+	indent := string(configBytes[match[2]:match[3]])
+	newline := string(configBytes[match[4]:match[5]])
+	if len(newline) == 0 {
+		newline = "\n"
+	}
+	lines := indent + "Endpoint: " + quoteYaml(endpoint) + newline
+	if len(fallbacks) > 0 {
+		quoted := make([]string, len(fallbacks))
+		for i, fallback := range fallbacks {
+			quoted[i] = quoteYaml(fallback)
+		}
+		lines += indent + "Endpoints: [" + strings.Join(quoted, ", ") + "]" + newline
+	}
+	result := make([]byte, 0, len(configBytes)+len(lines))
+	result = append(result, configBytes[:match[0]]...)
+	result = append(result, lines...)
+	result = append(result, configBytes[match[1]:]...)
+
+	// Make sure that the edit did not break the config
+	var config Config
+	if err := yaml.Unmarshal(result, &config); err != nil {
+		return nil, fmt.Errorf("Failed to edit the endpoints of the config! Error: %v", err)
+	}
+	if config.Webservice.Endpoint != endpoint || !reflect.DeepEqual(config.Webservice.Endpoints, fallbacks) {
+		return nil, fmt.Errorf("Failed to edit the endpoints of the config")
+	}
+	return result, nil
+}
+
+// Single-quoted YAML scalar, which needs no escaping except for the quotes
+func quoteYaml(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
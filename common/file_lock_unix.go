@@ -0,0 +1,18 @@
+// +build !windows
+
+package common
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Blocks until the calling process holds an exclusive lock on the whole file
+func lockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+package common
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Blocks until the calling process holds an exclusive lock on the whole file
+func lockFile(file *os.File) error {
+	return windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -8,27 +9,28 @@ import (
 	log "github.com/palette-software/go-log-targets"
 )
 
-func GetLicenseData(baseFolder string) (*insight_server.LicenseData, error) {
+func GetLicenseData(ctx context.Context, baseFolder string) (*insight_server.LicenseData, error) {
 
-	client, err := NewApiClient(baseFolder)
+	client, err := SharedApiClient(baseFolder)
 	if err != nil {
 		log.Error("Failed to create Insight API client for acquiring license data! Error: ", err)
 		return nil, err
 	}
-	return getLicenseDataForClient(client)
+	return getLicenseDataForClient(ctx, client)
 }
 
-func GetLicenseDataForConfig(config Config) (*insight_server.LicenseData, error) {
+// Checks the license with a config which has not been applied yet, so it gets a client of its own
+func GetLicenseDataForConfig(ctx context.Context, config Config) (*insight_server.LicenseData, error) {
 	client, err := NewApiClientWithConfig(config)
 	if err != nil {
 		log.Error("Failed to create Insight API client for acquiring license data! Error: ", err)
 		return nil, err
 	}
-	return getLicenseDataForClient(client)
+	return getLicenseDataForClient(ctx, client)
 }
 
-func getLicenseDataForClient(client *ApiClient) (*insight_server.LicenseData, error) {
-	resp, err := client.Get("/license")
+func getLicenseDataForClient(ctx context.Context, client *ApiClient) (*insight_server.LicenseData, error) {
+	resp, err := client.Get(ctx, "/license")
 	if err != nil {
 		// The error has already been logged
 		return nil, err
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Instead of the license key itself, the LicenseKey in Config.yml may be
+//   file:<path>      the path of a file containing the key. Relative paths are relative to the
+//                    installation folder. The file must not be readable by others.
+//   sealed:<base64>  the key sealed by SealLicenseKey: DPAPI on Windows, a machine key file elsewhere
+const (
+	licenseKeyFilePrefix   = "file:"
+	licenseKeySealedPrefix = "sealed:"
+)
+
+// The LicenseKey line of a YAML config, keeping the key
+var licenseKeyLinePattern = regexp.MustCompile(`(?m)^([ \t]*LicenseKey[ \t]*:[ \t]*)[^\r\n]*`)
+
+// Returns true if the LicenseKey in the config is a reference or a sealed value instead of the key itself
+func IsLicenseKeyReference(value string) bool {
+	return strings.HasPrefix(value, licenseKeyFilePrefix) || strings.HasPrefix(value, licenseKeySealedPrefix)
+}
+
+// Returns the license key for the LicenseKey value of a config
+func ResolveLicenseKey(value, baseFolder string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, licenseKeyFilePrefix):
+		path := strings.TrimPrefix(value, licenseKeyFilePrefix)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseFolder, path)
+		}
+		if err := checkKeyFilePermissions(path); err != nil {
+			return "", err
+		}
+		keyBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read license key file! Error: %v", err)
+		}
+		key := strings.TrimSpace(string(keyBytes))
+		if len(key) == 0 {
+			return "", fmt.Errorf("License key file is empty: %s", path)
+		}
+		return key, nil
+	case strings.HasPrefix(value, licenseKeySealedPrefix):
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, licenseKeySealedPrefix))
+		if err != nil {
+			return "", fmt.Errorf("Invalid sealed license key! Error: %v", err)
+		}
+		key, err := unsealSecret(sealed, baseFolder)
+		if err != nil {
+			return "", fmt.Errorf("Failed to unseal license key! Error: %v", err)
+		}
+		return string(key), nil
+	}
+	return value, nil
+}
+
+// Returns the sealed LicenseKey value for the config. It can only be unsealed on this machine.
+func SealLicenseKey(key, baseFolder string) (string, error) {
+	sealed, err := sealSecret([]byte(key), baseFolder)
+	if err != nil {
+		return "", err
+	}
+	return licenseKeySealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Returns the LicenseKey value as it is written in the YAML config, or an empty string if there is none
+func RawLicenseKey(configBytes []byte) string {
+	match := licenseKeyLinePattern.FindSubmatchIndex(configBytes)
+	if match == nil {
+		return ""
+	}
+	value := strings.TrimSpace(string(configBytes[match[3]:match[1]]))
+	if len(value) < 2 {
+		return value
+	}
+	switch quote := value[0]; {
+	case quote == '\'' && value[len(value)-1] == quote:
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1)
+	case quote == '"' && value[len(value)-1] == quote:
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// Sets the LicenseKey value of a YAML config. It is quoted, as Windows paths are not plain YAML scalars.
+func ReplaceLicenseKey(configBytes []byte, value string) []byte {
+	line := quoteYaml(value)
+	match := licenseKeyLinePattern.FindSubmatchIndex(configBytes)
+	if match == nil {
+		return append([]byte("LicenseKey: "+line+"\n"), configBytes...)
+	}
+	result := make([]byte, 0, len(configBytes)+len(line))
+	result = append(result, configBytes[:match[3]]...)
+	result = append(result, line...)
+	return append(result, configBytes[match[1]:]...)
+}
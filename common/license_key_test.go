@@ -0,0 +1,88 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LicenseKeyTestSuite struct {
+	suite.Suite
+	baseFolder string
+}
+
+func TestLicenseKeyTestSuite(t *testing.T) {
+	suite.Run(t, new(LicenseKeyTestSuite))
+}
+
+func (suite *LicenseKeyTestSuite) SetupTest() {
+	var err error
+	suite.baseFolder, err = ioutil.TempDir("", "license-key")
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.baseFolder, "Config"), 0755))
+}
+
+func (suite *LicenseKeyTestSuite) TearDownTest() {
+	os.RemoveAll(suite.baseFolder)
+}
+
+func (suite *LicenseKeyTestSuite) TestResolveLicenseKey_clear() {
+	key, err := ResolveLicenseKey("abc-123", suite.baseFolder)
+	suite.NoError(err)
+	suite.Equal("abc-123", key)
+}
+
+func (suite *LicenseKeyTestSuite) TestResolveLicenseKey_file() {
+	keyPath := filepath.Join(suite.baseFolder, "Config", "license.key")
+	suite.Require().NoError(ioutil.WriteFile(keyPath, []byte("abc-123\n"), 0600))
+
+	key, err := ResolveLicenseKey("file:Config/license.key", suite.baseFolder)
+	suite.NoError(err)
+	suite.Equal("abc-123", key)
+
+	suite.Require().NoError(os.Chmod(keyPath, 0644))
+	_, err = ResolveLicenseKey("file:"+keyPath, suite.baseFolder)
+	suite.Error(err)
+}
+
+func (suite *LicenseKeyTestSuite) TestSealLicenseKey() {
+	sealed, err := SealLicenseKey("abc-123", suite.baseFolder)
+	suite.Require().NoError(err)
+	suite.True(IsLicenseKeyReference(sealed))
+	suite.NotContains(sealed, "abc-123")
+
+	key, err := ResolveLicenseKey(sealed, suite.baseFolder)
+	suite.NoError(err)
+	suite.Equal("abc-123", key)
+
+	_, err = ResolveLicenseKey("sealed:bm90IHNlYWxlZA==", suite.baseFolder)
+	suite.Error(err)
+}
+
+func (suite *LicenseKeyTestSuite) TestParseConfig_resolves() {
+	sealed, err := SealLicenseKey("abc-123", suite.baseFolder)
+	suite.Require().NoError(err)
+	configPath := filepath.Join(suite.baseFolder, "Config", "Config.yml")
+	configBytes := ReplaceLicenseKey([]byte("LicenseKey: abc-123\nWebservice:\n  Endpoint: https://example.com\n"), sealed)
+	suite.Require().NoError(ioutil.WriteFile(configPath, configBytes, 0600))
+
+	config, err := ParseConfig(configPath)
+	suite.NoError(err)
+	suite.Equal("abc-123", config.LicenseKey)
+	suite.Equal("https://example.com", config.Webservice.Endpoint)
+}
+
+func (suite *LicenseKeyTestSuite) TestRawLicenseKey() {
+	config := []byte("Webservice:\r\n  Endpoint: x\r\nLicenseKey: 'file:C:\\Keys\\it''s.key'\r\n")
+	suite.Equal(`file:C:\Keys\it's.key`, RawLicenseKey(config))
+
+	replaced := ReplaceLicenseKey(config, "abc-123")
+	suite.Equal("Webservice:\r\n  Endpoint: x\r\nLicenseKey: 'abc-123'\r\n", string(replaced))
+	suite.Equal("abc-123", RawLicenseKey(replaced))
+
+	suite.Equal("", RawLicenseKey([]byte("Webservice:\n")))
+	suite.Equal("LicenseKey: 'abc'\nWebservice:\n", string(ReplaceLicenseKey([]byte("Webservice:\n"), "abc")))
+}
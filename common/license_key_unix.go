@@ -0,0 +1,104 @@
+// +build !windows
+
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Without DPAPI secrets are sealed with AES-GCM by a random machine key, which is kept in
+// this file next to Config.yml, readable only by its owner
+const sealKeyFileName = ".license-seal.key"
+
+func sealKeyPath(baseFolder string) string {
+	return filepath.Join(baseFolder, "Config", sealKeyFileName)
+}
+
+// Reads the machine key, or creates it if it does not exist yet and create is set
+func readSealKey(baseFolder string, create bool) ([]byte, error) {
+	path := sealKeyPath(baseFolder)
+	if _, err := os.Stat(path); os.IsNotExist(err) && create {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, key, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	if err := checkKeyFilePermissions(path); err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Invalid seal key file: %s", path)
+	}
+	return key, nil
+}
+
+func newSealCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The sealed secret is the nonce followed by the encrypted secret
+func sealSecret(secret []byte, baseFolder string) ([]byte, error) {
+	key, err := readSealKey(baseFolder, true)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newSealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, secret, nil), nil
+}
+
+func unsealSecret(sealed []byte, baseFolder string) ([]byte, error) {
+	key, err := readSealKey(baseFolder, false)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newSealCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Sealed secret is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// Key files must not be accessible by the group or others
+func checkKeyFilePermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("Key file %s is accessible by others (mode %v)! Run chmod 600 on it.", path, info.Mode().Perm())
+	}
+	return nil
+}
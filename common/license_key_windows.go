@@ -0,0 +1,51 @@
+package common
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Mixed into the DPAPI encryption, so that other applications cannot unseal the key by accident
+var sealEntropy = []byte("palette-insight-license-key")
+
+// Seals with DPAPI in machine scope, as the services and the administrators run as different users
+func sealSecret(secret []byte, baseFolder string) ([]byte, error) {
+	var sealed windows.DataBlob
+	err := windows.CryptProtectData(newDataBlob(secret), nil, newDataBlob(sealEntropy), 0, nil,
+		windows.CRYPTPROTECT_UI_FORBIDDEN|windows.CRYPTPROTECT_LOCAL_MACHINE, &sealed)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&sealed), nil
+}
+
+func unsealSecret(sealed []byte, baseFolder string) ([]byte, error) {
+	var secret windows.DataBlob
+	err := windows.CryptUnprotectData(newDataBlob(sealed), nil, newDataBlob(sealEntropy), 0, nil,
+		windows.CRYPTPROTECT_UI_FORBIDDEN, &secret)
+	if err != nil {
+		return nil, err
+	}
+	return takeDataBlob(&secret), nil
+}
+
+// The key file is protected by the ACL of the installation folder
+func checkKeyFilePermissions(path string) error {
+	return nil
+}
+
+func newDataBlob(data []byte) *windows.DataBlob {
+	if len(data) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(data)), Data: &data[0]}
+}
+
+// Copies and frees the data allocated by DPAPI
+func takeDataBlob(blob *windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(uintptr(unsafe.Pointer(blob.Data))))
+	data := make([]byte, blob.Size)
+	copy(data, (*[1 << 30]byte)(unsafe.Pointer(blob.Data))[:blob.Size:blob.Size])
+	return data
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// The watchdog passes the operation ID to the manager in this environment variable
+const OperationIdEnvVar = "PALETTE_OPERATION_ID"
+
+const operationIdField = "operation_id"
+
+type operationIdKey struct{}
+
+// Returns a new random ID for correlating the log lines of an update or a command
+func NewOperationId() string {
+	id, err := newIdempotencyKey()
+	if err != nil {
+		return "unknown"
+	}
+	// Shorter IDs are easier to search for, and they are unique enough for this purpose
+	return id[:12]
+}
+
+func WithOperationId(ctx context.Context, operationId string) context.Context {
+	return context.WithValue(ctx, operationIdKey{}, operationId)
+}
+
+// Returns the operation ID of the context, or an empty string if there is none
+func OperationId(ctx context.Context) string {
+	operationId, _ := ctx.Value(operationIdKey{}).(string)
+	return operationId
+}
+
+// Formats key/value pairs as key=value, quoting the values if needed
+func formatLogFields(keyvals []interface{}) string {
+	var buffer bytes.Buffer
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		value := "(missing)"
+		if i+1 < len(keyvals) {
+			value = fmt.Sprint(keyvals[i+1])
+		}
+		if len(value) == 0 || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&buffer, " %s=%s", key, value)
+	}
+	return buffer.String()
+}
+
+// Fields added to every log line of the process, e.g. the operation ID in the manager
+var processLogFields = struct {
+	sync.Mutex
+	fields []byte
+}{}
+
+func SetProcessLogFields(keyvals ...interface{}) {
+	processLogFields.Lock()
+	defer processLogFields.Unlock()
+	processLogFields.fields = []byte(formatLogFields(keyvals))
+}
+
+// Inserts the process fields at the end of the line, before the line break
+func appendProcessLogFields(line []byte) []byte {
+	processLogFields.Lock()
+	fields := processLogFields.fields
+	processLogFields.Unlock()
+	if len(fields) == 0 {
+		return line
+	}
+
+	content := bytes.TrimRight(line, "\r\n")
+	result := make([]byte, 0, len(line)+len(fields))
+	result = append(result, content...)
+	result = append(result, fields...)
+	return append(result, line[len(content):]...)
+}
+
+// Logs with key/value fields appended to the messages
+type FieldLogger struct {
+	fields string
+}
+
+// Returns a logger which adds the operation ID of the context to every message
+func Log(ctx context.Context) *FieldLogger {
+	if operationId := OperationId(ctx); len(operationId) > 0 {
+		return &FieldLogger{fields: formatLogFields([]interface{}{operationIdField, operationId})}
+	}
+	return &FieldLogger{}
+}
+
+// Returns a logger which adds the given key/value pairs to every message as well
+func (l *FieldLogger) With(keyvals ...interface{}) *FieldLogger {
+	return &FieldLogger{fields: l.fields + formatLogFields(keyvals)}
+}
+
+func (l *FieldLogger) Debug(v ...interface{}) {
+	log.Debug(fmt.Sprint(v...) + l.fields)
+}
+
+func (l *FieldLogger) Debugf(format string, v ...interface{}) {
+	log.Debug(fmt.Sprintf(format, v...) + l.fields)
+}
+
+func (l *FieldLogger) Info(v ...interface{}) {
+	log.Info(fmt.Sprint(v...) + l.fields)
+}
+
+func (l *FieldLogger) Infof(format string, v ...interface{}) {
+	log.Info(fmt.Sprintf(format, v...) + l.fields)
+}
+
+func (l *FieldLogger) Warning(v ...interface{}) {
+	log.Warning(fmt.Sprint(v...) + l.fields)
+}
+
+func (l *FieldLogger) Warningf(format string, v ...interface{}) {
+	log.Warning(fmt.Sprintf(format, v...) + l.fields)
+}
+
+func (l *FieldLogger) Error(v ...interface{}) {
+	log.Error(fmt.Sprint(v...) + l.fields)
+}
+
+func (l *FieldLogger) Errorf(format string, v ...interface{}) {
+	log.Error(fmt.Sprintf(format, v...) + l.fields)
+}
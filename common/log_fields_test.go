@@ -0,0 +1,57 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LogFieldsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *LogFieldsTestSuite) TearDownTest() {
+	SetProcessLogFields()
+}
+
+func TestLogFieldsTestSuite(t *testing.T) {
+	suite.Run(t, new(LogFieldsTestSuite))
+}
+
+func (suite *LogFieldsTestSuite) TestFormatLogFields() {
+	suite.Equal(` version=1.2.3 path="C:\\Program Files\\agent" empty="" odd=(missing)`,
+		formatLogFields([]interface{}{"version", "1.2.3", "path", `C:\Program Files\agent`, "empty", "", "odd"}))
+}
+
+func (suite *LogFieldsTestSuite) TestOperationId() {
+	ctx := context.Background()
+	suite.Equal("", OperationId(ctx))
+
+	operationId := NewOperationId()
+	suite.Len(operationId, 12)
+	suite.NotEqual(operationId, NewOperationId())
+	suite.Equal(operationId, OperationId(WithOperationId(ctx, operationId)))
+}
+
+func (suite *LogFieldsTestSuite) TestFieldLogger() {
+	ctx := WithOperationId(context.Background(), "abc")
+	suite.Equal(" operation_id=abc", Log(ctx).fields)
+	suite.Equal(" operation_id=abc command=update", Log(ctx).With("command", "update").fields)
+	suite.Equal("", Log(context.Background()).fields)
+}
+
+func (suite *LogFieldsTestSuite) TestProcessFieldsAreAppendedToEveryLine() {
+	SetProcessLogFields("operation_id", "abc")
+	target := &bytes.Buffer{}
+	filter := &LevelFilter{Target: target}
+
+	n, err := filter.Write([]byte("2016-10-01 12:00:00.000 [INFO] first\r\n"))
+	suite.NoError(err)
+	suite.Equal(len("2016-10-01 12:00:00.000 [INFO] first\r\n"), n)
+	filter.Write([]byte("no line break"))
+
+	suite.Equal("2016-10-01 12:00:00.000 [INFO] first operation_id=abc\r\nno line break operation_id=abc",
+		target.String())
+}
@@ -0,0 +1,209 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Log levels which can be set at runtime. The levels of the targets cannot be changed once they
+// are added to go-log-targets, so every target is added at debug level behind a LevelFilter.
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarning
+	logLevelError
+	logLevelFatal
+)
+
+var logLevelNames = map[string]int{
+	"debug":   logLevelDebug,
+	"info":    logLevelInfo,
+	"warning": logLevelWarning,
+	"error":   logLevelError,
+}
+
+// Only this many bytes are searched for the level at the beginning of a log line
+const logLevelSearchLength = 64
+
+const defaultLogLevel = "debug"
+
+var logLevel = struct {
+	sync.Mutex
+	level      int
+	resetTimer *time.Timer
+	resetsAt   time.Time
+	// Incremented on every change, so that an outdated reset can be recognized
+	generation int
+}{level: logLevelNames[defaultLogLevel]}
+
+// Drops the log lines below the level set by SetLogLevel, or below the own level of the target
+type LevelFilter struct {
+	Target   io.Writer
+	minLevel int
+}
+
+// Creates a filter for a target which only needs the lines from the given level
+func NewLevelFilter(target io.Writer, level string) (*LevelFilter, error) {
+	filter := &LevelFilter{Target: target}
+	if len(level) > 0 {
+		minLevel, ok := logLevelNames[strings.ToLower(level)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown log level: %s", level)
+		}
+		filter.minLevel = minLevel
+	}
+	return filter, nil
+}
+
+func (f *LevelFilter) Write(p []byte) (int, error) {
+	logLevel.Lock()
+	minLevel := logLevel.level
+	logLevel.Unlock()
+	if f.minLevel > minLevel {
+		minLevel = f.minLevel
+	}
+
+	if detectLogLevel(p) < minLevel {
+		// Pretend that it has been written, otherwise the logger reports an error
+		return len(p), nil
+	}
+	if _, err := f.Target.Write(appendProcessLogFields([]byte(Redact(string(p))))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var logLevelTokens = []struct {
+	token []byte
+	level int
+}{
+	{[]byte("DEBUG"), logLevelDebug},
+	{[]byte("INFO"), logLevelInfo},
+	{[]byte("WARN"), logLevelWarning},
+	{[]byte("ERROR"), logLevelError},
+}
+
+// Returns the level of a log line, which is the level name occurring first in it. Lines
+// without a recognizable level are never dropped.
+func detectLogLevel(line []byte) int {
+	if len(line) > logLevelSearchLength {
+		line = line[:logLevelSearchLength]
+	}
+	line = bytes.ToUpper(line)
+	level, first := logLevelFatal, len(line)
+	for _, t := range logLevelTokens {
+		if index := bytes.Index(line, t.token); index >= 0 && index < first {
+			level, first = t.level, index
+		}
+	}
+	return level
+}
+
+func logLevelName(level int) string {
+	for name, value := range logLevelNames {
+		if value == level {
+			return name
+		}
+	}
+	return "fatal"
+}
+
+// Changes the minimum level of the log targets. The level is reset to the default after
+// the expiry, so that a forgotten verbose level does not flood the logs.
+func SetLogLevel(name string, expiry time.Duration) error {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("Unknown log level: %s", name)
+	}
+	if expiry <= 0 {
+		return fmt.Errorf("Log level expiry must be positive, got: %v", expiry)
+	}
+
+	logLevel.Lock()
+	if logLevel.resetTimer != nil {
+		logLevel.resetTimer.Stop()
+	}
+	logLevel.level = level
+	logLevel.resetsAt = time.Now().Add(expiry)
+	logLevel.generation++
+	generation := logLevel.generation
+	logLevel.resetTimer = time.AfterFunc(expiry, func() {
+		resetLogLevel(generation)
+	})
+	resetsAt := logLevel.resetsAt
+	// Logging must happen without holding the lock, as the LevelFilter needs it too
+	logLevel.Unlock()
+
+	log.Infof("Log level is set to %s until %s", name, resetsAt.Format(time.RFC3339))
+	return nil
+}
+
+func resetLogLevel(generation int) {
+	logLevel.Lock()
+	if logLevel.generation != generation {
+		// The level has been set again since this timer was started
+		logLevel.Unlock()
+		return
+	}
+	logLevel.level = logLevelNames[defaultLogLevel]
+	logLevel.resetTimer = nil
+	logLevel.resetsAt = time.Time{}
+	logLevel.Unlock()
+	log.Info("Log level is reset to ", defaultLogLevel)
+}
+
+// Returns the current log level and when it is reset to the default. The time is zero
+// if the default level is in effect.
+func GetLogLevel() (string, time.Time) {
+	logLevel.Lock()
+	defer logLevel.Unlock()
+	return logLevelName(logLevel.level), logLevel.resetsAt
+}
+
+// Layouts of the timestamps at the beginning of the log lines
+var logTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.000",
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+}
+
+// Returns the log lines written between since and until. A zero time means no limit on that side.
+// Lines without a timestamp (e.g. stack traces) belong to the last line with a timestamp.
+func FilterLogLines(lines []string, since, until time.Time) []string {
+	var result []string
+	included := false
+	for _, line := range lines {
+		if ts, ok := parseLogTimestamp(line); ok {
+			included = (since.IsZero() || !ts.Before(since)) && (until.IsZero() || !ts.After(until))
+		}
+		if included {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func parseLogTimestamp(line string) (time.Time, bool) {
+	for _, layout := range logTimestampLayouts {
+		var candidate string
+		if layout == time.RFC3339Nano {
+			// RFC3339 timestamps vary in length, so the first word is parsed
+			candidate = strings.SplitN(line, " ", 2)[0]
+		} else if len(line) >= len(layout) {
+			candidate = line[:len(layout)]
+		} else {
+			continue
+		}
+		if ts, err := time.ParseInLocation(layout, candidate, time.Local); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
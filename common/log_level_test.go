@@ -0,0 +1,99 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LogLevelTestSuite struct {
+	suite.Suite
+	target *bytes.Buffer
+	filter *LevelFilter
+}
+
+func (suite *LogLevelTestSuite) SetupTest() {
+	suite.target = &bytes.Buffer{}
+	suite.filter = &LevelFilter{Target: suite.target}
+}
+
+func (suite *LogLevelTestSuite) TearDownTest() {
+	suite.NoError(SetLogLevel(defaultLogLevel, time.Hour))
+}
+
+func TestLogLevelTestSuite(t *testing.T) {
+	suite.Run(t, new(LogLevelTestSuite))
+}
+
+func (suite *LogLevelTestSuite) TestLevelFilter_dropsLowerLevels() {
+	suite.NoError(SetLogLevel("warning", time.Hour))
+
+	suite.filter.Write([]byte("2016-10-01 12:00:00.000 [DEBUG] dropped\n"))
+	suite.filter.Write([]byte("2016-10-01 12:00:00.000 [INFO] dropped\n"))
+	suite.filter.Write([]byte("2016-10-01 12:00:00.000 [WARNING] kept, no info about it\n"))
+	suite.filter.Write([]byte("2016-10-01 12:00:00.000 [ERROR] kept\n"))
+	suite.filter.Write([]byte("panic: kept\n"))
+
+	suite.Equal("2016-10-01 12:00:00.000 [WARNING] kept, no info about it\n"+
+		"2016-10-01 12:00:00.000 [ERROR] kept\n"+
+		"panic: kept\n", suite.target.String())
+}
+
+func (suite *LogLevelTestSuite) TestSetLogLevel_expires() {
+	suite.NoError(SetLogLevel("error", 50*time.Millisecond))
+	level, resetsAt := GetLogLevel()
+	suite.Equal("error", level)
+	suite.False(resetsAt.IsZero())
+
+	time.Sleep(200 * time.Millisecond)
+	level, resetsAt = GetLogLevel()
+	suite.Equal(defaultLogLevel, level)
+	suite.True(resetsAt.IsZero())
+}
+
+func (suite *LogLevelTestSuite) TestSetLogLevel_newLevelIsNotResetByOldExpiry() {
+	suite.NoError(SetLogLevel("error", 50*time.Millisecond))
+	suite.NoError(SetLogLevel("info", time.Hour))
+
+	time.Sleep(200 * time.Millisecond)
+	level, _ := GetLogLevel()
+	suite.Equal("info", level)
+}
+
+func (suite *LogLevelTestSuite) TestSetLogLevel_invalid() {
+	suite.Error(SetLogLevel("verbose", time.Hour))
+	suite.Error(SetLogLevel("info", 0))
+}
+
+func (suite *LogLevelTestSuite) TestFilterLogLines() {
+	lines := []string{
+		"2016-10-01 11:59:59.000 [INFO] before",
+		"2016-10-01 12:00:00.000 [INFO] first",
+		"panic: continuation of first",
+		"2016-10-01 12:30:00.000 [INFO] second",
+		"2016-10-01 13:00:01.000 [INFO] after",
+		"continuation of after",
+	}
+	since := time.Date(2016, 10, 1, 12, 0, 0, 0, time.Local)
+	until := time.Date(2016, 10, 1, 13, 0, 0, 0, time.Local)
+
+	suite.Equal([]string{
+		"2016-10-01 12:00:00.000 [INFO] first",
+		"panic: continuation of first",
+		"2016-10-01 12:30:00.000 [INFO] second",
+	}, FilterLogLines(lines, since, until))
+	suite.Equal(lines[3:], FilterLogLines(lines, time.Date(2016, 10, 1, 12, 30, 0, 0, time.Local), time.Time{}))
+}
+
+func (suite *LogLevelTestSuite) TestFilterLogLines_rfc3339() {
+	lines := []string{
+		"2016-10-01T12:00:00Z INFO first",
+		"2016-10-01T14:00:00+02:00 INFO second",
+	}
+	since := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	until := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	suite.Equal(lines, FilterLogLines(lines, since, until))
+}
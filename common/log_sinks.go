@@ -0,0 +1,232 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+)
+
+// Remote sinks send the log lines from a queue, so that logging never waits for the network
+const (
+	logSinkQueueLength  = 1000
+	logSinkBatchSize    = 100
+	logSinkTimeout      = 10 * time.Second
+	logSinkCloseTimeout = 5 * time.Second
+)
+
+// Syslog severities by log level, the facility is always "user"
+var syslogSeverities = map[int]int{
+	logLevelDebug:   7,
+	logLevelInfo:    6,
+	logLevelWarning: 4,
+	logLevelError:   3,
+	logLevelFatal:   2,
+}
+
+const syslogFacilityUser = 1
+
+// Queues the log lines and sends them in batches in the background. Lines are dropped while
+// the queue is full, e.g. the remote end is unreachable.
+type asyncSink struct {
+	name string
+	send func(lines [][]byte) error
+
+	mutex  sync.Mutex
+	closed bool
+	lines  chan []byte
+	done   chan struct{}
+}
+
+func newAsyncSink(name string, send func(lines [][]byte) error) *asyncSink {
+	sink := &asyncSink{
+		name:  name,
+		send:  send,
+		lines: make(chan []byte, logSinkQueueLength),
+		done:  make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (s *asyncSink) Write(p []byte) (int, error) {
+	// The logger may reuse the buffer
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		select {
+		case s.lines <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (s *asyncSink) run() {
+	defer close(s.done)
+	failing := false
+	for line := range s.lines {
+		batch := [][]byte{line}
+	drain:
+		for len(batch) < logSinkBatchSize {
+			select {
+			case line, ok := <-s.lines:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, line)
+			default:
+				break drain
+			}
+		}
+
+		err := s.send(batch)
+		// Only report changes, because the report itself goes into this sink too
+		if err != nil && !failing {
+			log.Warningf("Failed to send logs to %s sink! Dropping log lines until it recovers. Error: %v", s.name, err)
+		} else if err == nil && failing {
+			log.Infof("Sending logs to %s sink recovered.", s.name)
+		}
+		failing = err != nil
+	}
+}
+
+// Sends the queued lines, but waits for them only for a limited time
+func (s *asyncSink) Close() error {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.lines)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(logSinkCloseTimeout):
+		return fmt.Errorf("Timed out sending the remaining logs to %s sink", s.name)
+	}
+}
+
+// Sends the log lines as RFC 5424 syslog messages
+type syslogSender struct {
+	network  string
+	address  string
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogSink(config LogSink, defaultTag string) *asyncSink {
+	sender := &syslogSender{
+		network: config.Network,
+		address: config.Address,
+		tag:     config.Tag,
+	}
+	if len(sender.network) == 0 {
+		sender.network = "udp"
+	}
+	if len(sender.tag) == 0 {
+		sender.tag = defaultTag
+	}
+	sender.hostname, _ = os.Hostname()
+	return newAsyncSink("syslog", sender.send)
+}
+
+func (s *syslogSender) send(lines [][]byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, logSinkTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	for _, line := range lines {
+		priority := syslogFacilityUser*8 + syslogSeverities[detectLogLevel(line)]
+		message := fmt.Sprintf("<%d>1 %s %s %s - - - %s", priority, time.Now().Format(time.RFC3339),
+			s.hostname, s.tag, bytes.TrimRight(line, "\r\n"))
+		if s.network != "udp" {
+			// Non-transparent framing
+			message += "\n"
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(logSinkTimeout))
+		if _, err := s.conn.Write([]byte(message)); err != nil {
+			// Reconnect next time
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+type httpLogLine struct {
+	Host    string `json:"host"`
+	Source  string `json:"source"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// POSTs the log lines as a JSON array
+type httpLogSender struct {
+	url      string
+	headers  map[string]string
+	source   string
+	hostname string
+	client   *http.Client
+}
+
+func newHttpLogSink(config LogSink, source string) *asyncSink {
+	sender := &httpLogSender{
+		url:     config.Url,
+		headers: config.Headers,
+		source:  source,
+		client:  &http.Client{Timeout: logSinkTimeout},
+	}
+	sender.hostname, _ = os.Hostname()
+	return newAsyncSink("http", sender.send)
+}
+
+func (s *httpLogSender) send(lines [][]byte) error {
+	body := make([]httpLogLine, len(lines))
+	for i, line := range lines {
+		body[i] = httpLogLine{
+			Host:    s.hostname,
+			Source:  s.source,
+			Level:   logLevelName(detectLogLevel(line)),
+			Message: string(bytes.TrimRight(line, "\r\n")),
+		}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Log sink %s responded with %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LogSinksTestSuite struct {
+	suite.Suite
+}
+
+func TestLogSinksTestSuite(t *testing.T) {
+	suite.Run(t, new(LogSinksTestSuite))
+}
+
+func (suite *LogSinksTestSuite) TestSyslogSink() {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	suite.Require().NoError(err)
+	defer conn.Close()
+
+	sink := newSyslogSink(LogSink{Address: conn.LocalAddr().String(), Tag: "test"}, "watchdog")
+	sink.Write([]byte("2016-10-01 12:00:00.000 [ERROR] something failed\n"))
+	suite.NoError(sink.Close())
+
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	suite.Require().NoError(err)
+	message := string(buffer[:n])
+	// Facility user (1), severity error (3)
+	suite.True(strings.HasPrefix(message, "<11>1 "), message)
+	suite.True(strings.HasSuffix(message, " test - - - 2016-10-01 12:00:00.000 [ERROR] something failed"), message)
+}
+
+func (suite *LogSinksTestSuite) TestHttpLogSink() {
+	received := make(chan []httpLogLine, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.Equal("secret", r.Header.Get("X-Token"))
+		var lines []httpLogLine
+		suite.NoError(json.NewDecoder(r.Body).Decode(&lines))
+		received <- lines
+	}))
+	defer server.Close()
+
+	sink := newHttpLogSink(LogSink{Url: server.URL, Headers: map[string]string{"X-Token": "secret"}}, "manager")
+	sink.Write([]byte("2016-10-01 12:00:00.000 [INFO] first\n"))
+	sink.Write([]byte("2016-10-01 12:00:00.000 [WARNING] second\n"))
+	suite.NoError(sink.Close())
+	close(received)
+
+	var lines []httpLogLine
+	for batch := range received {
+		lines = append(lines, batch...)
+	}
+	suite.Require().Len(lines, 2)
+	suite.Equal("manager", lines[0].Source)
+	suite.Equal("info", lines[0].Level)
+	suite.Equal("2016-10-01 12:00:00.000 [INFO] first", lines[0].Message)
+	suite.Equal("warning", lines[1].Level)
+}
+
+func (suite *LogSinksTestSuite) TestAsyncSink_unreachableDoesNotBlock() {
+	sink := newSyslogSink(LogSink{Network: "tcp", Address: "127.0.0.1:1"}, "watchdog")
+	start := time.Now()
+	for i := 0; i < 2*logSinkQueueLength; i++ {
+		_, err := sink.Write([]byte("2016-10-01 12:00:00.000 [INFO] dropped\n"))
+		suite.NoError(err)
+	}
+	suite.True(time.Since(start) < time.Second)
+	sink.Close()
+}
+
+func (suite *LogSinksTestSuite) TestLevelFilter_ownLevel() {
+	target := &bytes.Buffer{}
+	filter, err := NewLevelFilter(target, "error")
+	suite.Require().NoError(err)
+
+	filter.Write([]byte("2016-10-01 12:00:00.000 [WARNING] dropped\n"))
+	filter.Write([]byte("2016-10-01 12:00:00.000 [ERROR] kept\n"))
+	suite.Equal("2016-10-01 12:00:00.000 [ERROR] kept\n", target.String())
+
+	_, err = NewLevelFilter(target, "verbose")
+	suite.Error(err)
+}
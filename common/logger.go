@@ -1,45 +1,116 @@
 package common
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kardianos/osext"
 	log "github.com/palette-software/go-log-targets"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
-func setupLogRotate(logFilePath string) (*lumberjack.Logger, error) {
-	logRotate := &lumberjack.Logger{
+// The Splunk target needs the owner of the license, which may take a while to get
+const splunkSetupTimeout = 2 * time.Minute
+
+// Used when there are no sinks in the config
+var defaultLogSinks = []LogSink{
+	{Type: "file"},
+	{Type: "splunk"},
+}
+
+// Keeps track of the sinks which need to be closed at exit. Sinks may be added in the
+// background after InitLogging returned.
+type logSinks struct {
+	mutex   sync.Mutex
+	closed  bool
+	closers []io.Closer
+}
+
+// Adds the sink as a log target. An invalid level is reported, but the sink is added at debug level.
+func (s *logSinks) add(sink io.WriteCloser, level string) error {
+	filter, levelErr := NewLevelFilter(sink, level)
+	if levelErr != nil {
+		filter = &LevelFilter{Target: sink}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return sink.Close()
+	}
+	s.closers = append(s.closers, sink)
+	if err := log.AddTarget(filter, log.LevelDebug); err != nil {
+		return err
+	}
+	return levelErr
+}
+
+func (s *logSinks) close() {
+	s.mutex.Lock()
+	s.closed = true
+	closers := s.closers
+	s.mutex.Unlock()
+
+	for _, closer := range closers {
+		if err := closer.Close(); err != nil {
+			fmt.Println("Failed to close log sink! ", err)
+		}
+	}
+}
+
+func setupLogRotate(logFilePath string) *lumberjack.Logger {
+	return &lumberjack.Logger{
 		Filename:   logFilePath,
 		MaxSize:    10, // megabytes
 		MaxBackups: 10,
 	}
-
-	return logRotate, log.AddTarget(logRotate, log.LevelDebug)
 }
 
-func setupSplunkLogger(execFolder, logFilename string) (*log.SplunkTarget, error) {
-	license, err := GetLicenseData(execFolder)
-	if err == nil {
+// Adds the Splunk target once the owner of the license is known. Does not block.
+func (s *logSinks) setupSplunkLogger(config Config, sink LogSink, logFilename string) {
+	address := sink.Address
+	if len(address) == 0 {
+		address = SplunkServerAddress
+	}
+	token := sink.Token
+	if len(token) == 0 {
+		token = WatchdogSplunkToken
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), splunkSetupTimeout)
+		defer cancel()
+		client, err := SharedApiClientWithConfig(config)
+		if err != nil {
+			log.Error("Failed to create Insight API client in ", logFilename, "! Continue without Splunk logging! Error: ", err)
+			return
+		}
+		license, err := getLicenseDataForClient(ctx, client)
+		if err != nil {
+			log.Error("Failed to get license data in ", logFilename, "! Continue without Splunk logging! Error: ", err)
+			return
+		}
 		log.Info("Owner of the license:", license.Owner)
-		// Add logging to Splunk as well
-		splunkLogger, err := log.NewSplunkTarget(SplunkServerAddress, WatchdogSplunkToken, license.Owner)
-		if err == nil {
-			log.AddTarget(splunkLogger, log.LevelDebug)
-			return splunkLogger, nil
-		} else {
+		splunkLogger, err := log.NewSplunkTarget(address, token, license.Owner)
+		if err != nil {
 			log.Error("Failed to create Splunk target for ", logFilename, "! Error: ", err)
-			return nil, err
+			return
 		}
-	} else {
-		log.Error("Failed to get license data in ", logFilename, "! Continue without Splunk logging! Error: ", err)
-		return nil, err
-	}
+		if err := s.add(splunkLogger, sink.Level); err != nil {
+			log.Error("Failed to add Splunk target for ", logFilename, "! Error: ", err)
+		}
+	}()
 }
 
-// Initialize the log to write into file instead of stderr
+// Initialize the log to write into the configured sinks instead of stderr. Problems with the
+// sinks are only logged, and remote sinks are set up in the background, so that starting up
+// never depends on the network.
 func InitLogging(logFilename string) (func(), error) {
 	// Do not use relative paths, otherwise our files will end up in Windows/System32
 	execFolder, errorToLogLater := osext.ExecutableFolder()
@@ -49,37 +120,56 @@ func InitLogging(logFilename string) (func(), error) {
 
 	// open output file
 	logsFolder := filepath.Join(execFolder, "Logs")
-	err := os.Mkdir(logsFolder, 0777)
+	err := os.MkdirAll(logsFolder, 0777)
 	if err != nil {
 		fmt.Println("Failed to create log folder! ", err)
-		panic(err)
+		return nil, err
 	}
 
-	logFilePath := filepath.Join(logsFolder, logFilename)
-
-	logRotate, err := setupLogRotate(logFilePath)
-	if err != nil {
-		return nil, err
+	// Problems with the config are logged again once the sinks are set up
+	config, configErr := ParseAgentConfig(execFolder)
+	redactionErr := SetRedaction(config)
+	configuredSinks := config.Watchdog.Logging.Sinks
+	if len(configuredSinks) == 0 {
+		configuredSinks = defaultLogSinks
 	}
 
-	splunkLogger, err := setupSplunkLogger(execFolder, logFilename)
-	if err != nil {
-		return nil, err
+	sinks := &logSinks{}
+	source := strings.TrimSuffix(logFilename, filepath.Ext(logFilename))
+	var sinkErrors []error
+	for _, sink := range configuredSinks {
+		err = nil
+		switch strings.ToLower(sink.Type) {
+		case "file":
+			err = sinks.add(setupLogRotate(filepath.Join(logsFolder, logFilename)), sink.Level)
+		case "splunk":
+			sinks.setupSplunkLogger(config, sink, logFilename)
+		case "syslog":
+			err = sinks.add(newSyslogSink(sink, source), sink.Level)
+		case "http":
+			err = sinks.add(newHttpLogSink(sink, source), sink.Level)
+		default:
+			err = fmt.Errorf("Unknown log sink type: %s", sink.Type)
+		}
+		if err != nil {
+			sinkErrors = append(sinkErrors, err)
+		}
 	}
 
 	if errorToLogLater != nil {
 		log.Error("Failed to retrieve executable folder, thus base dir is not set! Error message: ",
 			errorToLogLater)
 	}
-
-	closeLogging := func() {
-		if err := logRotate.Close(); err != nil {
-			fmt.Println("Failed to close log file! ", err)
-		}
-		if err := splunkLogger.Close(); err != nil {
-			fmt.Println("Failed to close splunk logger! ", err)
-		}
+	if configErr != nil {
+		log.Error("Failed to parse config for setting up logging! Using the default log sinks. Error: ", configErr)
+	}
+	if redactionErr != nil {
+		log.Error("Failed to set up redaction! Error: ", redactionErr)
+	}
+	for _, err := range sinkErrors {
+		log.Error("Failed to set up log sink! Error: ", err)
 	}
 
-	return closeLogging, nil
+	// A Splunk target which is added after this gets closed right away
+	return sinks.close, nil
 }
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Exit codes of the manager by failure class
+const (
+	ManagerExitSuccess          = 0
+	ManagerExitInternal         = 1
+	ManagerExitUsage            = 2
+	ManagerExitInvalidPackage   = 3
+	ManagerExitServiceControl   = 4
+	ManagerExitInstallFailed    = 5
+	ManagerExitAgentStartFailed = 6
+)
+
+var managerExitClasses = map[int]string{
+	ManagerExitSuccess:          "success",
+	ManagerExitInternal:         "internal",
+	ManagerExitUsage:            "usage",
+	ManagerExitInvalidPackage:   "invalid-package",
+	ManagerExitServiceControl:   "service-control",
+	ManagerExitInstallFailed:    "install-failed",
+	ManagerExitAgentStartFailed: "agent-start-failed",
+}
+
+// The manager writes the result of an update into this file next to its executable as well,
+// because the update restarts the watchdog, so it cannot read the output of the manager.
+const ManagerResultFileName = "manager-result.json"
+
+// The result of a manager command. The manager prints it as a single JSON line on stdout.
+type ManagerResult struct {
+	Command     string    `json:"command"`
+	OperationId string    `json:"operationId"`
+	ExitCode    int       `json:"exitCode"`
+	Class       string    `json:"class"`
+	Message     string    `json:"message,omitempty"`
+	Warnings    []string  `json:"warnings,omitempty"`
+	Finished    time.Time `json:"finished"`
+}
+
+func (r ManagerResult) Success() bool {
+	return r.ExitCode == ManagerExitSuccess
+}
+
+// A failed manager command
+type ManagerError struct {
+	ExitCode int
+	Message  string
+}
+
+func NewManagerError(exitCode int, format string, v ...interface{}) *ManagerError {
+	return &ManagerError{ExitCode: exitCode, Message: fmt.Sprintf(format, v...)}
+}
+
+func (e *ManagerError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, ManagerExitClass(e.ExitCode))
+}
+
+func ManagerExitClass(exitCode int) string {
+	if class, ok := managerExitClasses[exitCode]; ok {
+		return class
+	}
+	return fmt.Sprintf("unknown (%d)", exitCode)
+}
+
+// Creates the result of a command. Errors other than *ManagerError count as internal errors.
+func NewManagerResult(command string, err error, warnings []string) ManagerResult {
+	result := ManagerResult{
+		Command:  command,
+		ExitCode: ManagerExitSuccess,
+		Warnings: warnings,
+		Finished: time.Now(),
+	}
+	if err != nil {
+		result.ExitCode = ManagerExitInternal
+		result.Message = err.Error()
+		if managerErr, ok := err.(*ManagerError); ok {
+			result.ExitCode = managerErr.ExitCode
+			result.Message = managerErr.Message
+		}
+	}
+	result.Class = ManagerExitClass(result.ExitCode)
+	return result
+}
+
+// Returns the error of a failed result, or nil
+func (r ManagerResult) Err() error {
+	if r.Success() {
+		return nil
+	}
+	return &ManagerError{ExitCode: r.ExitCode, Message: r.Message}
+}
+
+// Finds the result in the output of the manager. If there is none (e.g. an older manager),
+// the result is made up from the exit code.
+func ParseManagerOutput(command string, output []byte, exitCode int) ManagerResult {
+	lines := bytes.Split(output, []byte("\n"))
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := bytes.TrimSpace(lines[i])
+		if !bytes.HasPrefix(line, []byte("{")) {
+			continue
+		}
+		var result ManagerResult
+		if err := json.Unmarshal(line, &result); err == nil && len(result.Class) > 0 {
+			return result
+		}
+	}
+
+	result := NewManagerResult(command, nil, nil)
+	if exitCode != ManagerExitSuccess {
+		result = NewManagerResult(command, &ManagerError{ExitCode: exitCode,
+			Message: fmt.Sprintf("Manager exited with code %d without a result", exitCode)}, nil)
+	}
+	return result
+}
+
+func WriteManagerResultFile(path string, result ManagerResult) error {
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, resultBytes, 0644)
+}
+
+// Reads and deletes the result file. Returns false if there is no result file.
+func TakeManagerResultFile(path string) (ManagerResult, bool, error) {
+	var result ManagerResult
+	resultBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return result, false, nil
+	}
+	if err != nil {
+		return result, false, err
+	}
+	os.Remove(path)
+	if err := json.Unmarshal(resultBytes, &result); err != nil {
+		return result, false, fmt.Errorf("Invalid manager result file: %s Error: %v", path, err)
+	}
+	return result, true, nil
+}
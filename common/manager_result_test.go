@@ -0,0 +1,78 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ManagerResultTestSuite struct {
+	suite.Suite
+}
+
+func TestManagerResultTestSuite(t *testing.T) {
+	suite.Run(t, new(ManagerResultTestSuite))
+}
+
+func (suite *ManagerResultTestSuite) TestNewManagerResult() {
+	result := NewManagerResult("update", NewManagerError(ManagerExitInstallFailed, "msiexec failed: %d", 1603), nil)
+	suite.Equal(ManagerExitInstallFailed, result.ExitCode)
+	suite.Equal("install-failed", result.Class)
+	suite.Equal("msiexec failed: 1603", result.Message)
+	suite.False(result.Success())
+
+	result = NewManagerResult("stop", errors.New("unexpected"), nil)
+	suite.Equal(ManagerExitInternal, result.ExitCode)
+	suite.Equal("internal", result.Class)
+
+	result = NewManagerResult("start", nil, []string{"warning"})
+	suite.True(result.Success())
+	suite.Nil(result.Err())
+}
+
+func (suite *ManagerResultTestSuite) TestParseManagerOutput() {
+	output := []byte("some installer output\r\n" +
+		`{"command":"stop","operationId":"abc","exitCode":4,"class":"service-control","message":"access denied"}` + "\r\n")
+
+	result := ParseManagerOutput("stop", output, 4)
+	suite.Equal("abc", result.OperationId)
+	suite.Equal(ManagerExitServiceControl, result.ExitCode)
+
+	err, ok := result.Err().(*ManagerError)
+	suite.Require().True(ok)
+	suite.Equal(ManagerExitServiceControl, err.ExitCode)
+	suite.Equal("access denied (service-control)", err.Error())
+}
+
+func (suite *ManagerResultTestSuite) TestParseManagerOutput_noResult() {
+	result := ParseManagerOutput("start", []byte("{not json\n"), 3)
+	suite.Equal("start", result.Command)
+	suite.Equal(ManagerExitInvalidPackage, result.ExitCode)
+	suite.Equal("invalid-package", result.Class)
+
+	suite.True(ParseManagerOutput("start", nil, 0).Success())
+}
+
+func (suite *ManagerResultTestSuite) TestResultFile() {
+	folder, err := ioutil.TempDir("", "manager-result")
+	suite.Require().NoError(err)
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, ManagerResultFileName)
+
+	_, found, err := TakeManagerResultFile(path)
+	suite.NoError(err)
+	suite.False(found)
+
+	suite.NoError(WriteManagerResultFile(path, NewManagerResult("update", nil, nil)))
+	result, found, err := TakeManagerResultFile(path)
+	suite.NoError(err)
+	suite.True(found)
+	suite.Equal("update", result.Command)
+
+	_, err = os.Stat(path)
+	suite.True(os.IsNotExist(err))
+}
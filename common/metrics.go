@@ -0,0 +1,196 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal metrics registry which can be rendered in the Prometheus text exposition format.
+// It only supports what the watchdog needs: counters, gauges and summaries without quantiles.
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+	metricSummary = "summary"
+)
+
+type Metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	count       uint64
+}
+
+type metricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []*Metric
+}
+
+var defaultRegistry metricsRegistry
+
+func newMetric(name, help, kind string, labelNames []string) *Metric {
+	m := &Metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*metricSeries),
+	}
+	defaultRegistry.mutex.Lock()
+	defer defaultRegistry.mutex.Unlock()
+	defaultRegistry.metrics = append(defaultRegistry.metrics, m)
+	return m
+}
+
+// Creates and registers a counter. Label values need to be passed in the same order as the names.
+func NewCounter(name, help string, labelNames ...string) *Metric {
+	return newMetric(name, help, metricCounter, labelNames)
+}
+
+func NewGauge(name, help string, labelNames ...string) *Metric {
+	return newMetric(name, help, metricGauge, labelNames)
+}
+
+// Summaries are exported as <name>_sum and <name>_count
+func NewSummary(name, help string, labelNames ...string) *Metric {
+	return newMetric(name, help, metricSummary, labelNames)
+}
+
+func (m *Metric) getSeries(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labelNames) {
+		// Do not panic in production code because of a metric, but make it visible
+		labelValues = append(labelValues, make([]string, len(m.labelNames))...)[:len(m.labelNames)]
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *Metric) Add(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.getSeries(labelValues).value += value
+}
+
+func (m *Metric) Set(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.getSeries(labelValues).value = value
+}
+
+func (m *Metric) Observe(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.getSeries(labelValues)
+	s.value += value
+	s.count++
+}
+
+func (m *Metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		labels := m.formatLabels(s.labelValues)
+		if m.kind == metricSummary {
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatMetricValue(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatMetricValue(s.value))
+		}
+	}
+}
+
+func (m *Metric) formatLabels(labelValues []string) string {
+	if len(m.labelNames) == 0 {
+		return ""
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	for i, name := range m.labelNames {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		fmt.Fprintf(&buffer, "%s=\"%s\"", name, escapeLabelValue(labelValues[i]))
+	}
+	buffer.WriteString("}")
+	return buffer.String()
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Writes every registered metric in the Prometheus text format
+func WriteMetrics(w io.Writer) {
+	defaultRegistry.mutex.Lock()
+	metrics := append([]*Metric(nil), defaultRegistry.metrics...)
+	defaultRegistry.mutex.Unlock()
+
+	sort.Sort(metricsByName(metrics))
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type metricsByName []*Metric
+
+func (a metricsByName) Len() int           { return len(a) }
+func (a metricsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a metricsByName) Less(i, j int) bool { return a[i].name < a[j].name }
+
+// Metrics of the Insight API client
+var (
+	apiRequestDuration = NewSummary("palette_api_request_duration_seconds",
+		"Duration of Insight Server API requests.", "method", "status")
+	apiRetries = NewCounter("palette_api_retries_total",
+		"Number of retried Insight Server API requests.", "method")
+	apiNotModified = NewCounter("palette_api_not_modified_total",
+		"Number of conditional Insight Server API requests answered with 304 Not Modified.")
+	endpointSwitches = NewCounter("palette_api_endpoint_switches_total",
+		"Number of times the Insight Server endpoint in use changed.")
+	downloadedBytes = NewCounter("palette_download_bytes_total",
+		"Number of bytes downloaded from the Insight Server.")
+	downloadDuration = NewSummary("palette_download_duration_seconds",
+		"Duration of successful file downloads.")
+	downloadFailures = NewCounter("palette_download_failures_total",
+		"Number of failed file downloads by reason.", "reason")
+)
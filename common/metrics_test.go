@@ -0,0 +1,61 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+}
+
+func TestMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
+
+func (suite *MetricsTestSuite) TestCounterWithLabels() {
+	counter := NewCounter("test_counter_total", "Test counter.", "reason")
+	counter.Inc("b")
+	counter.Inc("a")
+	counter.Add(2, "b")
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	suite.Equal("# HELP test_counter_total Test counter.\n"+
+		"# TYPE test_counter_total counter\n"+
+		"test_counter_total{reason=\"a\"} 1\n"+
+		"test_counter_total{reason=\"b\"} 3\n", buffer.String())
+}
+
+func (suite *MetricsTestSuite) TestSummary() {
+	summary := NewSummary("test_duration_seconds", "Test summary.")
+	summary.Observe(0.5)
+	summary.Observe(1.25)
+
+	var buffer bytes.Buffer
+	summary.write(&buffer)
+	suite.Equal("# HELP test_duration_seconds Test summary.\n"+
+		"# TYPE test_duration_seconds summary\n"+
+		"test_duration_seconds_sum 1.75\n"+
+		"test_duration_seconds_count 2\n", buffer.String())
+}
+
+func (suite *MetricsTestSuite) TestLabelValueEscaping() {
+	gauge := NewGauge("test_gauge", "Test gauge.", "path")
+	gauge.Set(3, "C:\\\"Logs\"")
+
+	var buffer bytes.Buffer
+	gauge.write(&buffer)
+	suite.Contains(buffer.String(), "test_gauge{path=\"C:\\\\\\\"Logs\\\"\"} 3\n")
+}
+
+func (suite *MetricsTestSuite) TestMissingLabelValues() {
+	counter := NewCounter("test_missing_labels_total", "Test counter.", "command", "result")
+	counter.Inc("start")
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+	suite.Contains(buffer.String(), "test_missing_labels_total{command=\"start\",result=\"\"} 1\n")
+}
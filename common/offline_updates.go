@@ -0,0 +1,136 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	insight "github.com/palette-software/insight-server/lib"
+)
+
+// The manifest files which can be placed in the offline update folder. The first one is in
+// the same format as the response of the /updates/manifest endpoint, the legacy one is in
+// the format of /agent/version. URLs are paths relative to the offline update folder.
+const (
+	OfflineManifestFileName       = "manifest.json"
+	OfflineLegacyManifestFileName = "agent-version.json"
+)
+
+// Without a manifest, the folder is scanned for installers named like <product>-<version>.msi
+// (e.g. agent-2.1.5.msi or palette-insight-agent-v2.1.5.msi). The SHA-256 hash of an installer
+// has to be in <installer>.sha256 next to it, otherwise the installer is skipped.
+var offlineInstallerPattern = regexp.MustCompile(`(?i)^(.+?)[-_]v?(\d+\.\d+\.\d+(?:\.\d+)?)\.(msi|exe)$`)
+
+const offlineChecksumExtension = ".sha256"
+
+// Returns the newest artifact of the product for the platform in the offline update folder
+func FindOfflineArtifact(ctx context.Context, folder, product, goos, arch string) (UpdateArtifact, error) {
+	logger := Log(ctx)
+	if _, err := os.Stat(folder); err != nil {
+		return UpdateArtifact{}, fmt.Errorf("Offline update folder %s is not available! Error: %v", folder, err)
+	}
+
+	manifestPath := filepath.Join(folder, OfflineManifestFileName)
+	if _, err := os.Stat(manifestPath); err == nil {
+		manifest := UpdateManifest{}
+		if err := decodeJsonFile(manifestPath, &manifest); err != nil {
+			return UpdateArtifact{}, err
+		}
+		return manifest.FindArtifact(product, goos, arch)
+	}
+
+	legacyPath := filepath.Join(folder, OfflineLegacyManifestFileName)
+	if _, err := os.Stat(legacyPath); err == nil {
+		latestUpdate := insight.UpdateVersion{}
+		if err := decodeJsonFile(legacyPath, &latestUpdate); err != nil {
+			return UpdateArtifact{}, err
+		}
+		return LegacyUpdateArtifact(product, latestUpdate), nil
+	}
+
+	manifest, err := scanOfflineFolder(ctx, folder, product)
+	if err != nil {
+		return UpdateArtifact{}, err
+	}
+	artifact, err := manifest.FindArtifact(product, goos, arch)
+	if err != nil {
+		return UpdateArtifact{}, fmt.Errorf("Neither %s nor %s, nor any %s installer with a %s checksum file is in offline update folder %s!",
+			OfflineManifestFileName, OfflineLegacyManifestFileName, product, offlineChecksumExtension, folder)
+	}
+	logger.Debugf("Found %s installer %s by scanning %s", product, artifact.Url, folder)
+	return artifact, nil
+}
+
+// Lists the installers of the product in the folder, which have a checksum file
+func scanOfflineFolder(ctx context.Context, folder, product string) (UpdateManifest, error) {
+	logger := Log(ctx)
+	manifest := UpdateManifest{}
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return manifest, fmt.Errorf("Failed to list offline update folder %s! Error: %v", folder, err)
+	}
+
+	for _, file := range files {
+		match := offlineInstallerPattern.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		name := strings.ToLower(match[1])
+		if name != product && !strings.HasSuffix(name, "-"+product) {
+			continue
+		}
+		hash, err := readChecksumFile(filepath.Join(folder, file.Name()+offlineChecksumExtension))
+		if err != nil {
+			logger.Warningf("Skipping offline installer %s, because its checksum is not available! Error: %v",
+				file.Name(), err)
+			continue
+		}
+		manifest.Artifacts = append(manifest.Artifacts, UpdateArtifact{
+			Product: product,
+			Version: match[2],
+			Url:     file.Name(),
+			Sha256:  hash,
+			Size:    file.Size(),
+			// Placing an installer into the folder is an explicit decision to install it
+			Mandatory: true,
+		})
+	}
+	return manifest, nil
+}
+
+// Reads a checksum file, which contains the hex SHA-256 hash optionally followed by the file name
+func readChecksumFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("Checksum file is empty: %s", path)
+	}
+	hash, err := hex.DecodeString(fields[0])
+	if err != nil || len(hash) != sha256.Size {
+		return "", fmt.Errorf("Invalid SHA-256 hash in checksum file: %s", path)
+	}
+	return fields[0], nil
+}
+
+func decodeJsonFile(path string, v interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open offline update manifest: %s! Error: %v", path, err)
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		return fmt.Errorf("Error while deserializing offline update manifest: %s. Error message: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OfflineUpdatesTestSuite struct {
+	suite.Suite
+	folder string
+}
+
+func TestOfflineUpdatesTestSuite(t *testing.T) {
+	suite.Run(t, new(OfflineUpdatesTestSuite))
+}
+
+func (suite *OfflineUpdatesTestSuite) SetupTest() {
+	var err error
+	suite.folder, err = ioutil.TempDir("", "offline-updates")
+	suite.Require().NoError(err)
+}
+
+func (suite *OfflineUpdatesTestSuite) TearDownTest() {
+	os.RemoveAll(suite.folder)
+}
+
+const testSha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (suite *OfflineUpdatesTestSuite) writeFile(name, content string) {
+	suite.Require().NoError(ioutil.WriteFile(filepath.Join(suite.folder, name), []byte(content), 0644))
+}
+
+func (suite *OfflineUpdatesTestSuite) TestManifest() {
+	suite.writeFile(OfflineManifestFileName, `{"artifacts": [
+		{"product": "agent", "os": "windows", "version": "2.1.5", "url": "agent-2.1.5.msi", "sha256": "abc"},
+		{"product": "agent", "os": "windows", "version": "2.2.0", "url": "agent-2.2.0.msi", "sha256": "def"}]}`)
+	// The manifest takes precedence over the other files
+	suite.writeFile(OfflineLegacyManifestFileName, `{"major": 9, "minor": 0, "patch": 0}`)
+	suite.writeFile("agent-9.9.9.msi", "")
+	suite.writeFile("agent-9.9.9.msi.sha256", testSha256)
+
+	artifact, err := FindOfflineArtifact(context.Background(), suite.folder, "agent", "windows", "amd64")
+	suite.Require().NoError(err)
+	suite.Equal("2.2.0", artifact.Version)
+	suite.Equal("agent-2.2.0.msi", artifact.Url)
+}
+
+func (suite *OfflineUpdatesTestSuite) TestLegacyManifest() {
+	suite.writeFile(OfflineLegacyManifestFileName,
+		`{"major": 2, "minor": 1, "patch": 7, "md5": "abc", "url": "agent.msi"}`)
+
+	artifact, err := FindOfflineArtifact(context.Background(), suite.folder, "agent", "windows", "amd64")
+	suite.Require().NoError(err)
+	suite.Equal("2.1.7", artifact.Version)
+	suite.Equal("agent.msi", artifact.Url)
+	suite.Equal("abc", artifact.Md5)
+	suite.True(artifact.Mandatory)
+}
+
+func (suite *OfflineUpdatesTestSuite) TestInvalidManifest() {
+	suite.writeFile(OfflineManifestFileName, `{"artifacts": [`)
+
+	_, err := FindOfflineArtifact(context.Background(), suite.folder, "agent", "windows", "amd64")
+	suite.Error(err)
+}
+
+func (suite *OfflineUpdatesTestSuite) TestScan() {
+	suite.writeFile("agent-2.1.5.msi", "old")
+	suite.writeFile("agent-2.1.5.msi.sha256", testSha256)
+	suite.writeFile("Palette-Insight-Agent-v2.2.0.msi", "newer")
+	suite.writeFile("Palette-Insight-Agent-v2.2.0.msi.sha256", strings.ToUpper(testSha256)+" *Palette-Insight-Agent-v2.2.0.msi\n")
+	// Newer, but without a checksum
+	suite.writeFile("agent-3.0.0.msi", "")
+	// Installer of another product
+	suite.writeFile("watchdog-9.0.0.msi", "")
+	suite.writeFile("watchdog-9.0.0.msi.sha256", testSha256)
+
+	artifact, err := FindOfflineArtifact(context.Background(), suite.folder, "agent", "windows", "amd64")
+	suite.Require().NoError(err)
+	suite.Equal("2.2.0", artifact.Version)
+	suite.Equal("Palette-Insight-Agent-v2.2.0.msi", artifact.Url)
+	suite.Equal(strings.ToUpper(testSha256), artifact.Sha256)
+	suite.Equal(int64(len("newer")), artifact.Size)
+	suite.True(artifact.Mandatory)
+}
+
+func (suite *OfflineUpdatesTestSuite) TestScan_invalidChecksum() {
+	suite.writeFile("agent-2.1.5.msi", "")
+	suite.writeFile("agent-2.1.5.msi.sha256", "not a hash")
+
+	_, err := FindOfflineArtifact(context.Background(), suite.folder, "agent", "windows", "amd64")
+	suite.Error(err)
+}
+
+func (suite *OfflineUpdatesTestSuite) TestEmptyFolder() {
+	_, err := FindOfflineArtifact(context.Background(), suite.folder, "agent", "windows", "amd64")
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), OfflineManifestFileName)
+}
+
+func (suite *OfflineUpdatesTestSuite) TestMissingFolder() {
+	_, err := FindOfflineArtifact(context.Background(), filepath.Join(suite.folder, "missing"), "agent", "windows", "amd64")
+	suite.Error(err)
+}
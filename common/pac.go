@@ -0,0 +1,262 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+const (
+	// The PAC file is loaded again after this time
+	pacRefreshInterval = time.Hour
+	// A PAC script running longer than this is stopped
+	pacEvaluationTimeout = 5 * time.Second
+	pacDownloadTimeout   = 30 * time.Second
+)
+
+var errPacTimeout = errors.New("The proxy auto-config script timed out")
+
+// The PAC helper functions which do not need Go. weekdayRange, dateRange and timeRange are not
+// supported, they always match.
+const pacHelpers = `
+function isPlainHostName(host) { return host.indexOf('.') < 0; }
+function dnsDomainIs(host, domain) {
+	return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+function localHostOrDomainIs(host, hostdom) { return host == hostdom || hostdom.indexOf(host + '.') == 0; }
+function dnsDomainLevels(host) { return host.split('.').length - 1; }
+function isInNet(host, pattern, mask) {
+	var ip = dnsResolve(host);
+	return ip != null && _isInNet(ip, pattern, mask);
+}
+function weekdayRange() { return true; }
+function dateRange() { return true; }
+function timeRange() { return true; }
+`
+
+// A proxy auto-config file from a URL or a local path. The script is run by a JavaScript interpreter.
+type pacFile struct {
+	source     string
+	baseFolder string
+
+	mutex  sync.Mutex
+	vm     *otto.Otto
+	loaded time.Time
+}
+
+func newPacFile(source, baseFolder string) *pacFile {
+	return &pacFile{source: source, baseFolder: baseFolder}
+}
+
+// Whether the other PAC file is loaded from the same place, so that it can be kept
+func (p *pacFile) sameAs(other *pacFile) bool {
+	return other != nil && p.source == other.source && p.baseFolder == other.baseFolder
+}
+
+// Returns the first proxy returned by FindProxyForURL, or nil for DIRECT
+func (p *pacFile) findProxy(ctx context.Context, target *url.URL) (*url.URL, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.vm == nil || time.Since(p.loaded) > pacRefreshInterval {
+		if err := p.load(); err != nil {
+			if p.vm == nil {
+				return nil, err
+			}
+			Log(ctx).Error("Failed to reload proxy auto-config file! Using the previous one. Error: ", err)
+			p.loaded = time.Now()
+		}
+	}
+
+	result, err := p.evaluate(target.String(), target.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	return parsePacResult(result)
+}
+
+func (p *pacFile) load() error {
+	script, err := p.read()
+	if err != nil {
+		return err
+	}
+	vm := otto.New()
+	for name, function := range pacNativeFunctions {
+		if err := vm.Set(name, function); err != nil {
+			return err
+		}
+	}
+	if _, err := vm.Run(pacHelpers); err != nil {
+		return err
+	}
+	if _, err := vm.Run(script); err != nil {
+		return fmt.Errorf("Invalid proxy auto-config file %s! Error: %v", p.source, err)
+	}
+	p.vm = vm
+	p.loaded = time.Now()
+	return nil
+}
+
+func (p *pacFile) read() (string, error) {
+	if strings.HasPrefix(p.source, "http://") || strings.HasPrefix(p.source, "https://") {
+		// The PAC file itself is downloaded directly
+		client := &http.Client{Timeout: pacDownloadTimeout}
+		resp, err := client.Get(p.source)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Failed to download proxy auto-config file %s: %s", p.source, resp.Status)
+		}
+		script, err := ioutil.ReadAll(resp.Body)
+		return string(script), err
+	}
+
+	path := p.source
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.baseFolder, path)
+	}
+	script, err := ioutil.ReadFile(path)
+	return string(script), err
+}
+
+// Runs FindProxyForURL, stopping the script if it runs for too long
+func (p *pacFile) evaluate(targetUrl, host string) (result string, err error) {
+	// Every call has a channel of its own. The timer may fire even after Stop, but then it
+	// interrupts nothing, because the next call no longer reads this channel.
+	interrupt := make(chan func(), 1)
+	p.vm.Interrupt = interrupt
+	timer := time.AfterFunc(pacEvaluationTimeout, func() {
+		interrupt <- func() {
+			panic(errPacTimeout)
+		}
+	})
+	defer timer.Stop()
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught != errPacTimeout {
+				panic(caught)
+			}
+			err = errPacTimeout
+		}
+	}()
+
+	value, err := p.vm.Call("FindProxyForURL", nil, targetUrl, host)
+	if err != nil {
+		return "", err
+	}
+	return value.ToString()
+}
+
+// Parses the first usable entry of a result like "PROXY proxy:8080; SOCKS5 socks:1080; DIRECT"
+func parsePacResult(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			if len(fields) > 1 {
+				return parseProxyAddress("http://" + fields[1])
+			}
+		case "HTTPS":
+			if len(fields) > 1 {
+				return parseProxyAddress("https://" + fields[1])
+			}
+		case "SOCKS", "SOCKS5":
+			if len(fields) > 1 {
+				return parseProxyAddress("socks5://" + fields[1])
+			}
+		}
+	}
+	return nil, fmt.Errorf("No usable proxy in the result of the proxy auto-config file: %s", result)
+}
+
+// The PAC helper functions implemented in Go
+var pacNativeFunctions = map[string]func(otto.FunctionCall) otto.Value{
+	"dnsResolve": func(call otto.FunctionCall) otto.Value {
+		if ip := resolveIPv4(call.Argument(0).String()); ip != nil {
+			return stringValue(ip.String())
+		}
+		return otto.NullValue()
+	},
+	"isResolvable": func(call otto.FunctionCall) otto.Value {
+		return boolValue(resolveIPv4(call.Argument(0).String()) != nil)
+	},
+	"myIpAddress": func(call otto.FunctionCall) otto.Value {
+		return stringValue(myIpAddress())
+	},
+	"shExpMatch": func(call otto.FunctionCall) otto.Value {
+		return boolValue(shExpMatch(call.Argument(0).String(), call.Argument(1).String()))
+	},
+	"_isInNet": func(call otto.FunctionCall) otto.Value {
+		ip := net.ParseIP(call.Argument(0).String())
+		pattern := net.ParseIP(call.Argument(1).String())
+		mask := net.ParseIP(call.Argument(2).String())
+		if ip == nil || pattern == nil || mask == nil {
+			return boolValue(false)
+		}
+		ipMask := net.IPMask(mask.To4())
+		return boolValue(ip.Mask(ipMask).Equal(pattern.Mask(ipMask)))
+	},
+}
+
+func stringValue(value string) otto.Value {
+	result, _ := otto.ToValue(value)
+	return result
+}
+
+func boolValue(value bool) otto.Value {
+	result, _ := otto.ToValue(value)
+	return result
+}
+
+func resolveIPv4(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
+
+// The address of the interface used for outgoing connections. No packet is sent.
+func myIpAddress() string {
+	conn, err := net.Dial("udp", "198.51.100.1:80")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// Matches shell expressions with * and ? wildcards
+func shExpMatch(text, expression string) bool {
+	pattern := regexp.QuoteMeta(expression)
+	pattern = strings.Replace(pattern, `\*`, ".*", -1)
+	pattern = strings.Replace(pattern, `\?`, ".", -1)
+	matched, err := regexp.MatchString("^"+pattern+"$", text)
+	return err == nil && matched
+}
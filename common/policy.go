@@ -0,0 +1,122 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palette-software/insight-server/lib"
+	"gopkg.in/yaml.v2"
+)
+
+// The local policy is kept next to Config.yml, but it is not part of the config, so it cannot be
+// changed remotely
+const PolicyFileName = "Policy.yml"
+
+// How far the agent may be updated from its current version
+const (
+	UpdatesAny   = "any"
+	UpdatesMinor = "minor" // within the current major version
+	UpdatesPatch = "patch" // within the current major and minor version
+	UpdatesNone  = "none"
+)
+
+// Restricts the remote commands and the updates the watchdog performs
+type Policy struct {
+	Commands CommandPolicy `yaml:"Commands"`
+	Updates  UpdatePolicy  `yaml:"Updates"`
+}
+
+// If Allow is given, only the listed commands are performed. Denied commands are never performed.
+type CommandPolicy struct {
+	Allow []string `yaml:"Allow"`
+	Deny  []string `yaml:"Deny"`
+}
+
+// Allow is one of any (the default), minor, patch or none
+type UpdatePolicy struct {
+	Allow string `yaml:"Allow"`
+}
+
+// An action denied by the local policy
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// Reads the policy from the Config folder. Without a policy file everything is allowed. If the
+// policy file cannot be read, everything is denied.
+func LoadPolicy(baseFolder string) (Policy, error) {
+	path := filepath.Join(baseFolder, "Config", PolicyFileName)
+	policyBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Policy{}, nil
+	}
+	if err == nil {
+		var policy Policy
+		if err = yaml.Unmarshal(policyBytes, &policy); err == nil {
+			err = policy.validate()
+		}
+		if err == nil {
+			return policy, nil
+		}
+	}
+	return denyAllPolicy, fmt.Errorf("Invalid policy file %s, so every command and update is denied! Error: %v",
+		path, err)
+}
+
+var denyAllPolicy = Policy{
+	Commands: CommandPolicy{Allow: []string{}, Deny: []string{"*"}},
+	Updates:  UpdatePolicy{Allow: UpdatesNone},
+}
+
+func (p Policy) validate() error {
+	switch strings.ToLower(p.Updates.Allow) {
+	case "", UpdatesAny, UpdatesMinor, UpdatesPatch, UpdatesNone:
+		return nil
+	}
+	return fmt.Errorf("Invalid Updates.Allow: %s", p.Updates.Allow)
+}
+
+func containsCommand(commands []string, command string) bool {
+	for _, listed := range commands {
+		if listed == "*" || strings.EqualFold(listed, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a *PolicyError if the remote command is not allowed
+func (p Policy) CheckCommand(command string) error {
+	if containsCommand(p.Commands.Deny, command) {
+		return &PolicyError{fmt.Sprintf("Command %s is denied by the local policy", command)}
+	}
+	if p.Commands.Allow != nil && !containsCommand(p.Commands.Allow, command) {
+		return &PolicyError{fmt.Sprintf("Command %s is not allowed by the local policy", command)}
+	}
+	return nil
+}
+
+// Returns a *PolicyError if updating from the current version to the new one is not allowed
+func (p Policy) CheckUpdate(current, update insight_server.Version) error {
+	allowed := true
+	switch strings.ToLower(p.Updates.Allow) {
+	case UpdatesNone:
+		allowed = false
+	case UpdatesMinor:
+		allowed = update.Major == current.Major
+	case UpdatesPatch:
+		allowed = update.Major == current.Major && update.Minor == current.Minor
+	}
+	if !allowed {
+		return &PolicyError{fmt.Sprintf("Update from %s to %s is denied by the local policy (updates allowed: %s)",
+			current, update, p.Updates.Allow)}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/palette-software/insight-server/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+type PolicyTestSuite struct {
+	suite.Suite
+	baseFolder string
+}
+
+func TestPolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(PolicyTestSuite))
+}
+
+func (suite *PolicyTestSuite) SetupTest() {
+	var err error
+	suite.baseFolder, err = ioutil.TempDir("", "policy")
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.MkdirAll(filepath.Join(suite.baseFolder, "Config"), 0755))
+}
+
+func (suite *PolicyTestSuite) TearDownTest() {
+	os.RemoveAll(suite.baseFolder)
+}
+
+func (suite *PolicyTestSuite) writePolicy(content string) {
+	path := filepath.Join(suite.baseFolder, "Config", PolicyFileName)
+	suite.Require().NoError(ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func (suite *PolicyTestSuite) TestLoadPolicy_missing() {
+	policy, err := LoadPolicy(suite.baseFolder)
+	suite.NoError(err)
+	suite.NoError(policy.CheckCommand("GET-CONFIG"))
+	suite.NoError(policy.CheckUpdate(insight_server.Version{1, 0, 0}, insight_server.Version{2, 0, 0}))
+}
+
+func (suite *PolicyTestSuite) TestLoadPolicy_invalid() {
+	suite.writePolicy("Updates:\n  Allow: sometimes\n")
+	policy, err := LoadPolicy(suite.baseFolder)
+	suite.Error(err)
+	suite.Error(policy.CheckCommand("start"))
+	suite.Error(policy.CheckUpdate(insight_server.Version{1, 0, 0}, insight_server.Version{1, 0, 1}))
+}
+
+func (suite *PolicyTestSuite) TestCheckCommand() {
+	suite.writePolicy("Commands:\n  Deny: [GET-CONFIG, stop]\n")
+	policy, err := LoadPolicy(suite.baseFolder)
+	suite.Require().NoError(err)
+	suite.Error(policy.CheckCommand("get-config"))
+	suite.Error(policy.CheckCommand("stop"))
+	suite.NoError(policy.CheckCommand("start"))
+
+	suite.writePolicy("Commands:\n  Allow: [start, SET-LOG-LEVEL]\n")
+	policy, err = LoadPolicy(suite.baseFolder)
+	suite.Require().NoError(err)
+	suite.NoError(policy.CheckCommand("SET-LOG-LEVEL"))
+	_, isPolicyErr := policy.CheckCommand("PUT-CONFIG").(*PolicyError)
+	suite.True(isPolicyErr)
+}
+
+func (suite *PolicyTestSuite) TestCheckUpdate() {
+	current := insight_server.Version{2, 3, 4}
+	policy := Policy{Updates: UpdatePolicy{Allow: UpdatesPatch}}
+	suite.NoError(policy.CheckUpdate(current, insight_server.Version{2, 3, 9}))
+	suite.Error(policy.CheckUpdate(current, insight_server.Version{2, 4, 0}))
+
+	policy.Updates.Allow = UpdatesMinor
+	suite.NoError(policy.CheckUpdate(current, insight_server.Version{2, 4, 0}))
+	suite.Error(policy.CheckUpdate(current, insight_server.Version{3, 0, 0}))
+
+	policy.Updates.Allow = UpdatesNone
+	suite.Error(policy.CheckUpdate(current, insight_server.Version{2, 3, 5}))
+}
@@ -0,0 +1,316 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Settings of the proxy, which are used if UseProxy is set. ProxyAddress is an http:// or a
+// socks5:// URL, and it may contain the credentials too.
+type ProxyConfig struct {
+	Username string `yaml:"Username"`
+	Password string `yaml:"Password"`
+	// basic (the default) or digest for HTTP proxies. SOCKS5 proxies use username/password authentication.
+	AuthScheme string `yaml:"AuthScheme"`
+	// Hosts which are reached directly: host names, *.domain or .domain suffixes, IP addresses,
+	// CIDR ranges, and <local> for host names without dots
+	Bypass []string `yaml:"Bypass"`
+	// URL or path of a proxy auto-config file, which decides instead of ProxyAddress. Relative
+	// paths are relative to the installation folder.
+	PacFile string `yaml:"PacFile"`
+}
+
+// Decides which proxy to use for a request
+type proxyResolver struct {
+	// Nil if only the PAC file decides
+	address  *url.URL
+	username string
+	password string
+	digest   bool
+	bypass   []bypassRule
+	pac      *pacFile
+}
+
+type bypassRule func(host string) bool
+
+// The PAC file is nil if Proxy.PacFile is not set
+func newProxyResolver(config Webservice, pac *pacFile) (*proxyResolver, error) {
+	proxyConfig := config.Proxy
+	resolver := &proxyResolver{
+		username: proxyConfig.Username,
+		password: proxyConfig.Password,
+		pac:      pac,
+	}
+	switch strings.ToLower(proxyConfig.AuthScheme) {
+	case "", "basic":
+	case "digest":
+		resolver.digest = true
+	default:
+		return nil, fmt.Errorf("Unknown proxy AuthScheme: %s", proxyConfig.AuthScheme)
+	}
+
+	if len(config.ProxyAddress) > 0 {
+		address, err := parseProxyAddress(config.ProxyAddress)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse proxy address: %s Error: %v", config.ProxyAddress, err)
+		}
+		if address.User != nil && len(resolver.username) == 0 {
+			resolver.username = address.User.Username()
+			resolver.password, _ = address.User.Password()
+		}
+		address.User = nil
+		resolver.address = address
+	}
+	if resolver.address == nil && resolver.pac == nil {
+		return nil, fmt.Errorf("Missing proxy address from config file, but UseProxy is set!")
+	}
+
+	for _, entry := range proxyConfig.Bypass {
+		rule, err := parseBypassRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		resolver.bypass = append(resolver.bypass, rule)
+	}
+	return resolver, nil
+}
+
+// Accepts host:port as well, which means an HTTP proxy
+func parseProxyAddress(address string) (*url.URL, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	proxyUrl, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme: %s", proxyUrl.Scheme)
+	}
+	if len(proxyUrl.Host) == 0 {
+		return nil, fmt.Errorf("Missing proxy host")
+	}
+	return proxyUrl, nil
+}
+
+func parseBypassRule(entry string) (bypassRule, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	switch {
+	case entry == "<local>":
+		return func(host string) bool { return !strings.Contains(host, ".") }, nil
+	case strings.Contains(entry, "/"):
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy bypass entry: %s Error: %v", entry, err)
+		}
+		return func(host string) bool {
+			ip := net.ParseIP(host)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	case strings.HasPrefix(entry, "*.") || strings.HasPrefix(entry, "."):
+		suffix := strings.TrimPrefix(entry, "*")
+		return func(host string) bool {
+			return strings.HasSuffix(host, suffix) || host == suffix[1:]
+		}, nil
+	}
+	return func(host string) bool { return host == entry }, nil
+}
+
+// Returns the proxy for the target URL, or nil if it is reached directly
+func (r *proxyResolver) proxyFor(ctx context.Context, target *url.URL) (*url.URL, error) {
+	host := strings.ToLower(target.Hostname())
+	for _, rule := range r.bypass {
+		if rule(host) {
+			return nil, nil
+		}
+	}
+
+	proxyUrl := r.address
+	if r.pac != nil {
+		pacProxy, err := r.pac.findProxy(ctx, target)
+		if err != nil {
+			Log(ctx).Error("Failed to evaluate the proxy auto-config file! Using ProxyAddress instead. Error: ", err)
+		} else {
+			proxyUrl = pacProxy
+		}
+	}
+	if proxyUrl == nil {
+		return nil, nil
+	}
+
+	// Digest authentication is done by the transport wrapper and the CONNECT headers
+	withUser := *proxyUrl
+	if len(r.username) > 0 && (!r.digest || withUser.Scheme == "socks5") {
+		withUser.User = url.UserPassword(r.username, r.password)
+	}
+	return &withUser, nil
+}
+
+// Implements http.Transport.Proxy
+func (r *proxyResolver) proxy(req *http.Request) (*url.URL, error) {
+	return r.proxyFor(req.Context(), req.URL)
+}
+
+// Sets up the transport to use the proxies of the resolver. The returned round tripper is the
+// transport itself, unless digest authentication needs to retry plain HTTP requests.
+func (r *proxyResolver) configure(transport *http.Transport) http.RoundTripper {
+	transport.Proxy = r.proxy
+	if !r.digest || len(r.username) == 0 {
+		return transport
+	}
+	transport.GetProxyConnectHeader = r.connectHeader
+	return &digestProxyTransport{Transport: transport, resolver: r}
+}
+
+// Requests the Digest challenge of the HTTP proxy with a CONNECT without credentials, then
+// answers it in the headers of the real CONNECT
+func (r *proxyResolver) connectHeader(ctx context.Context, proxyUrl *url.URL, target string) (http.Header, error) {
+	if proxyUrl.Scheme != "http" {
+		return nil, nil
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil, nil
+	}
+	authorization, err := r.digestAuthorization(resp.Header.Get("Proxy-Authenticate"), http.MethodConnect, target)
+	if err != nil {
+		return nil, err
+	}
+	return http.Header{"Proxy-Authorization": []string{authorization}}, nil
+}
+
+// Answers the Digest challenge of the proxy for plain HTTP requests
+type digestProxyTransport struct {
+	*http.Transport
+	resolver *proxyResolver
+}
+
+func (t *digestProxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired || req.URL.Scheme != "http" {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// The body cannot be sent again
+		return resp, nil
+	}
+	authorization, err := t.resolver.digestAuthorization(resp.Header.Get("Proxy-Authenticate"), req.Method, req.URL.String())
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.WithContext(req.Context())
+	retry.Header = make(http.Header)
+	for key, values := range req.Header {
+		retry.Header[key] = values
+	}
+	retry.Header.Set("Proxy-Authorization", authorization)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.Transport.RoundTrip(retry)
+}
+
+// Computes the Digest (RFC 2617) Proxy-Authorization for the challenge
+func (r *proxyResolver) digestAuthorization(challenge, method, uri string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "digest ") {
+		return "", fmt.Errorf("The proxy does not ask for Digest authentication: %s", challenge)
+	}
+	params := parseAuthParams(challenge[len("digest "):])
+	realm, nonce := params["realm"], params["nonce"]
+	if algorithm := params["algorithm"]; len(algorithm) > 0 && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("Unsupported Digest algorithm: %s", algorithm)
+	}
+
+	ha1 := md5Hex(r.username + ":" + realm + ":" + r.password)
+	ha2 := md5Hex(method + ":" + uri)
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, r.username, realm, nonce, uri)
+	if qopAuth(params["qop"]) {
+		cnonceBytes := make([]byte, 8)
+		if _, err := rand.Read(cnonceBytes); err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(cnonceBytes)
+		response := md5Hex(ha1 + ":" + nonce + ":00000001:" + cnonce + ":auth:" + ha2)
+		authorization += fmt.Sprintf(`, qop=auth, nc=00000001, cnonce="%s", response="%s"`, cnonce, response)
+	} else {
+		authorization += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+	if opaque, ok := params["opaque"]; ok {
+		authorization += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return authorization, nil
+}
+
+func qopAuth(qop string) bool {
+	for _, option := range strings.Split(qop, ",") {
+		if strings.TrimSpace(option) == "auth" {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses the comma separated key=value or key="value" parameters of a challenge
+func parseAuthParams(params string) map[string]string {
+	result := make(map[string]string)
+	for len(params) > 0 {
+		params = strings.TrimLeft(params, " ,")
+		equals := strings.Index(params, "=")
+		if equals < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(params[:equals]))
+		params = params[equals+1:]
+		var value string
+		if strings.HasPrefix(params, `"`) {
+			end := strings.Index(params[1:], `"`)
+			if end < 0 {
+				value = params[1:]
+				params = ""
+			} else {
+				value = params[1 : end+1]
+				params = params[end+2:]
+			}
+		} else {
+			end := strings.Index(params, ",")
+			if end < 0 {
+				end = len(params)
+			}
+			value = strings.TrimSpace(params[:end])
+			params = params[end:]
+		}
+		result[key] = value
+	}
+	return result
+}
+
+func md5Hex(text string) string {
+	sum := md5.Sum([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
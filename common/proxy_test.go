@@ -0,0 +1,401 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxyTestSuite struct {
+	suite.Suite
+	folder string
+	target *httptest.Server
+}
+
+func TestProxyTestSuite(t *testing.T) {
+	suite.Run(t, new(ProxyTestSuite))
+}
+
+func (suite *ProxyTestSuite) SetupTest() {
+	var err error
+	suite.folder, err = ioutil.TempDir("", "proxy")
+	suite.Require().NoError(err)
+	suite.target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pong")
+	}))
+}
+
+func (suite *ProxyTestSuite) TearDownTest() {
+	suite.target.Close()
+	os.RemoveAll(suite.folder)
+}
+
+// A forward HTTP proxy which requires the given Proxy-Authorization, if it is not empty
+type testProxy struct {
+	*httptest.Server
+	check func(r *http.Request) bool
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func newTestProxy(check func(r *http.Request) bool) *testProxy {
+	proxy := &testProxy{check: check}
+	proxy.Server = httptest.NewServer(proxy)
+	return proxy
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.check != nil && !p.check(r) {
+		w.Header().Set("Proxy-Authenticate", `Digest realm="insight", nonce="abc123", qop="auth", opaque="xyz"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.mutex.Lock()
+	p.requests = append(p.requests, r.Method+" "+r.Host)
+	p.mutex.Unlock()
+
+	if r.Method == http.MethodConnect {
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, buffered, _ := w.(http.Hijacker).Hijack()
+		go pipe(conn, buffered, target)
+		return
+	}
+
+	outgoing, _ := http.NewRequest(r.Method, r.URL.String(), r.Body)
+	resp, err := (&http.Transport{}).RoundTrip(outgoing)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *testProxy) received() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+func pipe(conn net.Conn, reader io.Reader, target net.Conn) {
+	defer conn.Close()
+	defer target.Close()
+	go io.Copy(target, reader)
+	io.Copy(conn, target)
+}
+
+func basicProxyAuth(username, password string) func(r *http.Request) bool {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	return func(r *http.Request) bool {
+		return r.Header.Get("Proxy-Authorization") == expected
+	}
+}
+
+// Checks the Digest response for the nonce and the realm of the test proxy
+func digestProxyAuth(username, password string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		authorization := r.Header.Get("Proxy-Authorization")
+		if !strings.HasPrefix(authorization, "Digest ") {
+			return false
+		}
+		params := parseAuthParams(authorization[len("Digest "):])
+		ha1 := md5Hex(username + ":insight:" + password)
+		ha2 := md5Hex(r.Method + ":" + params["uri"])
+		expected := md5Hex(ha1 + ":abc123:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		return params["username"] == username && params["opaque"] == "xyz" && params["response"] == expected
+	}
+}
+
+func (suite *ProxyTestSuite) get(proxyConfig ProxyConfig, proxyAddress string, endpoint string) error {
+	config := Config{baseFolder: suite.folder}
+	config.Webservice.Endpoint = endpoint
+	config.Webservice.UseProxy = true
+	config.Webservice.ProxyAddress = proxyAddress
+	config.Webservice.Proxy = proxyConfig
+	config.Webservice.Retry.MaxAttempts = 1
+
+	client, err := NewApiClientWithConfig(config)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(context.Background(), "/ping")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (suite *ProxyTestSuite) TestBasicAuth() {
+	proxy := newTestProxy(basicProxyAuth("user", "p@ss"))
+	defer proxy.Close()
+
+	suite.NoError(suite.get(ProxyConfig{Username: "user", Password: "p@ss"}, proxy.URL, suite.target.URL))
+	suite.Equal([]string{"GET " + suite.target.Listener.Addr().String()}, proxy.received())
+
+	suite.Error(suite.get(ProxyConfig{Username: "user", Password: "wrong"}, proxy.URL, suite.target.URL))
+}
+
+func (suite *ProxyTestSuite) TestBasicAuth_credentialsInAddress() {
+	proxy := newTestProxy(basicProxyAuth("user", "secret"))
+	defer proxy.Close()
+
+	proxyUrl, _ := url.Parse(proxy.URL)
+	proxyUrl.User = url.UserPassword("user", "secret")
+	suite.NoError(suite.get(ProxyConfig{}, proxyUrl.String(), suite.target.URL))
+}
+
+func (suite *ProxyTestSuite) TestBasicAuth_connect() {
+	proxy := newTestProxy(basicProxyAuth("user", "secret"))
+	defer proxy.Close()
+	tlsTarget := httptest.NewTLSServer(suite.target.Config.Handler)
+	defer tlsTarget.Close()
+
+	suite.NoError(suite.get(ProxyConfig{Username: "user", Password: "secret"}, proxy.URL, tlsTarget.URL))
+	suite.Equal([]string{"CONNECT " + tlsTarget.Listener.Addr().String()}, proxy.received())
+}
+
+func (suite *ProxyTestSuite) TestDigestAuth() {
+	proxy := newTestProxy(digestProxyAuth("user", "secret"))
+	defer proxy.Close()
+	tlsTarget := httptest.NewTLSServer(suite.target.Config.Handler)
+	defer tlsTarget.Close()
+
+	proxyConfig := ProxyConfig{Username: "user", Password: "secret", AuthScheme: "digest"}
+	suite.NoError(suite.get(proxyConfig, proxy.URL, suite.target.URL))
+	suite.NoError(suite.get(proxyConfig, proxy.URL, tlsTarget.URL))
+	suite.Len(proxy.received(), 2)
+
+	proxyConfig.Password = "wrong"
+	suite.Error(suite.get(proxyConfig, proxy.URL, suite.target.URL))
+}
+
+func (suite *ProxyTestSuite) TestBypass() {
+	proxy := newTestProxy(nil)
+	defer proxy.Close()
+
+	suite.NoError(suite.get(ProxyConfig{Bypass: []string{"127.0.0.0/8"}}, proxy.URL, suite.target.URL))
+	suite.Empty(proxy.received())
+}
+
+func (suite *ProxyTestSuite) TestParseBypassRule() {
+	cases := []struct {
+		rule    string
+		host    string
+		matches bool
+	}{
+		{"<local>", "insight", true},
+		{"<local>", "insight.example.com", false},
+		{"*.example.com", "insight.example.com", true},
+		{"*.example.com", "example.com", true},
+		{".example.com", "insight.example.com", true},
+		{"*.example.com", "badexample.com", false},
+		{"Insight.Example.com", "insight.example.com", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.1.2.3", false},
+	}
+	for _, c := range cases {
+		rule, err := parseBypassRule(c.rule)
+		suite.Require().NoError(err)
+		suite.Equal(c.matches, rule(c.host), "%s %s", c.rule, c.host)
+	}
+
+	_, err := parseBypassRule("10.0.0.0/99")
+	suite.Error(err)
+}
+
+func (suite *ProxyTestSuite) TestSocks5() {
+	socks := newTestSocks5Server(suite.T(), "user", "secret")
+	defer socks.Close()
+
+	suite.NoError(suite.get(ProxyConfig{Username: "user", Password: "secret"}, "socks5://"+socks.Addr().String(), suite.target.URL))
+	suite.Equal([]string{suite.target.Listener.Addr().String()}, socks.received())
+
+	suite.Error(suite.get(ProxyConfig{Username: "user", Password: "wrong"}, "socks5://"+socks.Addr().String(), suite.target.URL))
+}
+
+func (suite *ProxyTestSuite) TestPacFile() {
+	proxy := newTestProxy(nil)
+	defer proxy.Close()
+
+	proxyHost := proxy.Listener.Addr().String()
+	script := fmt.Sprintf(`function FindProxyForURL(url, host) {
+		if (isPlainHostName(host) || dnsDomainIs(host, ".internal")) return "DIRECT";
+		if (shExpMatch(url, "*/api/*") && isInNet(host, "127.0.0.0", "255.0.0.0")) return "PROXY %s; DIRECT";
+		return "DIRECT";
+	}`, proxyHost)
+	suite.Require().NoError(ioutil.WriteFile(filepath.Join(suite.folder, "proxy.pac"), []byte(script), 0600))
+
+	suite.NoError(suite.get(ProxyConfig{PacFile: "proxy.pac"}, "", suite.target.URL))
+	suite.Equal([]string{"GET " + suite.target.Listener.Addr().String()}, proxy.received())
+
+	resolver, err := newProxyResolver(Webservice{Proxy: ProxyConfig{PacFile: "proxy.pac"}}, newPacFile("proxy.pac", suite.folder))
+	suite.Require().NoError(err)
+	direct, _ := url.Parse("https://insight.internal/api/v1/ping")
+	proxyUrl, err := resolver.proxyFor(context.Background(), direct)
+	suite.NoError(err)
+	suite.Nil(proxyUrl)
+}
+
+func (suite *ProxyTestSuite) TestPacFile_fromUrl() {
+	proxy := newTestProxy(nil)
+	defer proxy.Close()
+	script := fmt.Sprintf(`function FindProxyForURL(url, host) { return "PROXY %s"; }`, proxy.Listener.Addr().String())
+	pacServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, script)
+	}))
+	defer pacServer.Close()
+
+	suite.NoError(suite.get(ProxyConfig{PacFile: pacServer.URL + "/proxy.pac"}, "", suite.target.URL))
+	suite.Len(proxy.received(), 1)
+}
+
+func (suite *ProxyTestSuite) TestParsePacResult() {
+	proxyUrl, err := parsePacResult("PROXY proxy:8080; DIRECT")
+	suite.NoError(err)
+	suite.Equal("http://proxy:8080", proxyUrl.String())
+
+	proxyUrl, err = parsePacResult("SOCKS5 socks:1080")
+	suite.NoError(err)
+	suite.Equal("socks5://socks:1080", proxyUrl.String())
+
+	proxyUrl, err = parsePacResult(" DIRECT ")
+	suite.NoError(err)
+	suite.Nil(proxyUrl)
+
+	_, err = parsePacResult("")
+	suite.Error(err)
+}
+
+func (suite *ProxyTestSuite) TestMissingProxy() {
+	suite.Error(suite.get(ProxyConfig{}, "", suite.target.URL))
+	suite.Error(suite.get(ProxyConfig{AuthScheme: "ntlm"}, "proxy:8080", suite.target.URL))
+	suite.Error(suite.get(ProxyConfig{}, "ftp://proxy:21", suite.target.URL))
+}
+
+// A SOCKS5 server which supports only username/password authentication and CONNECT
+type testSocks5Server struct {
+	net.Listener
+	username, password string
+
+	mutex   sync.Mutex
+	targets []string
+}
+
+func newTestSocks5Server(t *testing.T, username, password string) *testSocks5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSocks5Server{Listener: listener, username: username, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *testSocks5Server) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func (s *testSocks5Server) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	readBytes := func(n int) []byte {
+		buffer := make([]byte, n)
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			return nil
+		}
+		return buffer
+	}
+
+	// Greeting: version, methods
+	header := readBytes(2)
+	if header == nil || readBytes(int(header[1])) == nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// Username/password authentication
+	header = readBytes(2)
+	if header == nil {
+		conn.Close()
+		return
+	}
+	username := string(readBytes(int(header[1])))
+	passwordLength := readBytes(1)
+	if passwordLength == nil {
+		conn.Close()
+		return
+	}
+	password := string(readBytes(int(passwordLength[0])))
+	if username != s.username || password != s.password {
+		conn.Write([]byte{1, 1})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// CONNECT request: version, command, reserved, address type, address, port
+	request := readBytes(4)
+	if request == nil {
+		conn.Close()
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(readBytes(4)).String()
+	case 3:
+		length := readBytes(1)
+		host = string(readBytes(int(length[0])))
+	default:
+		conn.Close()
+		return
+	}
+	port := binary.BigEndian.Uint16(readBytes(2))
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	s.mutex.Lock()
+	s.targets = append(s.targets, address)
+	s.mutex.Unlock()
+
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, reader, target)
+}
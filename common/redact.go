@@ -0,0 +1,96 @@
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redactedValue = "<redacted>"
+
+// Secrets which may show up in log lines, request dumps and config files
+var (
+	// Keeps the header name
+	secretHeadersPattern = regexp.MustCompile(
+		`(?im)^([ \t]*(Authorization|Proxy-Authorization|Cookie|Set-Cookie|X-Api-Key)[ \t]*:[ \t]*)[^\r\n]*`)
+	// YAML (e.g. Config.yml) keys, keeping the key
+	secretYamlFieldsPattern = regexp.MustCompile(
+		`(?im)^([ \t]*-?[ \t]*(LicenseKey|Token|[a-zA-Z0-9]*Password)[ \t]*:[ \t]*)[^\r\n]*`)
+	// JSON fields, keeping the key
+	secretJsonFieldsPattern = regexp.MustCompile(`(?i)("(licenseKey|token|[a-z0-9]*password)"[ \t]*:[ \t]*)"[^"]*"`)
+	// Credentials in URLs, e.g. proxy addresses
+	urlCredentialsPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:)[^/\s@]+@`)
+)
+
+// The values which have to be redacted on top of the built-in patterns
+var redaction = struct {
+	sync.RWMutex
+	secrets  []string
+	patterns []*regexp.Regexp
+}{}
+
+// Sets the secrets of the config to be redacted everywhere: the license key and the custom
+// patterns of the logging config. Invalid patterns are skipped and reported.
+func SetRedaction(config Config) error {
+	var secrets []string
+	if len(config.LicenseKey) > 0 {
+		secrets = append(secrets, config.LicenseKey)
+	}
+	var patterns []*regexp.Regexp
+	var invalidPatterns []string
+	for _, pattern := range config.Watchdog.Logging.RedactPatterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			invalidPatterns = append(invalidPatterns, pattern)
+			continue
+		}
+		patterns = append(patterns, compiled)
+	}
+
+	redaction.Lock()
+	redaction.secrets = secrets
+	redaction.patterns = patterns
+	redaction.Unlock()
+
+	if len(invalidPatterns) > 0 {
+		return fmt.Errorf("Invalid redaction patterns in config: %v", invalidPatterns)
+	}
+	return nil
+}
+
+// Adds a secret which is only known at runtime to be redacted everywhere
+func AddRedactedSecret(secret string) {
+	if len(secret) == 0 {
+		return
+	}
+	redaction.Lock()
+	defer redaction.Unlock()
+	redaction.secrets = append(redaction.secrets, secret)
+}
+
+// Replaces the secrets in the text
+func Redact(text string) string {
+	text = secretHeadersPattern.ReplaceAllString(text, "${1}"+redactedValue)
+	text = secretYamlFieldsPattern.ReplaceAllString(text, "${1}"+redactedValue)
+	text = secretJsonFieldsPattern.ReplaceAllString(text, `${1}"`+redactedValue+`"`)
+	text = urlCredentialsPattern.ReplaceAllString(text, "${1}"+redactedValue+"@")
+
+	redaction.RLock()
+	defer redaction.RUnlock()
+	for _, secret := range redaction.secrets {
+		text = strings.Replace(text, secret, redactedValue, -1)
+	}
+	for _, pattern := range redaction.patterns {
+		text = pattern.ReplaceAllString(text, redactedValue)
+	}
+	return text
+}
+
+// Cuts the text at the given length, noting how much has been left out
+func Truncate(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+	return text[:maxLength] + "... (truncated)"
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default retry policy of the Insight API client
+const (
+	defaultRetryMaxAttempts = 4
+	defaultRetryBaseDelay   = 2 * time.Second
+	defaultRetryMaxDelay    = 30 * time.Second
+)
+
+// The header which lets the server recognize the retries of the same upload
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Controls how failed Insight API requests are retried. Delays are chosen randomly between
+// zero and BaseDelay * 2^(attempt-1) (capped at MaxDelay), so that a fleet of watchdogs
+// does not retry in lockstep after a server outage.
+type RetryPolicy struct {
+	// Number of attempts including the first one. 1 disables retries.
+	MaxAttempts int           `yaml:"MaxAttempts"`
+	BaseDelay   time.Duration `yaml:"BaseDelay"`
+	MaxDelay    time.Duration `yaml:"MaxDelay"`
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRetryBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRetryMaxDelay
+	}
+	return p
+}
+
+// Returns the delay before the next attempt after the given (1-based) attempt failed
+func (p RetryPolicy) backoff(attempt int, random func(int64) int64) time.Duration {
+	ceiling := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if ceiling > float64(p.MaxDelay) {
+		ceiling = float64(p.MaxDelay)
+	}
+	if ceiling < 1 {
+		return 0
+	}
+	return time.Duration(random(int64(ceiling) + 1))
+}
+
+// Thread-safe random source for the jitter
+type lockedRandom struct {
+	mutex  sync.Mutex
+	source *mathrand.Rand
+}
+
+func newLockedRandom() *lockedRandom {
+	return &lockedRandom{source: mathrand.New(mathrand.NewSource(time.Now().UnixNano()))}
+}
+
+func (r *lockedRandom) Int63n(n int64) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.source.Int63n(n)
+}
+
+// Only requests which can safely be sent again are retried
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return len(req.Header.Get(idempotencyKeyHeader)) > 0
+}
+
+// Network errors, throttling and temporary server-side failures are worth retrying
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	if !isIdempotent(req) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Parses the Retry-After header, which is either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := date.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
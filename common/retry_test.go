@@ -0,0 +1,183 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+	server    *httptest.Server
+	apiClient *ApiClient
+	handler   func(w http.ResponseWriter, r *http.Request)
+	requests  []*http.Request
+	sleeps    []time.Duration
+}
+
+func (suite *RetryTestSuite) SetupTest() {
+	suite.requests = nil
+	suite.sleeps = nil
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.requests = append(suite.requests, r)
+		suite.handler(w, r)
+	}))
+
+	var config Config
+	config.Webservice.Endpoint = suite.server.URL
+	config.Webservice.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	suite.apiClient, _ = NewApiClientWithConfig(config)
+	// Always choose the longest possible delay
+	suite.apiClient.random = func(n int64) int64 { return n - 1 }
+	suite.apiClient.sleep = func(ctx context.Context, d time.Duration) error {
+		suite.sleeps = append(suite.sleeps, d)
+		return nil
+	}
+}
+
+func (suite *RetryTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
+
+// Responds with the given status codes in order, then with 200 OK
+func (suite *RetryTestSuite) respondWith(statusCodes ...int) {
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		if len(statusCodes) == 0 {
+			w.Write([]byte("ok"))
+			return
+		}
+		statusCode := statusCodes[0]
+		statusCodes = statusCodes[1:]
+		w.WriteHeader(statusCode)
+	}
+}
+
+func (suite *RetryTestSuite) TestBackoff() {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	longest := func(n int64) int64 { return n - 1 }
+	suite.Equal(time.Second, policy.backoff(1, longest))
+	suite.Equal(2*time.Second, policy.backoff(2, longest))
+	suite.Equal(4*time.Second, policy.backoff(3, longest))
+	suite.Equal(5*time.Second, policy.backoff(4, longest))
+	suite.Equal(time.Duration(0), policy.backoff(4, func(n int64) int64 { return 0 }))
+}
+
+func (suite *RetryTestSuite) TestParseRetryAfter() {
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := parseRetryAfter("120", now)
+	suite.True(ok)
+	suite.Equal(2*time.Minute, delay)
+
+	delay, ok = parseRetryAfter("Sat, 01 Oct 2016 12:00:30 GMT", now)
+	suite.True(ok)
+	suite.Equal(30*time.Second, delay)
+
+	_, ok = parseRetryAfter("", now)
+	suite.False(ok)
+	_, ok = parseRetryAfter("soon", now)
+	suite.False(ok)
+}
+
+func (suite *RetryTestSuite) TestGet_retriesTemporaryFailures() {
+	suite.respondWith(http.StatusServiceUnavailable, http.StatusBadGateway)
+
+	resp, err := suite.apiClient.Get(context.Background(), "/agent/version")
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	suite.Len(suite.requests, 3)
+	suite.Equal([]time.Duration{time.Second, 2 * time.Second}, suite.sleeps)
+}
+
+func (suite *RetryTestSuite) TestGet_givesUpAfterMaxAttempts() {
+	suite.respondWith(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	_, err := suite.apiClient.Get(context.Background(), "/agent/version")
+	suite.Error(err)
+	suite.Len(suite.requests, 3)
+}
+
+func (suite *RetryTestSuite) TestGet_doesNotRetryClientErrors() {
+	suite.respondWith(http.StatusNotFound)
+
+	_, err := suite.apiClient.Get(context.Background(), "/agent/version")
+	suite.True(IsNotFound(err))
+	suite.Len(suite.requests, 1)
+}
+
+func (suite *RetryTestSuite) TestGet_respectsRetryAfter() {
+	first := true
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		if first {
+			first = false
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+
+	resp, err := suite.apiClient.Get(context.Background(), "/agent/version")
+	suite.Require().NoError(err)
+	resp.Body.Close()
+	suite.Equal([]time.Duration{7 * time.Second}, suite.sleeps)
+}
+
+func (suite *RetryTestSuite) TestGet_givesUpOnLongRetryAfter() {
+	suite.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_, err := suite.apiClient.Get(context.Background(), "/agent/version")
+	suite.Error(err)
+	suite.Len(suite.requests, 1)
+	suite.Empty(suite.sleeps)
+}
+
+func (suite *RetryTestSuite) TestUploadFile_sameIdempotencyKeyForRetries() {
+	file, err := ioutil.TempFile("", "upload")
+	suite.Require().NoError(err)
+	file.WriteString("LicenseKey: abc")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	suite.respondWith(http.StatusServiceUnavailable)
+
+	suite.NoError(suite.apiClient.UploadFile(context.Background(), "/config", file.Name()))
+	suite.Require().Len(suite.requests, 2)
+	key := suite.requests[0].Header.Get(idempotencyKeyHeader)
+	suite.NotEmpty(key)
+	suite.Equal(key, suite.requests[1].Header.Get(idempotencyKeyHeader))
+}
+
+func (suite *RetryTestSuite) TestIsRetryable_postWithoutIdempotencyKey() {
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/", nil)
+	suite.False(isRetryable(req, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+
+	req.Header.Set(idempotencyKeyHeader, "key")
+	suite.True(isRetryable(req, &http.Response{StatusCode: http.StatusServiceUnavailable}, nil))
+}
+
+func (suite *RetryTestSuite) TestGet_stopsRetryingWhenCancelled() {
+	suite.respondWith(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	ctx, cancel := context.WithCancel(context.Background())
+	suite.apiClient.sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return sleepContext(ctx, d)
+	}
+
+	_, err := suite.apiClient.Get(ctx, "/agent/version")
+	suite.Error(err)
+	suite.Len(suite.requests, 1)
+}
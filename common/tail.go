@@ -0,0 +1,52 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+const tailBlockSize = 64 * 1024
+
+// Returns the last lineCount lines of the file without reading the whole of it
+func TailFile(path string, lineCount int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read blocks backwards until there are enough line breaks
+	var content []byte
+	offset := info.Size()
+	for offset > 0 && bytes.Count(content, []byte("\n")) <= lineCount {
+		blockSize := int64(tailBlockSize)
+		if offset < blockSize {
+			blockSize = offset
+		}
+		offset -= blockSize
+		block := make([]byte, blockSize)
+		if _, err := file.ReadAt(block, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		content = append(block, content...)
+	}
+
+	if len(content) == 0 {
+		return []string{}, nil
+	}
+	lines := bytes.Split(bytes.TrimRight(content, "\r\n"), []byte("\n"))
+	if len(lines) > lineCount {
+		lines = lines[len(lines)-lineCount:]
+	}
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		result[i] = string(bytes.TrimRight(line, "\r"))
+	}
+	return result, nil
+}
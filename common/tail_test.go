@@ -0,0 +1,62 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TailTestSuite struct {
+	suite.Suite
+	path string
+}
+
+func (suite *TailTestSuite) SetupTest() {
+	file, err := ioutil.TempFile("", "tail")
+	suite.Require().NoError(err)
+	defer file.Close()
+	// Make it span multiple blocks
+	for i := 1; i <= 20000; i++ {
+		fmt.Fprintf(file, "line %d\r\n", i)
+	}
+	suite.path = file.Name()
+}
+
+func (suite *TailTestSuite) TearDownTest() {
+	os.Remove(suite.path)
+}
+
+func TestTailTestSuite(t *testing.T) {
+	suite.Run(t, new(TailTestSuite))
+}
+
+func (suite *TailTestSuite) TestTailFile() {
+	lines, err := TailFile(suite.path, 3)
+	suite.NoError(err)
+	suite.Equal([]string{"line 19998", "line 19999", "line 20000"}, lines)
+}
+
+func (suite *TailTestSuite) TestTailFile_acrossBlocks() {
+	lines, err := TailFile(suite.path, 15000)
+	suite.NoError(err)
+	suite.Len(lines, 15000)
+	suite.Equal("line 5001", lines[0])
+}
+
+func (suite *TailTestSuite) TestTailFile_moreThanAvailable() {
+	ioutil.WriteFile(suite.path, []byte(strings.Join([]string{"a", "b"}, "\n")), 0644)
+	lines, err := TailFile(suite.path, 10)
+	suite.NoError(err)
+	suite.Equal([]string{"a", "b"}, lines)
+}
+
+func (suite *TailTestSuite) TestTailFile_empty() {
+	ioutil.WriteFile(suite.path, nil, 0644)
+	lines, err := TailFile(suite.path, 10)
+	suite.NoError(err)
+	suite.Empty(lines)
+}
@@ -0,0 +1,173 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	insight "github.com/palette-software/insight-server/lib"
+)
+
+// The update manifest lists every artifact available for update. It supersedes the
+// single file response of the /agent/version endpoint.
+type UpdateManifest struct {
+	Artifacts []UpdateArtifact `json:"artifacts"`
+}
+
+type UpdateArtifact struct {
+	Product string `json:"product"`
+	// Empty OS or Arch means that the artifact is suitable for every platform
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+	Version string `json:"version"`
+	Url     string `json:"url"`
+	Sha256  string `json:"sha256,omitempty"`
+	// Only set for artifacts converted from the legacy /agent/version response
+	Md5  string `json:"md5,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	// The currently installed version needs to be at least this one to be able to update
+	MinimumVersion  string `json:"minimumVersion,omitempty"`
+	ReleaseNotesUrl string `json:"releaseNotesUrl,omitempty"`
+	// True if it is not given in the manifest, because every legacy update used to be installed
+	Mandatory bool `json:"mandatory"`
+}
+
+func (a *UpdateArtifact) UnmarshalJSON(data []byte) error {
+	// Without the methods of UpdateArtifact, so that it is decoded as usual
+	type plainArtifact UpdateArtifact
+	artifact := plainArtifact{Mandatory: true}
+	if err := json.Unmarshal(data, &artifact); err != nil {
+		return err
+	}
+	*a = UpdateArtifact(artifact)
+	return nil
+}
+
+// Returned when a downloaded file does not match the artifact it was downloaded for
+type VerificationError struct {
+	Algorithm string
+	message   string
+}
+
+func (e *VerificationError) Error() string {
+	return e.message
+}
+
+// Parses versions like "v1.2.3" or "1.2.3". Windows file versions may have a fourth
+// number, which is ignored.
+func ParseVersion(versionStr string) (insight.Version, error) {
+	var version insight.Version
+	numbers := strings.Split(strings.TrimPrefix(strings.TrimSpace(versionStr), "v"), ".")
+	if len(numbers) < 3 {
+		return version, fmt.Errorf("Invalid version: '%s'! Expected format is major.minor.patch", versionStr)
+	}
+
+	var err error
+	if version.Major, err = strconv.Atoi(numbers[0]); err != nil {
+		return version, fmt.Errorf("Invalid major version in '%s'! Error: %v", versionStr, err)
+	}
+	if version.Minor, err = strconv.Atoi(numbers[1]); err != nil {
+		return version, fmt.Errorf("Invalid minor version in '%s'! Error: %v", versionStr, err)
+	}
+	if version.Patch, err = strconv.Atoi(numbers[2]); err != nil {
+		return version, fmt.Errorf("Invalid patch version in '%s'! Error: %v", versionStr, err)
+	}
+	return version, nil
+}
+
+// Converts the response of the legacy /agent/version endpoint
+func LegacyUpdateArtifact(product string, update insight.UpdateVersion) UpdateArtifact {
+	return UpdateArtifact{
+		Product: product,
+		Version: fmt.Sprintf("%d.%d.%d", update.Major, update.Minor, update.Patch),
+		Url:     update.Url,
+		Md5:     update.Md5,
+		// Every legacy update used to be installed unconditionally
+		Mandatory: true,
+	}
+}
+
+// Returns the newest artifact of the product which is suitable for the given platform
+func (m *UpdateManifest) FindArtifact(product, goos, arch string) (UpdateArtifact, error) {
+	var found *UpdateArtifact
+	var foundVersion insight.Version
+	for i := range m.Artifacts {
+		artifact := &m.Artifacts[i]
+		if artifact.Product != product ||
+			(len(artifact.OS) > 0 && artifact.OS != goos) ||
+			(len(artifact.Arch) > 0 && artifact.Arch != arch) {
+			continue
+		}
+		version, err := ParseVersion(artifact.Version)
+		if err != nil {
+			// Skip the malformed entry, there might be usable ones
+			continue
+		}
+		if found == nil || insight.IsNewerVersion(version, foundVersion) {
+			found = artifact
+			foundVersion = version
+		}
+	}
+
+	if found == nil {
+		return UpdateArtifact{}, fmt.Errorf("No %s artifact found in update manifest for %s/%s!", product, goos, arch)
+	}
+	return *found, nil
+}
+
+// Checks the size and hash of a downloaded artifact. SHA-256 is preferred over MD5, if both are present.
+func VerifyArtifactFile(path string, artifact UpdateArtifact) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(sha256Hash, md5Hash), file)
+	if err != nil {
+		return err
+	}
+
+	if artifact.Size > 0 && size != artifact.Size {
+		return &VerificationError{
+			Algorithm: "size",
+			message: fmt.Sprintf("Size mismatch for file: %s! Expected size is %d, but it is %d bytes.",
+				path, artifact.Size, size),
+		}
+	}
+
+	switch {
+	case len(artifact.Sha256) > 0:
+		calculated := hex.EncodeToString(sha256Hash.Sum(nil))
+		if !strings.EqualFold(calculated, artifact.Sha256) {
+			return &VerificationError{
+				Algorithm: "sha256",
+				message: fmt.Sprintf("SHA-256 hash mismatch for file: %s! Expected hash is %s, but calculated is %s.",
+					path, artifact.Sha256, calculated),
+			}
+		}
+	case len(artifact.Md5) > 0:
+		calculated := fmt.Sprintf("%32x", md5Hash.Sum(nil))
+		if calculated != artifact.Md5 {
+			return &VerificationError{
+				Algorithm: "md5",
+				message: fmt.Sprintf("MD5 hash mismatch for file: %s! Expected hash is %s, but calculated is %s.",
+					path, artifact.Md5, calculated),
+			}
+		}
+	default:
+		return &VerificationError{
+			Algorithm: "none",
+			message:   fmt.Sprintf("Neither SHA-256 nor MD5 hash is available for file: %s!", path),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	insight "github.com/palette-software/insight-server/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+type UpdateManifestTestSuite struct {
+	suite.Suite
+	manifest UpdateManifest
+	file     string
+}
+
+func (suite *UpdateManifestTestSuite) SetupTest() {
+	suite.manifest = UpdateManifest{
+		Artifacts: []UpdateArtifact{
+			{Product: "agent", OS: "windows", Arch: "amd64", Version: "2.1.5", Url: "/agent-2.1.5.msi"},
+			{Product: "agent", OS: "windows", Arch: "amd64", Version: "2.2.0", Url: "/agent-2.2.0.msi"},
+			{Product: "agent", OS: "linux", Arch: "amd64", Version: "3.0.0", Url: "/agent-3.0.0.rpm"},
+			{Product: "agent", Version: "broken", Url: "/broken"},
+			{Product: "watchdog", Version: "9.0.0", Url: "/watchdog-9.0.0.zip"},
+		},
+	}
+
+	file, err := ioutil.TempFile("", "artifact")
+	suite.Require().NoError(err)
+	defer file.Close()
+	_, err = file.WriteString("palette")
+	suite.Require().NoError(err)
+	suite.file = file.Name()
+}
+
+func (suite *UpdateManifestTestSuite) TearDownTest() {
+	os.Remove(suite.file)
+}
+
+func TestUpdateManifestTestSuite(t *testing.T) {
+	suite.Run(t, new(UpdateManifestTestSuite))
+}
+
+func (suite *UpdateManifestTestSuite) TestParseVersion() {
+	version, err := ParseVersion("v2.1.33")
+	suite.NoError(err)
+	suite.Equal(insight.Version{Major: 2, Minor: 1, Patch: 33}, version)
+
+	version, err = ParseVersion("2.1.33.0")
+	suite.NoError(err)
+	suite.Equal(insight.Version{Major: 2, Minor: 1, Patch: 33}, version)
+
+	_, err = ParseVersion("2.1")
+	suite.Error(err)
+	_, err = ParseVersion("2.x.1")
+	suite.Error(err)
+}
+
+func (suite *UpdateManifestTestSuite) TestFindArtifact_newestForPlatform() {
+	artifact, err := suite.manifest.FindArtifact("agent", "windows", "amd64")
+	suite.NoError(err)
+	suite.Equal("/agent-2.2.0.msi", artifact.Url)
+
+	artifact, err = suite.manifest.FindArtifact("agent", "linux", "amd64")
+	suite.NoError(err)
+	suite.Equal("/agent-3.0.0.rpm", artifact.Url)
+}
+
+func (suite *UpdateManifestTestSuite) TestFindArtifact_anyPlatform() {
+	artifact, err := suite.manifest.FindArtifact("watchdog", "windows", "386")
+	suite.NoError(err)
+	suite.Equal("/watchdog-9.0.0.zip", artifact.Url)
+}
+
+func (suite *UpdateManifestTestSuite) TestFindArtifact_notFound() {
+	_, err := suite.manifest.FindArtifact("agent", "darwin", "amd64")
+	suite.Error(err)
+}
+
+func (suite *UpdateManifestTestSuite) TestLegacyUpdateArtifact() {
+	legacy := insight.UpdateVersion{Md5: "abc", Url: "/agent.msi"}
+	legacy.Version = insight.Version{Major: 1, Minor: 2, Patch: 3}
+	artifact := LegacyUpdateArtifact("agent", legacy)
+	suite.Equal("1.2.3", artifact.Version)
+	suite.Equal("abc", artifact.Md5)
+	suite.True(artifact.Mandatory)
+}
+
+func (suite *UpdateManifestTestSuite) TestDecodeManifest_mandatoryByDefault() {
+	var manifest UpdateManifest
+	err := json.Unmarshal([]byte(`{"artifacts": [
+		{"product": "agent", "version": "2.1.5", "url": "/agent-2.1.5.msi"},
+		{"product": "agent", "version": "2.2.0", "url": "/agent-2.2.0.msi", "mandatory": false},
+		{"product": "agent", "version": "2.3.0", "url": "/agent-2.3.0.msi", "mandatory": true}]}`), &manifest)
+	suite.Require().NoError(err)
+	suite.Require().Len(manifest.Artifacts, 3)
+	suite.True(manifest.Artifacts[0].Mandatory)
+	suite.Equal("/agent-2.1.5.msi", manifest.Artifacts[0].Url)
+	suite.False(manifest.Artifacts[1].Mandatory)
+	suite.True(manifest.Artifacts[2].Mandatory)
+}
+
+func (suite *UpdateManifestTestSuite) TestVerifyArtifactFile() {
+	artifact := UpdateArtifact{
+		Sha256: "19E4BD2D806BED3C364FD84D0BF220AF9E652BB807739EDDFB3ABBEB2D355C59",
+		Size:   7,
+	}
+	suite.NoError(VerifyArtifactFile(suite.file, artifact))
+
+	artifact.Size = 8
+	err := VerifyArtifactFile(suite.file, artifact)
+	suite.Equal("size", err.(*VerificationError).Algorithm)
+}
+
+func (suite *UpdateManifestTestSuite) TestVerifyArtifactFile_md5() {
+	suite.NoError(VerifyArtifactFile(suite.file, UpdateArtifact{Md5: "5ca5a8d02077b7f6a0da48bda450f755"}))
+
+	err := VerifyArtifactFile(suite.file, UpdateArtifact{Md5: "00000000000000000000000000000000"})
+	suite.Equal("md5", err.(*VerificationError).Algorithm)
+}
+
+func (suite *UpdateManifestTestSuite) TestVerifyArtifactFile_noHash() {
+	err := VerifyArtifactFile(suite.file, UpdateArtifact{})
+	suite.Equal("none", err.(*VerificationError).Algorithm)
+}
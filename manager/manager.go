@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -15,6 +16,7 @@ import (
 	servdis "github.com/palette-software/palette-updater/services-discovery"
 
 	"github.com/StackExchange/wmi"
+	"github.com/kardianos/osext"
 )
 
 const BatchFile = "reinstall.bat"
@@ -33,10 +35,13 @@ func doesExist(path string) (bool, error) {
 
 // Checks if the update is OK. This practically means checking if it exists for now.
 func checkUpdate(updateLocation string) error {
-	dirExists, err := doesExist(updateLocation)
-	if err != nil || dirExists {
+	exists, err := doesExist(updateLocation)
+	if err != nil {
 		return err
 	}
+	if !exists {
+		return fmt.Errorf("Update file does not exist: %s", updateLocation)
+	}
 	return nil
 }
 
@@ -56,13 +61,15 @@ func stopServices(serviceControl svcControl.ServiceControl) error {
 	// return err
 }
 
-func createBatchFile(msiPath string, targetDir, installerLogFile string) error {
+// The operation ID is passed to msiexec as a property, so that it appears in the verbose installer log
+func createBatchFile(msiPath string, targetDir, installerLogFile, operationId string) error {
 	f, err := os.Create(BatchFile)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	reinstallCommand := fmt.Sprintf("msiexec /i \"%s\" /norestart INSTALLFOLDER=\"%s\" /qnlv /log \"%s\"", msiPath, targetDir, installerLogFile)
+	reinstallCommand := fmt.Sprintf("msiexec /i \"%s\" /norestart INSTALLFOLDER=\"%s\" OPERATIONID=\"%s\" /qnlv /log \"%s\"",
+		msiPath, targetDir, operationId, installerLogFile)
 	_, err = f.WriteString(reinstallCommand)
 	if err != nil {
 		return err
@@ -79,6 +86,9 @@ func reinstallServices(msiPath string) error {
 	if err != nil {
 		return err
 	}
+	if len(dst) == 0 {
+		return errors.New("Could not find installed agent service.")
+	}
 
 	// Hopefully there will only be one target directory, but if get more for some reason, try them all.
 	var targetDir string = ""
@@ -91,16 +101,18 @@ func reinstallServices(msiPath string) error {
 			continue
 		}
 		installerLogFile := fmt.Sprintf("%s\\Logs\\installer.log", targetDir)
-		err = createBatchFile(msiPath, targetDir, installerLogFile)
+		err = createBatchFile(msiPath, targetDir, installerLogFile, operationId)
 		if err != nil {
 			log.Warningf("Failed to create batch file with target dir: %s. Error message: %s", targetDir, err)
 			continue
 		}
-		cmd := exec.Command(BatchFile)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		// The output goes into the log, as stdout is reserved for the result of the manager
+		var output []byte
+		output, err = exec.Command(BatchFile).CombinedOutput()
 		os.Remove(BatchFile)
+		if len(output) > 0 {
+			log.Infof("Output of the installer batch file:\n%s", output)
+		}
 		// Have the contents of the installer log in the common log
 		installerResult, logErr := ioutil.ReadFile(installerLogFile)
 		if logErr != nil {
@@ -120,74 +132,127 @@ func reinstallServices(msiPath string) error {
 	return err
 }
 
+// The watchdog passes the ID of the update or command, so that the log lines of the
+// watchdog, the manager and the installer can be correlated. Manual runs get their own ID.
+var operationId string
+
 func main() {
+	operationId = os.Getenv(common.OperationIdEnvVar)
+	if len(operationId) == 0 {
+		operationId = common.NewOperationId()
+	}
+	common.SetProcessLogFields("operation_id", operationId)
+
 	closeLogging, err := common.InitLogging("manager.log")
 	if err != nil {
 		fmt.Println("Failed to init logging! ", err)
 		panic(err)
 	}
 
-	defer closeLogging()
-
 	log.Infof("Firing up manager... Command line %s", os.Args)
 
-	if len(os.Args) < 2 {
-		log.Errorf("Usage: %s installer_file\n", os.Args[0])
-		os.Exit(1)
+	command, warnings, err := runCommand(os.Args)
+	result := common.NewManagerResult(command, err, warnings)
+	result.OperationId = operationId
+	reportResult(result)
+
+	// Deferred calls do not run on os.Exit
+	closeLogging()
+	os.Exit(result.ExitCode)
+}
+
+func runCommand(args []string) (string, []string, error) {
+	if len(args) < 2 {
+		return "", nil, common.NewManagerError(common.ManagerExitUsage,
+			"Usage: %s update <installer_file> | start | stop", args[0])
 	}
 
-	command := strings.ToLower(os.Args[1])
+	command := strings.ToLower(args[1])
 	var serviceControl svcControl.ServiceControl
 
 	switch command {
 	case "update":
 		// In this case the following command-line argument is going to be
 		// path for the update file.
-		if len(os.Args) < 3 {
-			log.Error("Missing update file for update command!")
-			return
+		if len(args) < 3 {
+			return command, nil, common.NewManagerError(common.ManagerExitUsage, "Missing update file for update command!")
 		}
-		installerFile := os.Args[2]
-		err = doUpdate(installerFile, serviceControl)
+		installerFile := args[2]
+		warnings, err := doUpdate(installerFile, serviceControl)
+		return command, warnings, err
 	case "start":
-		err = serviceControl.Start(common.AgentSvcName)
+		if err := serviceControl.Start(common.AgentSvcName); err != nil {
+			return command, nil, common.NewManagerError(common.ManagerExitServiceControl,
+				"Failed to start %s: %v", common.AgentSvcName, err)
+		}
 	case "stop":
-		err = serviceControl.Stop(common.AgentSvcName)
+		if err := serviceControl.Stop(common.AgentSvcName); err != nil {
+			return command, nil, common.NewManagerError(common.ManagerExitServiceControl,
+				"Failed to stop %s: %v", common.AgentSvcName, err)
+		}
 	default:
-		log.Errorf("Unexpected command to execute: %s!", command)
-		return
+		return command, nil, common.NewManagerError(common.ManagerExitUsage, "Unexpected command to execute: %s!", command)
+	}
+	return command, nil, nil
+}
+
+// Prints the result as a JSON line on stdout. The result of an update is saved into a file too.
+func reportResult(result common.ManagerResult) {
+	if result.Success() {
+		log.Infof("Successfully executed command %s.", result.Command)
+	} else {
+		log.Errorf("Failed to execute command %s! Error message: %s (exit code: %d, %s)",
+			result.Command, result.Message, result.ExitCode, result.Class)
 	}
 
+	resultBytes, err := json.Marshal(result)
 	if err != nil {
-		log.Errorf("Failed to execute command %s! Error message: %s", command, err)
+		log.Error("Failed to serialize manager result! Error: ", err)
 		return
 	}
+	fmt.Println(string(resultBytes))
+
+	if result.Command == "update" {
+		execFolder, err := osext.ExecutableFolder()
+		if err == nil {
+			err = common.WriteManagerResultFile(filepath.Join(execFolder, common.ManagerResultFileName), result)
+		}
+		if err != nil {
+			log.Error("Failed to write manager result file! Error: ", err)
+		}
+	}
 }
 
-func doUpdate(installerFile string, serviceControl svcControl.ServiceControl) error {
+func doUpdate(installerFile string, serviceControl svcControl.ServiceControl) (warnings []string, err error) {
+	warn := func(format string, v ...interface{}) {
+		warning := fmt.Sprintf(format, v...)
+		log.Warning(warning)
+		warnings = append(warnings, warning)
+	}
+
 	log.Info("Checking prerequisites.")
-	err := checkUpdate(installerFile)
+	err = checkUpdate(installerFile)
 	if err != nil {
-		log.Errorf("Stopping update as could not validate update package: %s", err)
-		os.Exit(1)
+		return nil, common.NewManagerError(common.ManagerExitInvalidPackage,
+			"Stopping update as could not validate update package: %v", err)
 	}
 
 	log.Info("Stopping services.")
 	err = serviceControl.Stop(common.AgentSvcName)
 	if err != nil {
 		// Should not stop here. Service needs to be started anyway from now on.
-		log.Warningf("Could not stop service: %s", err)
+		warn("Could not stop service: %v", err)
 	}
 
 	log.Info("Reinstalling services.")
-	err = reinstallServices(installerFile)
-	if err != nil {
+	installErr := reinstallServices(installerFile)
+	if installErr != nil {
 		// Should not stop here. Service needs to be started anyway from now on.
-		log.Warningf("Failed to install service: %s", err)
+		log.Warningf("Failed to install service: %s", installErr)
 	}
 
 	log.Info("Restarting services.")
-	err = serviceControl.Start(common.AgentSvcName)
+	startErr := serviceControl.Start(common.AgentSvcName)
 	// When we get error here we should try again....
 
 	// Anyway, we need to make sure that the Watchdog is running after the reinstall.
@@ -196,16 +261,24 @@ func doUpdate(installerFile string, serviceControl svcControl.ServiceControl) er
 	errWatchdog := serviceControl.Install(common.WatchdogSvcName, common.WatchdogSvcDisplayName, common.WatchdogSvcDescription)
 	if errWatchdog != nil {
 		if !strings.Contains(errWatchdog.Error(), "already exists") {
-			log.Warningf("Failed to install %s. Error message: %s", common.WatchdogSvcDisplayName, err)
+			warn("Failed to install %s. Error message: %v", common.WatchdogSvcDisplayName, errWatchdog)
 		}
 	}
 
 	errWatchdog = serviceControl.Start(common.WatchdogSvcName)
 	if errWatchdog != nil {
 		if !strings.Contains(errWatchdog.Error(), "already running") {
-			log.Warningf("Failed to start %s. Error message: %s", common.WatchdogSvcDisplayName, err)
+			warn("Failed to start %s. Error message: %v", common.WatchdogSvcDisplayName, errWatchdog)
 		}
 	}
 
-	return err
+	if installErr != nil {
+		return warnings, common.NewManagerError(common.ManagerExitInstallFailed,
+			"Failed to install %s: %v", installerFile, installErr)
+	}
+	if startErr != nil {
+		return warnings, common.NewManagerError(common.ManagerExitAgentStartFailed,
+			"Failed to start %s after the update: %v", common.AgentSvcName, startErr)
+	}
+	return warnings, nil
 }
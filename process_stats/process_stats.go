@@ -0,0 +1,26 @@
+package process_stats
+
+import (
+	"time"
+)
+
+// Resource usage of a process at a given moment
+type Stats struct {
+	Pid int
+	// Resident set size (working set on Windows)
+	MemoryBytes uint64
+	// CPU time spent in user and kernel mode since the start of the process
+	CpuTime time.Duration
+	// Number of open handles on Windows, open file descriptors on Linux
+	Handles    int
+	SampleTime time.Time
+}
+
+// Returns the CPU usage between the two samples in percent of a single core
+func CpuPercent(previous, current Stats) float64 {
+	elapsed := current.SampleTime.Sub(previous.SampleTime)
+	if elapsed <= 0 || current.Pid != previous.Pid || current.CpuTime < previous.CpuTime {
+		return 0
+	}
+	return float64(current.CpuTime-previous.CpuTime) / float64(elapsed) * 100
+}
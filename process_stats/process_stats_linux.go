@@ -0,0 +1,61 @@
+package process_stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The unit of CPU times in /proc/<pid>/stat. It is 100 on every architecture supported by Go.
+const clockTicksPerSecond = 100
+
+func GetStats(pid int) (Stats, error) {
+	procFolder := fmt.Sprintf("/proc/%d", pid)
+	statBytes, err := ioutil.ReadFile(procFolder + "/stat")
+	if err != nil {
+		return Stats{}, err
+	}
+	cpuTicks, rssPages, err := parseProcStat(string(statBytes))
+	if err != nil {
+		return Stats{}, err
+	}
+	fds, err := ioutil.ReadDir(procFolder + "/fd")
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return Stats{
+		Pid:         pid,
+		MemoryBytes: rssPages * uint64(os.Getpagesize()),
+		CpuTime:     time.Duration(cpuTicks) * time.Second / clockTicksPerSecond,
+		Handles:     len(fds),
+		SampleTime:  time.Now(),
+	}, nil
+}
+
+// Returns the user and system mode CPU time in clock ticks and the resident set size in pages
+func parseProcStat(stat string) (cpuTicks uint64, rssPages uint64, err error) {
+	// The process name is in parentheses and it may contain spaces and parentheses itself
+	nameEnd := strings.LastIndex(stat, ")")
+	if nameEnd < 0 {
+		return 0, 0, fmt.Errorf("Invalid process stat: %s", stat)
+	}
+	// Fields after the name, starting with the state (field 3 in proc(5))
+	fields := strings.Fields(stat[nameEnd+1:])
+	const utime, stime, rss = 14 - 3, 15 - 3, 24 - 3
+	if len(fields) <= rss {
+		return 0, 0, fmt.Errorf("Invalid process stat: %s", stat)
+	}
+
+	var values [3]uint64
+	for i, index := range []int{utime, stime, rss} {
+		values[i], err = strconv.ParseUint(fields[index], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid process stat field: %s Error: %v", fields[index], err)
+		}
+	}
+	return values[0] + values[1], values[2], nil
+}
@@ -0,0 +1,41 @@
+package process_stats
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	stat := "1234 (palette (insight) agent) S 1 1234 1234 0 -1 4194560 3084 0 0 0 250 50 0 0 20 0 " +
+		"12 0 5678 1038090240 4096 18446744073709551615 1 1 0 0 0 0 0 4096 0 0 0 0 17 1 0 0 0 0 0\n"
+
+	cpuTicks, rssPages, err := parseProcStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpuTicks != 300 {
+		t.Errorf("CPU ticks are %d instead of 300", cpuTicks)
+	}
+	if rssPages != 4096 {
+		t.Errorf("RSS is %d pages instead of 4096", rssPages)
+	}
+}
+
+func TestParseProcStat_truncated(t *testing.T) {
+	if _, _, err := parseProcStat("1234 (agent) S 1 1234"); err == nil {
+		t.Fatal("Truncated stat should be an error")
+	}
+}
+
+func TestGetStats_currentProcess(t *testing.T) {
+	stats, err := GetStats(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemoryBytes == 0 {
+		t.Error("Memory usage of the current process should not be zero")
+	}
+	if stats.Handles == 0 {
+		t.Error("The current process should have open file descriptors")
+	}
+}
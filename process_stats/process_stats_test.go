@@ -0,0 +1,26 @@
+package process_stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCpuPercent(t *testing.T) {
+	start := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	previous := Stats{Pid: 42, CpuTime: 10 * time.Second, SampleTime: start}
+	current := Stats{Pid: 42, CpuTime: 13 * time.Second, SampleTime: start.Add(10 * time.Second)}
+
+	if percent := CpuPercent(previous, current); percent != 30 {
+		t.Fatalf("CPU usage is %v instead of 30 percent", percent)
+	}
+}
+
+func TestCpuPercent_restartedProcess(t *testing.T) {
+	start := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	previous := Stats{Pid: 42, CpuTime: 10 * time.Second, SampleTime: start}
+	current := Stats{Pid: 43, CpuTime: time.Second, SampleTime: start.Add(10 * time.Second)}
+
+	if percent := CpuPercent(previous, current); percent != 0 {
+		t.Fatalf("CPU usage is %v instead of 0 for a different process", percent)
+	}
+}
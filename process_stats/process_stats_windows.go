@@ -0,0 +1,38 @@
+package process_stats
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/StackExchange/wmi"
+)
+
+type Win32_Process struct {
+	ProcessId      uint32
+	WorkingSetSize uint64
+	KernelModeTime uint64
+	UserModeTime   uint64
+	HandleCount    uint32
+}
+
+func GetStats(pid int) (Stats, error) {
+	var dst []Win32_Process
+	q := wmi.CreateQuery(&dst, fmt.Sprintf("where ProcessId = %d", pid))
+	err := wmi.Query(q, &dst)
+	if err != nil {
+		return Stats{}, err
+	}
+	if len(dst) == 0 {
+		return Stats{}, fmt.Errorf("process %d not found", pid)
+	}
+
+	process := dst[0]
+	return Stats{
+		Pid:         pid,
+		MemoryBytes: process.WorkingSetSize,
+		// Kernel and user mode times are in 100 nanosecond units
+		CpuTime:    time.Duration(process.KernelModeTime+process.UserModeTime) * 100,
+		Handles:    int(process.HandleCount),
+		SampleTime: time.Now(),
+	}, nil
+}
@@ -13,6 +13,7 @@ type Win32_Service struct {
 	PathName    string
 	DisplayName string
 	StartName   string
+	ProcessId   uint32
 }
 
 type CIM_DataFile struct {
@@ -54,6 +55,21 @@ func GetServiceVersion(serviceName string) (string, error) {
 	return "", err
 }
 
+// Returns the process ID of the running service
+func GetServiceProcessId(serviceName string) (int, error) {
+	var dst []Win32_Service
+	q := wmi.CreateQuery(&dst, fmt.Sprintf("where Name = '%s'", serviceName))
+	err := wmi.Query(q, &dst)
+	if err != nil {
+		log.Errorf("Failed to get process ID of service: %s. Error message: %s", serviceName, err)
+		return 0, err
+	}
+	if len(dst) == 0 || dst[0].ProcessId == 0 {
+		return 0, fmt.Errorf("Service %s is not running.", serviceName)
+	}
+	return int(dst[0].ProcessId), nil
+}
+
 func getVersion(pathName string) string {
 	var fileData []CIM_DataFile
 	cond := fmt.Sprintf("where Drive=\"%s\" and Path='%s' and Name like '%%%s%%'", getDrive(pathName), getPath(pathName), getExecutable(pathName))
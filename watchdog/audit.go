@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+)
+
+// Opened in main. Actions are not recorded if it could not be opened.
+var auditLog *common.AuditLog
+
+type initiatorKey struct{}
+
+// Actions are initiated by the watchdog itself unless the context says otherwise
+const defaultInitiator = "watchdog"
+
+func withInitiator(ctx context.Context, initiator string) context.Context {
+	return context.WithValue(ctx, initiatorKey{}, initiator)
+}
+
+func initiatorOf(ctx context.Context) string {
+	if initiator, ok := ctx.Value(initiatorKey{}).(string); ok {
+		return initiator
+	}
+	return defaultInitiator
+}
+
+// The initiator of the actions run from the command line
+func cliInitiator() string {
+	current, err := user.Current()
+	if err != nil {
+		return "cli"
+	}
+	return "cli:" + current.Username
+}
+
+func auditLogPath() string {
+	return filepath.Join(baseFolder, "Logs", common.AuditLogFileName)
+}
+
+func openAuditLog() {
+	var err error
+	auditLog, err = common.OpenAuditLog(auditLogPath())
+	if err != nil {
+		log.Error("Failed to open audit log! Actions are not audited. Error: ", err)
+	}
+}
+
+// Records an action in the audit log. The details are key/value pairs.
+func recordAudit(ctx context.Context, action string, actionErr error, details ...string) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Record(ctx, action, initiatorOf(ctx), actionErr, details...); err != nil {
+		log.Errorf("Failed to record %s in audit log! Error: %v", action, err)
+	}
+}
+
+// Returns the SHA-256 of the file, or "none" if it cannot be read
+func fileHash(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "none"
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Runs "audit verify [audit log]"
+func runAuditCommand(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return fmt.Errorf("Unknown audit command: %v", args)
+	}
+	path := auditLogPath()
+	if len(args) > 1 {
+		path = args[1]
+	}
+	count, err := common.VerifyAuditLog(path)
+	if err != nil {
+		fmt.Printf("Audit log %s is corrupted after %d valid entries: %v\n", path, count, err)
+		return err
+	}
+	fmt.Printf("Audit log %s is intact with %d entries\n", path, count)
+	return nil
+}
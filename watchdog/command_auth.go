@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Signed commands must expire within this time, so that they cannot be replayed for long
+// if the performed commands file is lost
+const maxCommandLifetime = 24 * time.Hour
+
+const performedCommandsFileName = "performed-commands.json"
+
+// Verifies the signature, the target host and the expiry of remote commands and makes sure
+// that they are performed only once
+type commandAuthenticator struct {
+	// The signing settings and their problem, which are logged when they change
+	signing      common.CommandSigning
+	signingError string
+	loaded       bool
+	// Nil if there is no valid key, so signed commands are rejected too
+	publicKey ed25519.PublicKey
+	guard     *common.CommandReplayGuard
+	// The last rejected command, which is polled again and again, but reported only once
+	lastRejected remoteCommand
+}
+
+// Loads the signing settings right away, so that the reason of rejecting every command is logged
+// at startup
+func newCommandAuthenticator() *commandAuthenticator {
+	auth := &commandAuthenticator{}
+	var err error
+	auth.guard, err = common.NewCommandReplayGuard(filepath.Join(baseFolder, performedCommandsFileName))
+	if err != nil {
+		log.Error("Failed to load performed commands! Error: ", err)
+	}
+	auth.reload(context.Background())
+	return auth
+}
+
+// Reads the signing settings before every command, so that creating or changing the file applies
+// without a restart
+func (auth *commandAuthenticator) reload(ctx context.Context) {
+	signing, err := common.LoadCommandSigning(baseFolder)
+	signingError := ""
+	if err != nil {
+		signingError = err.Error()
+	}
+	if auth.loaded && auth.signing == signing && auth.signingError == signingError {
+		return
+	}
+	auth.loaded = true
+	auth.signing = signing
+	auth.signingError = signingError
+
+	logger := common.Log(ctx)
+	if err != nil {
+		logger.Error(err)
+	}
+	auth.publicKey = nil
+	if len(signing.ServerPublicKey) > 0 {
+		// It has been validated by LoadCommandSigning
+		auth.publicKey, _ = common.ParseCommandPublicKey(signing.ServerPublicKey)
+	}
+	if signing.AllowUnsigned {
+		logger.Warning("Unsigned remote commands are accepted. Only allow this for legacy servers.")
+	}
+}
+
+// Legacy servers send unsigned commands, which are identified by their timestamp
+func (auth *commandAuthenticator) needsSignature(command remoteCommand) bool {
+	return len(command.Signature) > 0 || !auth.signing.AllowUnsigned
+}
+
+// Returns nil if the signed command can be performed on this host now
+func (auth *commandAuthenticator) verify(command remoteCommand, hostname string, now time.Time) error {
+	if auth.publicKey == nil {
+		return fmt.Errorf("Command %s cannot be verified without a valid ServerPublicKey in %s", command.Id,
+			common.CommandSigningFileName)
+	}
+	if len(command.Id) == 0 {
+		return fmt.Errorf("Command %s has no ID", command.Cmd)
+	}
+	err := common.VerifyCommandSignature(auth.publicKey, command.signedFields(), command.Signature)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(command.Hostname, hostname) {
+		return fmt.Errorf("Command %s is for host %s", command.Id, command.Hostname)
+	}
+	expires, err := time.Parse(time.RFC3339, command.Expires)
+	if err != nil {
+		return fmt.Errorf("Invalid expiry of command %s! Error: %v", command.Id, err)
+	}
+	if !expires.After(now) {
+		return fmt.Errorf("Command %s expired at %s", command.Id, command.Expires)
+	}
+	if expires.After(now.Add(maxCommandLifetime)) {
+		return fmt.Errorf("Command %s expires too late: %s", command.Id, command.Expires)
+	}
+	return nil
+}
+
+// Verifies the signed command and remembers it, so that it is not performed again. Returns false
+// with a nil error if the command has already been performed.
+func (auth *commandAuthenticator) accept(ctx context.Context, command remoteCommand, hostname string) (bool, error) {
+	logger := common.Log(ctx)
+	if auth.guard.Performed(command.Id) {
+		logger.Debugf("Command %s has already been performed.", command.Id)
+		return false, nil
+	}
+
+	now := time.Now()
+	if err := auth.verify(command, hostname, now); err != nil {
+		if !auth.lastRejected.equals(command) {
+			auth.lastRejected = command
+			logger.Error("Rejected remote command! Error: ", err)
+			commandsProcessed.Inc(command.Cmd, "rejected")
+			recordAudit(ctx, "command-rejected", err, "command", command.Cmd, "id", command.Id)
+		}
+		return false, err
+	}
+
+	// Remembered before performing it, as a failed command must not be retried by a replay either
+	expires, _ := time.Parse(time.RFC3339, command.Expires)
+	if err := auth.guard.Remember(command.Id, expires, now); err != nil {
+		logger.Error("Failed to save performed commands! Error: ", err)
+		return false, err
+	}
+	return true, nil
+}
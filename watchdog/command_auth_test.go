@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	insight "github.com/palette-software/insight-server/lib"
+	"github.com/palette-software/palette-updater/common"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Points baseFolder to an empty installation folder until the returned function is called
+func useTempBaseFolder(t *testing.T) func() {
+	previous := baseFolder
+	folder, err := ioutil.TempDir("", "watchdog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(folder, "Config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	baseFolder = folder
+	return func() {
+		os.RemoveAll(folder)
+		baseFolder = previous
+	}
+}
+
+func writeCommandSigning(t *testing.T, content string) {
+	path := filepath.Join(baseFolder, "Config", common.CommandSigningFileName)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signedCommand(t *testing.T, privateKey ed25519.PrivateKey, hostname string) remoteCommand {
+	command := remoteCommand{
+		AgentCommand: insight.AgentCommand{Cmd: "start"},
+		Id:           "1",
+		Hostname:     hostname,
+		Expires:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	}
+	payload, err := command.signedFields().Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	command.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload))
+	return command
+}
+
+// Hosts upgraded from a version without signed commands have no command signing file
+func TestCommandAuthenticator_upgradedHost(t *testing.T) {
+	defer useTempBaseFolder(t)()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := newCommandAuthenticator()
+	unsigned := remoteCommand{AgentCommand: insight.AgentCommand{Cmd: "GET-CONFIG", Ts: time.Now().Format(time.RFC3339)}}
+	if !auth.needsSignature(unsigned) {
+		t.Error("Unsigned commands should be rejected without the command signing file")
+	}
+	err = auth.verify(signedCommand(t, privateKey, "host"), "host", time.Now())
+	if err == nil || !strings.Contains(err.Error(), common.CommandSigningFileName) {
+		t.Errorf("Expected an error naming the command signing file, got %v", err)
+	}
+
+	// Legacy servers keep working once the file is created, without a restart
+	writeCommandSigning(t, "AllowUnsigned: true\n")
+	auth.reload(context.Background())
+	if auth.needsSignature(unsigned) {
+		t.Error("Unsigned commands should be accepted with AllowUnsigned")
+	}
+
+	writeCommandSigning(t, "ServerPublicKey: "+base64.StdEncoding.EncodeToString(publicKey)+"\n")
+	auth.reload(context.Background())
+	if !auth.needsSignature(unsigned) {
+		t.Error("Unsigned commands should be rejected without AllowUnsigned")
+	}
+	if err := auth.verify(signedCommand(t, privateKey, "host"), "host", time.Now()); err != nil {
+		t.Error(err)
+	}
+}
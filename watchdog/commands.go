@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	insight "github.com/palette-software/insight-server/lib"
@@ -28,97 +32,289 @@ func commandToString(cmd insight.AgentCommand) string {
 	return string(b)
 }
 
-func performCommand(arguments ...string) (err error) {
+// A command from the Insight Server. Some commands take parameters, e.g. SET-LOG-LEVEL.
+type remoteCommand struct {
+	insight.AgentCommand
+	Params map[string]string `json:"params"`
+	// Signed commands have an ID, the target host, an expiry and a base64 Ed25519 signature
+	Id        string `json:"id"`
+	Hostname  string `json:"hostname"`
+	Expires   string `json:"expires"`
+	Signature string `json:"signature"`
+}
+
+func (c remoteCommand) signedFields() common.SignedCommandFields {
+	return common.SignedCommandFields{
+		Id:       c.Id,
+		Hostname: c.Hostname,
+		Command:  c.Cmd,
+		Params:   c.Params,
+		Expires:  c.Expires,
+	}
+}
+
+func (c remoteCommand) equals(other remoteCommand) bool {
+	return c.AgentCommand == other.AgentCommand && c.Id == other.Id && c.Signature == other.Signature
+}
+
+// Manager commands which must not be killed when the watchdog stops. The agent installer
+// stops and restarts the watchdog service itself during the update.
+var detachedManagerCommands = map[string]bool{
+	"update": true,
+}
+
+func performCommand(ctx context.Context, arguments ...string) (err error) {
+	logger := common.Log(ctx)
+	defer func() {
+		recordAudit(ctx, "manager-command", err, "command", arguments[0], "arguments", fmt.Sprint(arguments))
+	}()
+	// Held until the manager exits, even if that is after this function returns. So the agent is not
+	// started or stopped during an update, and the copy of the manager is not overwritten while it runs.
+	agentSvcMutex.Lock()
 	tempUpdaterFileName := filepath.Join(baseFolder, "manager_in_action.exe")
-	err = gocp.Copy(filepath.Join(baseFolder, "manager.exe"), tempUpdaterFileName)
-	if err != nil {
-		log.Error("Failed to make copy of manager.exe! Error message: ", err)
-		return err
+	copied := false
+	release := func() {
+		if copied {
+			logger.Debug("Deleting ", tempUpdaterFileName)
+			err := os.Remove(tempUpdaterFileName)
+			if err != nil {
+				logger.Errorf("Failed to delete %s! Error message: %s", tempUpdaterFileName, err)
+			}
+		}
+		agentSvcMutex.Unlock()
 	}
+	stillRunning := false
 	defer func() {
-		log.Debug("Deleting ", tempUpdaterFileName)
-		err = os.Remove(tempUpdaterFileName)
-		if err != nil {
-			log.Errorf("Failed to delete %s! Error message: %s", tempUpdaterFileName, err)
+		if !stillRunning {
+			release()
 		}
 	}()
 
-	log.Infof("Performing command: %s", arguments)
+	err = gocp.Copy(filepath.Join(baseFolder, "manager.exe"), tempUpdaterFileName)
+	if err != nil {
+		logger.Error("Failed to make copy of manager.exe! Error message: ", err)
+		return err
+	}
+	copied = true
+
+	logger.Infof("Performing command: %s", arguments)
 	cmd := exec.Command(tempUpdaterFileName, arguments...)
-	agentSvcMutex.Lock()
-	defer agentSvcMutex.Unlock()
-	err = cmd.Run()
+	// The output of detached commands cannot be read, they leave a result file instead
+	detached := detachedManagerCommands[arguments[0]]
+	var stdout bytes.Buffer
+	if !detached {
+		cmd.Stdout = &stdout
+	}
+	if operationId := common.OperationId(ctx); len(operationId) > 0 {
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", common.OperationIdEnvVar, operationId))
+	}
+	err = cmd.Start()
 	if err != nil {
-		log.Errorf("Failed to execute %s! Error message: %s", tempUpdaterFileName, err)
+		logger.Errorf("Failed to start %s! Error message: %s", tempUpdaterFileName, err)
 		return err
 	}
 
-	log.Infof("Successfully performed command: %s", arguments)
-	return nil
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cmd.Wait()
+	}()
+
+	// An install may take longer than the timeout of the job, so detached commands are only
+	// stopped being waited for when the service stops
+	waitCtx := ctx
+	if detached {
+		waitCtx = serviceContext(ctx)
+	}
+	select {
+	case err = <-finished:
+	case <-waitCtx.Done():
+		if detached {
+			logger.Warningf("Stopped waiting for command: %s, but it keeps running.", arguments)
+			stillRunning = true
+			go func() {
+				<-finished
+				logger.Infof("Command %s exited after the watchdog stopped waiting for it.", arguments)
+				release()
+			}()
+			return waitCtx.Err()
+		}
+		logger.Warningf("Killing command: %s, because it was cancelled.", arguments)
+		cmd.Process.Kill()
+		<-finished
+		return ctx.Err()
+	}
+	exitCode := common.ManagerExitSuccess
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			logger.Errorf("Failed to execute %s! Error message: %s", tempUpdaterFileName, err)
+			return err
+		}
+		exitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	}
+
+	var result common.ManagerResult
+	found := false
+	if detached {
+		result, found, err = common.TakeManagerResultFile(filepath.Join(baseFolder, common.ManagerResultFileName))
+		if err != nil {
+			logger.Error("Failed to read manager result! Error: ", err)
+		}
+	}
+	if !found {
+		result = common.ParseManagerOutput(arguments[0], stdout.Bytes(), exitCode)
+	}
+	logManagerResult(logger, result)
+	return result.Err()
 }
 
-func (pws *paletteWatchdogService) checkForCommand() error {
-	client, err := common.NewApiClient(baseFolder)
+func logManagerResult(logger *common.FieldLogger, result common.ManagerResult) {
+	managerResults.Inc(result.Command, result.Class)
+	for _, warning := range result.Warnings {
+		logger.Warningf("Manager command %s warning: %s", result.Command, warning)
+	}
+	if !result.Success() {
+		logger.Errorf("Manager command %s failed! Error message: %s (exit code: %d, %s)",
+			result.Command, result.Message, result.ExitCode, result.Class)
+		return
+	}
+	logger.Infof("Successfully performed command: %s", result.Command)
+}
+
+// Reports the result of an update which restarted the watchdog
+func checkLeftoverManagerResult() {
+	result, found, err := common.TakeManagerResultFile(filepath.Join(baseFolder, common.ManagerResultFileName))
 	if err != nil {
-		log.Error("Failed to create Insight API client while checking for command! Error: ", err)
+		log.Error("Failed to read manager result! Error: ", err)
+		return
+	}
+	if found {
+		logger := common.Log(common.WithOperationId(context.Background(), result.OperationId))
+		logger.Infof("Found result of manager command %s finished at %s", result.Command,
+			result.Finished.Format(time.RFC3339))
+		logManagerResult(logger, result)
+		recordAudit(common.WithOperationId(context.Background(), result.OperationId), "manager-result",
+			result.Err(), "command", result.Command, "class", result.Class)
+	}
+}
+
+func (pws *paletteWatchdogService) checkForCommand(ctx context.Context) error {
+	logger := common.Log(ctx)
+	client, err := common.SharedApiClient(baseFolder)
+	if err != nil {
+		logger.Error("Failed to create Insight API client while checking for command! Error: ", err)
+		return err
 	}
 	hostname, err := os.Hostname()
 	if err != nil {
-		log.Error("Failed to get hostname for command check! Error: ", err)
+		logger.Error("Failed to get hostname for command check! Error: ", err)
 		return err
 	}
-	resp, err := client.Get(fmt.Sprint("/command?hostname=", url.QueryEscape(hostname)))
+	// An unchanged command is still decoded, so that a failed command is retried while it is recent
+	body, changed, err := client.GetWithCache(ctx, fmt.Sprint("/command?hostname=", url.QueryEscape(hostname)))
 	if err != nil {
 		// The error has already been logged
 		return err
 	}
-	log.Debugf("Recent command response: %v", resp)
-	defer resp.Body.Close()
+	logger.Debugf("Recent command response (changed: %v): %s", changed, body)
 
 	// Decode the JSON in the response
-	var command insight.AgentCommand
-	if err := json.NewDecoder(resp.Body).Decode(&command); err != nil {
-		log.Errorf("Error while deserializing command response body. Error message: %v", err)
+	var command remoteCommand
+	if err := json.Unmarshal(body, &command); err != nil {
+		logger.Errorf("Error while deserializing command response body. Error message: %v", err)
 		return err
 	}
 
-	log.Info("Recent command: ", commandToString(command))
-	if pws.lastPerformedCommand == command {
-		// Command has already been performed. Nothing to do now.
-		log.Debugf("Command %s has already been performed.", commandToString(command))
+	if len(command.Cmd) == 0 {
+		logger.Debug("There is no command.")
 		return nil
 	}
 
-	cmdTimestamp, err := time.Parse(time.RFC3339, command.Ts)
+	logger = logger.With("command", command.Cmd)
+	logger.Info("Recent command: ", commandToString(command.AgentCommand))
+	pws.commandAuth.reload(ctx)
+	if pws.commandAuth.needsSignature(command) {
+		accepted, err := pws.commandAuth.accept(ctx, command, hostname)
+		if !accepted {
+			// The error has already been logged
+			return err
+		}
+	} else if !isRecentUnsignedCommand(ctx, pws.status.getLastSeenCommand(), command) {
+		return nil
+	}
+
+	ctx = withInitiator(ctx, "server")
+	paramsBytes, _ := json.Marshal(command.Params)
+	recordAudit(ctx, "command-received", nil, "command", command.Cmd, "id", command.Id, "ts", command.Ts,
+		"params", string(paramsBytes), "signed", fmt.Sprint(len(command.Signature) > 0))
+	if err = loadPolicy(ctx).CheckCommand(command.Cmd); err != nil {
+		reportPolicyDenial(ctx, client, command.Id+command.Ts+command.Cmd, policyDenial{
+			Action:    "command",
+			Command:   command.Cmd,
+			CommandId: command.Id,
+			Reason:    err.Error(),
+		})
+		commandsProcessed.Inc(command.Cmd, "denied")
+		// Do not consider it again, but it is not the last performed command either, so that
+		// a denied stop does not disable the alive check
+		pws.status.setLastSeenCommand(command.AgentCommand)
+		return nil
+	}
+	err = performRemoteCommand(ctx, client, hostname, command)
+	commandsProcessed.Inc(command.Cmd, resultLabel(err))
 	if err != nil {
-		log.Errorf("Failed to parse command timestamp: %s! Error message: %s", command.Ts, err)
+		// The error has already been logged
 		return err
 	}
 
+	pws.status.setLastCommand(command.AgentCommand)
+	return nil
+}
+
+// Unsigned commands are performed if they are recent and differ from the last handled one
+func isRecentUnsignedCommand(ctx context.Context, lastSeen insight.AgentCommand, command remoteCommand) bool {
+	logger := common.Log(ctx)
+	if lastSeen == command.AgentCommand {
+		// Command has already been performed or denied. Nothing to do now.
+		logger.Debugf("Command %s has already been handled.", commandToString(command.AgentCommand))
+		return false
+	}
+
+	cmdTimestamp, err := time.Parse(time.RFC3339, command.Ts)
+	if err != nil {
+		logger.Errorf("Failed to parse command timestamp: %s! Error message: %s", command.Ts, err)
+		return false
+	}
+
 	if cmdTimestamp.Add(7 * time.Minute).Before(time.Now()) {
-		log.Debugf("Command %s is not recent enough. Ignore it.",
-			commandToString(command))
-		return nil
+		logger.Debugf("Command %s is not recent enough. Ignore it.",
+			commandToString(command.AgentCommand))
+		return false
 	}
+	return true
+}
 
+func performRemoteCommand(ctx context.Context, client *common.ApiClient, hostname string, command remoteCommand) error {
+	logger := common.Log(ctx)
+	var err error
 	switch command.Cmd {
 	case "start", "stop":
-		err = performCommand(command.Cmd)
+		err = performCommand(ctx, command.Cmd)
 		if err != nil {
-			log.Errorf("Failed to perform command: '%s'! Error message: %v", command.Cmd, err)
+			logger.Errorf("Failed to perform command: '%s'! Error message: %v", command.Cmd, err)
 			return err
 		}
 	case "GET-CONFIG":
-		err = performGetConfig(client, hostname)
+		err = performGetConfig(ctx, client, hostname)
 		if err != nil {
-			log.Error("Failed to get and apply new config file! Error: ", err)
+			logger.Error("Failed to get and apply new config file! Error: ", err)
 			// Do not return here as the following PUT-CONFIG command has to be run, so that the online editor
 			// still shows the real content of this agent's Config.yml.
 		}
 		// Upload the applied config automatically as a response
-		err = performPutConfig(client, hostname)
+		err = performPutConfig(ctx, client, hostname)
 		if err != nil {
-			log.Error("Automatic config upload after getting new configs failed! Error: ", err)
+			logger.Error("Automatic config upload after getting new configs failed! Error: ", err)
 			return err
 		}
 
@@ -126,7 +322,7 @@ func (pws *paletteWatchdogService) checkForCommand() error {
 		var serviceControl svcControl.ServiceControl
 		svcStatus, err := serviceControl.Query(common.AgentSvcName)
 		if err != nil {
-			log.Errorf("Failed to query the status of %s service! Error: %v", common.AgentSvcName, err)
+			logger.Errorf("Failed to query the status of %s service! Error: %v", common.AgentSvcName, err)
 			return err
 		}
 		if svcStatus.State == svc.Running {
@@ -134,54 +330,92 @@ func (pws *paletteWatchdogService) checkForCommand() error {
 			defer agentSvcMutex.Unlock()
 			err = serviceControl.Stop(common.AgentSvcName)
 			if err != nil {
-				log.Errorf("Failed to stop %s service! Error %v", common.AgentSvcName, err)
+				logger.Errorf("Failed to stop %s service! Error %v", common.AgentSvcName, err)
 				// Do not return here, and try to start anyway
 			}
 			err = serviceControl.Start(common.AgentSvcName)
+			recordAudit(ctx, "agent-restart", err, "reason", "remote config applied")
 			if err != nil {
-				log.Errorf("Failed to restart %s service after applying remote config changes! Error: %v",
+				logger.Errorf("Failed to restart %s service after applying remote config changes! Error: %v",
 					common.AgentSvcName, err)
 				return err
 			}
 		}
 
 	case "PUT-CONFIG":
-		err = performPutConfig(client, hostname)
+		err = performPutConfig(ctx, client, hostname)
 		if err != nil {
-			log.Error("Failed to upload config file! Error: ", err)
+			logger.Error("Failed to upload config file! Error: ", err)
+			return err
+		}
+	case "SET-LOG-LEVEL":
+		err = performSetLogLevel(command.Params)
+		if err != nil {
+			logger.Error("Failed to set log level! Error: ", err)
+			return err
+		}
+	case "UPLOAD-LOGS":
+		err = performUploadLogs(ctx, client, hostname, command.Params)
+		if err != nil {
+			logger.Error("Failed to upload logs! Error: ", err)
+			return err
+		}
+	case "COLLECT-DIAGNOSTICS":
+		err = uploadDiagnostics(ctx, client, hostname, "")
+		if err != nil {
+			// The error has already been logged
 			return err
 		}
 	default:
 		err = fmt.Errorf("Unknown command received: %v", command.Cmd)
-		log.Error(err)
+		logger.Error(err)
 		return err
 	}
 
-	pws.lastPerformedCommand = command
 	return nil
 }
 
-func performGetConfig(client *common.ApiClient, hostname string) error {
-	log.Info("Acquiring remote config...")
+func performGetConfig(ctx context.Context, client *common.ApiClient, hostname string) (err error) {
+	logger := common.Log(ctx)
+	logger.Info("Acquiring remote config...")
 	// Create a temporary folder for incoming config file and delete it after reconfiguration is done
 	incomingConfigFolder := filepath.Join(baseFolder, "incoming-config")
 	defer os.RemoveAll(incomingConfigFolder)
 
 	destinationPath := filepath.Join(incomingConfigFolder, insight.AgentConfigFileName)
-	err := client.DownloadFile(makeConfigEndpoint(hostname), destinationPath)
+	var beforeHash, afterHash string
+	defer func() {
+		recordAudit(ctx, "config-applied", err, "before", beforeHash, "after", afterHash)
+	}()
+	err = client.DownloadFile(ctx, makeConfigEndpoint(hostname), destinationPath)
 	if err != nil {
 		return err
 	}
 
+	// Overwrite Insight Agent's current config file
+	currentConfigPath, err := common.FindAgentConfigFile(baseFolder)
+	if err != nil {
+		return err
+	}
+
+	// The license key is never written in clear if it is not in clear in the current config
+	if err = mergeConfigLicenseKey(destinationPath, currentConfigPath); err != nil {
+		logger.Error(err)
+		return err
+	}
+	beforeHash = fileHash(currentConfigPath)
+	afterHash = fileHash(destinationPath)
+
 	// Make sure that the downloaded Config.yml is correct and contains the required fields
 	newConfig, err := common.ParseConfig(destinationPath)
 	if err != nil {
 		return err
 	}
+	common.AddRedactedSecret(newConfig.LicenseKey)
 
 	// Make sure that the license in the new config is alright. This also checks implicitly, that
 	// the new insight server endpoint is fine.
-	license, err := common.GetLicenseDataForConfig(newConfig)
+	license, err := common.GetLicenseDataForConfig(ctx, newConfig)
 	if err != nil {
 		return err
 	}
@@ -189,35 +423,45 @@ func performGetConfig(client *common.ApiClient, hostname string) error {
 	if !license.Valid {
 		err = fmt.Errorf("License is invalid in new conifg file: '%s'! License information: %v",
 			destinationPath, license)
-		log.Error(err)
-		return err
-	}
-
-	// Overwrite Insight Agent's current config file
-	currentConfigPath, err := common.FindAgentConfigFile(baseFolder)
-	if err != nil {
+		logger.Error(err)
 		return err
 	}
 
 	os.Rename(destinationPath, currentConfigPath)
 
-	log.Info("Successfully acquired and applied remote config file.")
+	logger.Info("Successfully acquired and applied remote config file.")
 	return nil
 }
 
-func performPutConfig(client *common.ApiClient, hostname string) error {
-	log.Info("Uploading agent's config file...")
+func performPutConfig(ctx context.Context, client *common.ApiClient, hostname string) error {
+	logger := common.Log(ctx)
+	logger.Info("Uploading agent's config file...")
 	agentConfigPath, err := common.FindAgentConfigFile(baseFolder)
 	if err != nil {
 		return err
 	}
 
-	err = client.UploadFile(makeConfigEndpoint(hostname), agentConfigPath)
+	// Upload a copy without the license key in clear
+	configBytes, err := ioutil.ReadFile(agentConfigPath)
+	if err != nil {
+		return err
+	}
+	outgoingConfigFolder := filepath.Join(baseFolder, "outgoing-config")
+	defer os.RemoveAll(outgoingConfigFolder)
+	if err = os.MkdirAll(outgoingConfigFolder, 0700); err != nil {
+		return err
+	}
+	uploadPath := filepath.Join(outgoingConfigFolder, insight.AgentConfigFileName)
+	if err = ioutil.WriteFile(uploadPath, configForUpload(configBytes), 0600); err != nil {
+		return err
+	}
+
+	err = client.UploadFile(ctx, makeConfigEndpoint(hostname), uploadPath)
 	if err != nil {
 		return err
 	}
 
-	log.Info("Successfully uploaded agent's config file: ", agentConfigPath)
+	logger.Info("Successfully uploaded agent's config file: ", agentConfigPath)
 	return nil
 }
 
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	insight "github.com/palette-software/insight-server/lib"
+	"github.com/palette-software/palette-updater/common"
+	"golang.org/x/sys/windows/svc"
+)
+
+// Serves the command to the command poll of a watchdog in a temporary installation folder
+func serveCommand(t *testing.T, command remoteCommand) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/command" {
+			json.NewEncoder(w).Encode(command)
+		}
+	}))
+	configYaml := fmt.Sprintf("LicenseKey: abc\nWebservice:\n  Endpoint: %s\n", server.URL)
+	if err := ioutil.WriteFile(filepath.Join(baseFolder, "Config", "Config.yml"), []byte(configYaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestCheckAlive_afterDeniedStop(t *testing.T) {
+	defer useTempBaseFolder(t)()
+	writeCommandSigning(t, "AllowUnsigned: true\n")
+	policyPath := filepath.Join(baseFolder, "Config", common.PolicyFileName)
+	if err := ioutil.WriteFile(policyPath, []byte("Commands:\n  Deny: [stop]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := serveCommand(t, remoteCommand{AgentCommand: insight.AgentCommand{
+		Cmd: "stop",
+		Ts:  time.Now().UTC().Format(time.RFC3339),
+	}})
+	defer server.Close()
+
+	var recovered []svc.State
+	pws := &paletteWatchdogService{
+		crashLoop:   newCrashLoopDetector(common.CrashLoop{}),
+		commandAuth: newCommandAuthenticator(),
+		queryAgent: func() (svc.Status, error) {
+			return svc.Status{State: svc.Stopped}, nil
+		},
+		recoverAgent: func(ctx context.Context, state svc.State) {
+			recovered = append(recovered, state)
+		},
+	}
+	if err := pws.checkForCommand(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pws.checkAlive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovered) != 1 || recovered[0] != svc.Stopped {
+		t.Fatalf("The stopped agent was not started after a denied stop command: %v", recovered)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	insight "github.com/palette-software/insight-server/lib"
+	"github.com/palette-software/palette-updater/common"
+
+	gocp "github.com/cleversoap/go-cp"
+)
+
+// Crash loop defaults
+const (
+	defaultCrashLoopMaxRestarts   = 3
+	defaultCrashLoopWindow        = 30 * time.Minute
+	defaultCrashLoopMaxBackoff    = 4 * time.Hour
+	defaultCrashLoopAgentLogLines = 100
+	crashLoopEventCount           = 20
+)
+
+// Installers of the recently installed agent versions are kept here, so that we can roll back
+const installersFolderName = "Installers"
+
+// Contains the agent version which was rolled back because of a crash loop. Updates to this
+// version are not installed again.
+const blockedVersionFileName = "blocked-version.txt"
+
+type crashLoopAlert struct {
+	Hostname     string    `json:"hostname"`
+	Service      string    `json:"service"`
+	Version      string    `json:"version"`
+	MaxRestarts  int       `json:"maxRestarts"`
+	Window       string    `json:"window"`
+	BackoffUntil time.Time `json:"backoffUntil"`
+	AgentLog     []string  `json:"agentLog"`
+	Events       string    `json:"events"`
+	RollbackTo   string    `json:"rollbackTo,omitempty"`
+}
+
+func newCrashLoopDetector(config common.CrashLoop) *common.CrashLoopDetector {
+	detector := &common.CrashLoopDetector{
+		MaxRestarts: config.MaxRestarts,
+		Window:      config.Window,
+		BaseBackoff: aliveTimer,
+		MaxBackoff:  config.MaxBackoff,
+	}
+	if detector.MaxRestarts <= 0 {
+		detector.MaxRestarts = defaultCrashLoopMaxRestarts
+	}
+	if detector.Window <= 0 {
+		detector.Window = defaultCrashLoopWindow
+	}
+	if detector.MaxBackoff <= 0 {
+		detector.MaxBackoff = defaultCrashLoopMaxBackoff
+	}
+	return detector
+}
+
+// Collects diagnostics, alerts the Insight Server and rolls back the agent if it is configured
+func (pws *paletteWatchdogService) handleCrashLoop(ctx context.Context, config common.Config) {
+	logger := common.Log(ctx)
+	_, backoffUntil := pws.crashLoop.InBackoff(time.Now())
+	logger.Errorf("%s is in a crash loop! It had to be restarted %d times within %v. Further restarts are backed off until %s.",
+		common.AgentSvcName, pws.crashLoop.MaxRestarts, pws.crashLoop.Window, backoffUntil.Format(time.RFC3339))
+	crashLoops.Inc()
+
+	alert := crashLoopAlert{
+		Service:      common.AgentSvcName,
+		MaxRestarts:  pws.crashLoop.MaxRestarts,
+		Window:       pws.crashLoop.Window.String(),
+		BackoffUntil: backoffUntil,
+	}
+	alert.Hostname, _ = os.Hostname()
+	if currentVersion, err := getCurrentVersion(ctx, "agent"); err == nil {
+		alert.Version = fmt.Sprint(currentVersion)
+	}
+
+	logLines := config.Watchdog.CrashLoop.AgentLogLines
+	if logLines <= 0 {
+		logLines = defaultCrashLoopAgentLogLines
+	}
+	// The agent logs are not written by the watchdog, so they have not been redacted yet
+	for _, line := range collectAgentLog(ctx, logLines) {
+		alert.AgentLog = append(alert.AgentLog, common.Redact(line))
+	}
+	alert.Events = common.Redact(collectServiceEvents(ctx))
+
+	var rollbackInstaller string
+	if config.Watchdog.CrashLoop.Rollback {
+		var rollbackVersion insight.Version
+		rollbackInstaller, rollbackVersion = findRollbackInstaller(ctx)
+		if len(rollbackInstaller) > 0 {
+			alert.RollbackTo = fmt.Sprint(rollbackVersion)
+		}
+	}
+
+	client, err := common.SharedApiClientWithConfig(config)
+	if err == nil {
+		err = client.PostJSON(ctx, "/alerts/crash-loop", alert)
+	}
+	if err != nil {
+		logger.Error("Failed to report crash loop to the Insight Server! Error: ", err)
+	}
+
+	if len(rollbackInstaller) > 0 {
+		rollbackAgent(ctx, rollbackInstaller, alert.Version)
+	} else if config.Watchdog.CrashLoop.Rollback {
+		logger.Error("Unable to roll back the agent, because there is no installer of a previous version.")
+	}
+}
+
+// Returns the last lines of the most recently written agent log file
+func collectAgentLog(ctx context.Context, lineCount int) []string {
+	logger := common.Log(ctx)
+	logsFolder := filepath.Join(baseFolder, "Logs")
+	files, err := ioutil.ReadDir(logsFolder)
+	if err != nil {
+		logger.Error("Failed to list log files for crash loop diagnostics! Error: ", err)
+		return nil
+	}
+
+	var newest os.FileInfo
+	for _, file := range files {
+		name := strings.ToLower(file.Name())
+		if file.IsDir() || strings.HasPrefix(name, "watchdog") || strings.HasPrefix(name, "manager") ||
+			strings.HasPrefix(name, "installer") {
+			continue
+		}
+		if newest == nil || file.ModTime().After(newest.ModTime()) {
+			newest = file
+		}
+	}
+	if newest == nil {
+		logger.Warning("No agent log file found for crash loop diagnostics.")
+		return nil
+	}
+
+	lines, err := common.TailFile(filepath.Join(logsFolder, newest.Name()), lineCount)
+	if err != nil {
+		logger.Errorf("Failed to read agent log file: %s! Error: %v", newest.Name(), err)
+	}
+	return lines
+}
+
+// Returns the recent system events about the agent service (Windows event log or systemd journal)
+func collectServiceEvents(ctx context.Context) string {
+	logger := common.Log(ctx)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		// Service Control Manager reports the unexpected terminations of services in the System log
+		query := fmt.Sprintf("*[System[Provider[@Name='Service Control Manager']]] and *[EventData[Data='%s']]",
+			common.AgentSvcName)
+		cmd = exec.CommandContext(ctx, "wevtutil", "qe", "System", "/q:"+query,
+			fmt.Sprintf("/c:%d", crashLoopEventCount), "/rd:true", "/f:text")
+	case "linux":
+		cmd = exec.CommandContext(ctx, "journalctl", "-u", common.AgentSvcName,
+			"-n", fmt.Sprint(crashLoopEventCount), "--no-pager")
+	default:
+		return ""
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Errorf("Failed to query system events of %s! Error: %v Output: %s", common.AgentSvcName, err, output)
+	}
+	return string(output)
+}
+
+// Keeps the installer of the version being installed, and the one before that
+func keepInstallerForRollback(ctx context.Context, installerPath string, version insight.Version) {
+	logger := common.Log(ctx)
+	installersFolder := filepath.Join(baseFolder, installersFolderName)
+	err := os.MkdirAll(installersFolder, 0777)
+	if err != nil {
+		logger.Error("Failed to create installers folder! Error: ", err)
+		return
+	}
+
+	err = gocp.Copy(installerPath, filepath.Join(installersFolder, fmt.Sprintf("agent-%s", version)))
+	if err != nil {
+		logger.Error("Failed to keep installer for rollback! Error: ", err)
+		return
+	}
+
+	installers := listInstallers()
+	for i := 2; i < len(installers); i++ {
+		logger.Debug("Deleting old installer: ", installers[i].path)
+		os.Remove(installers[i].path)
+	}
+}
+
+type keptInstaller struct {
+	path    string
+	version insight.Version
+}
+
+// Returns the kept installers, newest version first
+func listInstallers() []keptInstaller {
+	installersFolder := filepath.Join(baseFolder, installersFolderName)
+	files, err := ioutil.ReadDir(installersFolder)
+	if err != nil {
+		return nil
+	}
+
+	var installers []keptInstaller
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "agent-") {
+			continue
+		}
+		version, err := common.ParseVersion(strings.TrimPrefix(file.Name(), "agent-"))
+		if err != nil {
+			continue
+		}
+		installers = append(installers, keptInstaller{filepath.Join(installersFolder, file.Name()), version})
+	}
+	sort.Sort(installersByVersion(installers))
+	return installers
+}
+
+type installersByVersion []keptInstaller
+
+func (a installersByVersion) Len() int      { return len(a) }
+func (a installersByVersion) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a installersByVersion) Less(i, j int) bool {
+	return insight.IsNewerVersion(a[i].version, a[j].version)
+}
+
+// Returns the newest kept installer which is older than the currently installed agent
+func findRollbackInstaller(ctx context.Context) (string, insight.Version) {
+	currentVersion, err := getCurrentVersion(ctx, "agent")
+	if err != nil {
+		return "", insight.Version{}
+	}
+	for _, installer := range listInstallers() {
+		if insight.IsNewerVersion(currentVersion, installer.version) {
+			return installer.path, installer.version
+		}
+	}
+	return "", insight.Version{}
+}
+
+func rollbackAgent(ctx context.Context, installerPath, crashingVersion string) {
+	logger := common.Log(ctx)
+	logger.Warningf("Rolling back %s from version %s using %s", common.AgentSvcName, crashingVersion, installerPath)
+
+	// Make sure that the next update check does not install the crashing version again
+	blockedVersionPath := filepath.Join(baseFolder, installersFolderName, blockedVersionFileName)
+	err := ioutil.WriteFile(blockedVersionPath, []byte(crashingVersion), 0644)
+	if err != nil {
+		logger.Error("Failed to save blocked agent version! Error: ", err)
+		return
+	}
+
+	err = performCommand(ctx, "update", installerPath)
+	if err != nil {
+		logger.Errorf("Failed to roll back %s! Error: %v", common.AgentSvcName, err)
+	}
+}
+
+// Returns whether the given version was rolled back because of a crash loop
+func isBlockedVersion(version insight.Version) bool {
+	blockedVersion, err := ioutil.ReadFile(filepath.Join(baseFolder, installersFolderName, blockedVersionFileName))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(blockedVersion)) == fmt.Sprint(version)
+}
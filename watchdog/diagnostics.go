@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+	svcControl "github.com/palette-software/palette-updater/service_control"
+	servdis "github.com/palette-software/palette-updater/services-discovery"
+)
+
+// Log files of these components are collected. The agent logs are huge, so they are left out.
+var diagnosticsLogPrefixes = []string{"watchdog", "manager", "installer", "audit"}
+
+type diagnosticsEnvironment struct {
+	Hostname     string    `json:"hostname"`
+	OS           string    `json:"os"`
+	Arch         string    `json:"arch"`
+	NumCPU       int       `json:"numCpu"`
+	GoVersion    string    `json:"goVersion"`
+	BaseFolder   string    `json:"baseFolder"`
+	ConfigSource string    `json:"configSource"`
+	CollectedAt  time.Time `json:"collectedAt"`
+}
+
+// Collects the logs, the redacted config, service states and versions into a zip file
+func collectDiagnostics(ctx context.Context, zipPath string) error {
+	zipFile, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+
+	archive := zip.NewWriter(zipFile)
+	collectDiagnosticLogs(archive)
+	collectDiagnosticConfig(archive)
+
+	services := make(map[string]string)
+	versions := make(map[string]string)
+	var serviceControl svcControl.ServiceControl
+	for _, name := range []string{common.AgentSvcName, common.WatchdogSvcName} {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		svcStatus, err := serviceControl.Query(name)
+		if err != nil {
+			services[name] = fmt.Sprintf("unknown (%v)", err)
+		} else {
+			services[name] = serviceStateToString(svcStatus.State)
+		}
+		version, err := servdis.GetServiceVersion(name)
+		if err != nil {
+			version = fmt.Sprintf("unknown (%v)", err)
+		}
+		versions[name] = version
+	}
+	addJsonToZip(archive, "services.json", services)
+	addJsonToZip(archive, "versions.json", versions)
+
+	environment := diagnosticsEnvironment{
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		NumCPU:      runtime.NumCPU(),
+		GoVersion:   runtime.Version(),
+		BaseFolder:  baseFolder,
+		CollectedAt: time.Now(),
+	}
+	environment.Hostname, _ = os.Hostname()
+	environment.ConfigSource, _ = common.FindAgentConfigFile(baseFolder)
+	addJsonToZip(archive, "environment.json", environment)
+
+	return archive.Close()
+}
+
+func collectDiagnosticLogs(archive *zip.Writer) {
+	logsFolder := filepath.Join(baseFolder, "Logs")
+	files, err := ioutil.ReadDir(logsFolder)
+	if err != nil {
+		log.Error("Failed to list log files for diagnostics! Error: ", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !isDiagnosticLog(file.Name()) {
+			continue
+		}
+		err := addFileToZip(archive, filepath.Join(logsFolder, file.Name()), "Logs/"+file.Name())
+		if err != nil {
+			log.Errorf("Failed to add log file %s to diagnostics! Error: %v", file.Name(), err)
+		}
+	}
+}
+
+func isDiagnosticLog(name string) bool {
+	name = strings.ToLower(name)
+	for _, prefix := range diagnosticsLogPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func collectDiagnosticConfig(archive *zip.Writer) {
+	configPath, err := common.FindAgentConfigFile(baseFolder)
+	if err != nil {
+		return
+	}
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		log.Error("Failed to read config file for diagnostics! Error: ", err)
+		return
+	}
+	writer, err := archive.Create("Config/" + filepath.Base(configPath))
+	if err == nil {
+		_, err = writer.Write(redactConfig(configBytes))
+	}
+	if err != nil {
+		log.Error("Failed to add config file to diagnostics! Error: ", err)
+	}
+}
+
+// Replaces the values of the secret keys in a YAML config
+func redactConfig(config []byte) []byte {
+	return []byte(common.Redact(string(config)))
+}
+
+func addFileToZip(archive *zip.Writer, path, name string) error {
+	// The watchdog keeps its own log file open, but it can still be read
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func addJsonToZip(archive *zip.Writer, name string, value interface{}) {
+	writer, err := archive.Create(name)
+	if err == nil {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(value)
+	}
+	if err != nil {
+		log.Errorf("Failed to add %s to diagnostics! Error: %v", name, err)
+	}
+}
+
+// Collects a diagnostics bundle and uploads it to the Insight Server. If keepPath is
+// empty, the bundle is deleted after the upload.
+func uploadDiagnostics(ctx context.Context, client *common.ApiClient, hostname, keepPath string) error {
+	logger := common.Log(ctx)
+	zipPath := keepPath
+	if len(zipPath) == 0 {
+		zipPath = filepath.Join(baseFolder, fmt.Sprintf("diagnostics-%s.zip", hostname))
+		defer os.Remove(zipPath)
+	}
+
+	logger.Info("Collecting diagnostics into ", zipPath)
+	err := collectDiagnostics(ctx, zipPath)
+	if err != nil {
+		logger.Error("Failed to collect diagnostics! Error: ", err)
+		return err
+	}
+
+	err = client.UploadFile(ctx, fmt.Sprint("/diagnostics?hostname=", url.QueryEscape(hostname)), zipPath)
+	if err != nil {
+		logger.Error("Failed to upload diagnostics! Error: ", err)
+		return err
+	}
+	logger.Info("Successfully uploaded diagnostics.")
+	return nil
+}
+
+// Runs the diagnostics collection from the command line. The bundle is kept at the given path,
+// so that it can be sent manually if the upload fails.
+func runDiagnostics(zipPath string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	if len(zipPath) == 0 {
+		zipPath = filepath.Join(baseFolder, fmt.Sprintf("diagnostics-%s-%s.zip", hostname,
+			time.Now().Format("20060102-150405")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	client, err := common.SharedApiClient(baseFolder)
+	if err != nil {
+		log.Error("Failed to create Insight API client for diagnostics upload! Error: ", err)
+		err = collectDiagnostics(ctx, zipPath)
+	} else {
+		err = uploadDiagnostics(ctx, client, hostname, zipPath)
+	}
+	fmt.Println("Diagnostics bundle:", zipPath)
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	insight "github.com/palette-software/insight-server/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+type DiagnosticsTestSuite struct {
+	suite.Suite
+	previousBaseFolder string
+}
+
+func TestDiagnosticsTestSuite(t *testing.T) {
+	suite.Run(t, new(DiagnosticsTestSuite))
+}
+
+const diagnosticsTestConfig = `LicenseKey: license-secret
+Webservice:
+  Endpoint: https://insight.example.com
+  Proxy:
+    Username: proxy-user
+    Password: proxy-secret
+Watchdog:
+  Logging:
+    Sinks:
+      - Type: splunk
+        Token: splunk-secret
+`
+
+func (suite *DiagnosticsTestSuite) SetupTest() {
+	suite.previousBaseFolder = baseFolder
+	folder, err := ioutil.TempDir("", "diagnostics")
+	suite.Require().NoError(err)
+	baseFolder = folder
+
+	suite.Require().NoError(os.MkdirAll(filepath.Join(baseFolder, "Config"), 0755))
+	suite.Require().NoError(os.MkdirAll(filepath.Join(baseFolder, "Logs"), 0755))
+	suite.writeFile(filepath.Join("Config", insight.AgentConfigFileName), diagnosticsTestConfig)
+	suite.writeFile(filepath.Join("Logs", "watchdog.log"), "watchdog log")
+	suite.writeFile(filepath.Join("Logs", "manager.log"), "manager log")
+	suite.writeFile(filepath.Join("Logs", "palette-insight-agent.log"), "agent log")
+}
+
+func (suite *DiagnosticsTestSuite) TearDownTest() {
+	os.RemoveAll(baseFolder)
+	baseFolder = suite.previousBaseFolder
+}
+
+func (suite *DiagnosticsTestSuite) writeFile(path, content string) {
+	suite.Require().NoError(ioutil.WriteFile(filepath.Join(baseFolder, path), []byte(content), 0600))
+}
+
+// Returns the contents of the bundle by file name
+func (suite *DiagnosticsTestSuite) collect() map[string]string {
+	zipPath := filepath.Join(baseFolder, "diagnostics.zip")
+	suite.Require().NoError(collectDiagnostics(context.Background(), zipPath))
+
+	archive, err := zip.OpenReader(zipPath)
+	suite.Require().NoError(err)
+	defer archive.Close()
+	contents := make(map[string]string)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		suite.Require().NoError(err)
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		suite.Require().NoError(err)
+		contents[file.Name] = string(content)
+	}
+	return contents
+}
+
+func (suite *DiagnosticsTestSuite) TestCollectDiagnostics_contents() {
+	contents := suite.collect()
+
+	for _, name := range []string{"Logs/watchdog.log", "Logs/manager.log", "Config/" + insight.AgentConfigFileName,
+		"services.json", "versions.json", "environment.json"} {
+		suite.Contains(contents, name)
+	}
+	suite.Equal("watchdog log", contents["Logs/watchdog.log"])
+	// The agent logs are left out
+	suite.NotContains(contents, "Logs/palette-insight-agent.log")
+}
+
+func (suite *DiagnosticsTestSuite) TestCollectDiagnostics_redactsConfig() {
+	config := suite.collect()["Config/"+insight.AgentConfigFileName]
+
+	suite.NotContains(config, "license-secret")
+	suite.NotContains(config, "proxy-secret")
+	suite.NotContains(config, "splunk-secret")
+	suite.Contains(config, "LicenseKey: <redacted>")
+	suite.Contains(config, "Password: <redacted>")
+	suite.Contains(config, "Token: <redacted>")
+	// Everything else is kept
+	suite.Contains(config, "Endpoint: https://insight.example.com")
+	suite.Contains(config, "Username: proxy-user")
+}
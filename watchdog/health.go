@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/palette-software/palette-updater/common"
+)
+
+const defaultHealthFailureThreshold = 2
+const defaultHttpCheckTimeout = 10 * time.Second
+
+// Checks an aspect of the running agent. Returns an error if the agent is not healthy.
+type healthProbe interface {
+	name() string
+	check(ctx context.Context) error
+}
+
+// Creates the probes which are enabled in the config
+func newHealthProbes(config common.Config) []healthProbe {
+	checks := config.Watchdog.HealthChecks
+	var probes []healthProbe
+
+	if len(checks.Heartbeat.File) > 0 && checks.Heartbeat.MaxAge > 0 {
+		path := checks.Heartbeat.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseFolder, path)
+		}
+		probes = append(probes, &heartbeatProbe{path: path, maxAge: checks.Heartbeat.MaxAge})
+	}
+	if len(checks.Http.Url) > 0 {
+		timeout := checks.Http.Timeout
+		if timeout <= 0 {
+			timeout = defaultHttpCheckTimeout
+		}
+		probes = append(probes, &httpProbe{url: checks.Http.Url, client: &http.Client{Timeout: timeout}})
+	}
+	if checks.LastUpload.MaxAge > 0 {
+		probes = append(probes, &lastUploadProbe{maxAge: checks.LastUpload.MaxAge})
+	}
+	return probes
+}
+
+// Runs every probe and returns the failures by probe name
+func runHealthProbes(ctx context.Context, probes []healthProbe) map[string]error {
+	logger := common.Log(ctx)
+	failures := make(map[string]error)
+	for _, probe := range probes {
+		if err := probe.check(ctx); err != nil {
+			logger.Warningf("Health check %s of %s failed: %v", probe.name(), common.AgentSvcName, err)
+			healthCheckFailures.Inc(probe.name())
+			failures[probe.name()] = err
+		}
+	}
+	return failures
+}
+
+type heartbeatProbe struct {
+	path   string
+	maxAge time.Duration
+}
+
+func (p *heartbeatProbe) name() string {
+	return "heartbeat"
+}
+
+func (p *heartbeatProbe) check(ctx context.Context) error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(info.ModTime()); age > p.maxAge {
+		return fmt.Errorf("heartbeat file %s was last modified %v ago", p.path, age)
+	}
+	return nil
+}
+
+type httpProbe struct {
+	url    string
+	client *http.Client
+}
+
+func (p *httpProbe) name() string {
+	return "http"
+}
+
+func (p *httpProbe) check(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health endpoint %s responded with %s", p.url, resp.Status)
+	}
+	return nil
+}
+
+// Asks the Insight Server when it last received data from this host
+type lastUploadProbe struct {
+	maxAge time.Duration
+}
+
+type lastUploadResponse struct {
+	LastUpload time.Time `json:"lastUpload"`
+}
+
+func (p *lastUploadProbe) name() string {
+	return "last-upload"
+}
+
+func (p *lastUploadProbe) check(ctx context.Context) error {
+	client, err := common.SharedApiClient(baseFolder)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Get(ctx, fmt.Sprint("/agent/last-upload?hostname=", url.QueryEscape(hostname)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var lastUpload lastUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lastUpload); err != nil {
+		return fmt.Errorf("Error while deserializing last upload response body. Error message: %v", err)
+	}
+	if age := time.Since(lastUpload.LastUpload); age > p.maxAge {
+		return fmt.Errorf("last upload was received by the Insight Server %v ago", age)
+	}
+	return nil
+}
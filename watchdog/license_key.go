@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+)
+
+// Sent instead of a license key which is in clear in Config.yml. The server sends it back
+// in the config if the key is not to be changed.
+const redactedLicenseKey = "<redacted>"
+
+// Returns the config to be uploaded to the server. A license key in clear is replaced, references
+// and sealed keys are kept as they are.
+func configForUpload(configBytes []byte) []byte {
+	rawKey := common.RawLicenseKey(configBytes)
+	if len(rawKey) == 0 || common.IsLicenseKeyReference(rawKey) {
+		return configBytes
+	}
+	return common.ReplaceLicenseKey(configBytes, redactedLicenseKey)
+}
+
+// Fills the license key of a config received from the server from the current config, so that
+//   - a redacted or missing key is replaced by the current one
+//   - a key in clear is sealed if the current config does not have the key in clear either
+func mergeIncomingLicenseKey(incoming, current []byte) ([]byte, error) {
+	incomingKey := common.RawLicenseKey(incoming)
+	currentKey := common.RawLicenseKey(current)
+	if len(incomingKey) == 0 || incomingKey == redactedLicenseKey {
+		if len(currentKey) == 0 {
+			return nil, fmt.Errorf("The license key is missing from the new config")
+		}
+		return common.ReplaceLicenseKey(incoming, currentKey), nil
+	}
+	if common.IsLicenseKeyReference(incomingKey) || !common.IsLicenseKeyReference(currentKey) {
+		return incoming, nil
+	}
+
+	// The key is the same most of the time
+	resolvedKey, err := common.ResolveLicenseKey(currentKey, baseFolder)
+	if err == nil && resolvedKey == incomingKey {
+		return common.ReplaceLicenseKey(incoming, currentKey), nil
+	}
+	sealedKey, err := common.SealLicenseKey(incomingKey, baseFolder)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to seal the license key of the new config! Error: %v", err)
+	}
+	return common.ReplaceLicenseKey(incoming, sealedKey), nil
+}
+
+// Merges the license key of the current config into the downloaded config file
+func mergeConfigLicenseKey(incomingPath, currentPath string) error {
+	incoming, err := ioutil.ReadFile(incomingPath)
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadFile(currentPath)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeIncomingLicenseKey(incoming, current)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(incomingPath, merged, 0600)
+}
+
+// Replaces the license key in clear in Config.yml with the sealed key
+func sealConfigLicenseKey() error {
+	configPath, err := common.FindAgentConfigFile(baseFolder)
+	if err != nil {
+		return err
+	}
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	rawKey := common.RawLicenseKey(configBytes)
+	if len(rawKey) == 0 {
+		return fmt.Errorf("There is no license key in %s", configPath)
+	}
+	if common.IsLicenseKeyReference(rawKey) {
+		log.Info("The license key is not in clear in ", configPath)
+		return nil
+	}
+	sealedKey, err := common.SealLicenseKey(rawKey, baseFolder)
+	if err != nil {
+		return err
+	}
+
+	// Write a new file and rename it, so that the config is never half written
+	tempPath := filepath.Join(filepath.Dir(configPath), "Config.yml.sealing")
+	if err := ioutil.WriteFile(tempPath, common.ReplaceLicenseKey(configBytes, sealedKey), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, configPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	log.Info("Sealed the license key in ", configPath)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palette-software/palette-updater/common"
+)
+
+const (
+	defaultLogLevelExpiry = time.Hour
+	defaultUploadLogLines = 1000
+	maxUploadLogLines     = 100000
+)
+
+// Log files which can be uploaded by the UPLOAD-LOGS command
+var uploadableLogFiles = map[string]string{
+	"watchdog": "watchdog.log",
+	"manager":  "manager.log",
+}
+
+// Params: "level" (debug, info, warning or error) and "expiry" (e.g. "30m", defaults to 1h)
+func performSetLogLevel(params map[string]string) error {
+	expiry := defaultLogLevelExpiry
+	if expiryParam, ok := params["expiry"]; ok {
+		var err error
+		expiry, err = time.ParseDuration(expiryParam)
+		if err != nil {
+			return fmt.Errorf("Invalid log level expiry: %s Error: %v", expiryParam, err)
+		}
+	}
+	return common.SetLogLevel(params["level"], expiry)
+}
+
+// Params: "file" (watchdog or manager, defaults to watchdog) and either "lines" (the number of
+// lines from the end of the file) or "since" and/or "until" (RFC3339 timestamps)
+func performUploadLogs(ctx context.Context, client *common.ApiClient, hostname string, params map[string]string) error {
+	logger := common.Log(ctx)
+	file := params["file"]
+	if len(file) == 0 {
+		file = "watchdog"
+	}
+	logFileName, ok := uploadableLogFiles[file]
+	if !ok {
+		return fmt.Errorf("Unknown log file: %s", file)
+	}
+	logPath := filepath.Join(baseFolder, "Logs", logFileName)
+
+	var lines []string
+	var err error
+	if len(params["since"]) > 0 || len(params["until"]) > 0 {
+		lines, err = readLogRange(logPath, params["since"], params["until"])
+	} else {
+		lineCount := defaultUploadLogLines
+		if linesParam, ok := params["lines"]; ok {
+			lineCount, err = strconv.Atoi(linesParam)
+			if err != nil || lineCount <= 0 || lineCount > maxUploadLogLines {
+				return fmt.Errorf("Invalid number of log lines: %s", linesParam)
+			}
+		}
+		lines, err = common.TailFile(logPath, lineCount)
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadFile, err := ioutil.TempFile(baseFolder, "upload-logs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(uploadFile.Name())
+	_, err = uploadFile.WriteString(strings.Join(lines, "\n"))
+	if closeErr := uploadFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("/logs?hostname=%s&file=%s", url.QueryEscape(hostname), url.QueryEscape(logFileName))
+	err = client.UploadFile(ctx, endpoint, uploadFile.Name())
+	if err != nil {
+		return err
+	}
+	logger.Infof("Uploaded %d lines of %s", len(lines), logFileName)
+	return nil
+}
+
+func readLogRange(logPath, sinceParam, untilParam string) ([]string, error) {
+	var since, until time.Time
+	var err error
+	if len(sinceParam) > 0 {
+		if since, err = time.Parse(time.RFC3339, sinceParam); err != nil {
+			return nil, fmt.Errorf("Invalid since timestamp: %s Error: %v", sinceParam, err)
+		}
+	}
+	if len(untilParam) > 0 {
+		if until, err = time.Parse(time.RFC3339, untilParam); err != nil {
+			return nil, fmt.Errorf("Invalid until timestamp: %s Error: %v", untilParam, err)
+		}
+	}
+
+	file, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	// Request and response dumps may make some lines really long
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	lines = common.FilterLogLines(lines, since, until)
+	if len(lines) > maxUploadLogLines {
+		lines = lines[len(lines)-maxUploadLogLines:]
+	}
+	return lines, nil
+}
@@ -31,6 +31,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -62,7 +63,8 @@ func usage(errormsg string) {
 		"%s\n\n"+
 			"usage: %s <command>\n"+
 			"       where <command> is one of\n"+
-			"       install, remove, debug, start or stop.\n",
+			"       install, remove, debug, start, stop, diagnostics [zip file], seal-license-key\n"+
+			"       or audit verify [audit log].\n",
 		errormsg, os.Args[0])
 	os.Exit(2)
 }
@@ -102,6 +104,7 @@ func main() {
 	}
 
 	log.Info("Base folder is: ", baseFolder)
+	openAuditLog()
 
 	if len(os.Args) < 2 {
 		usage("no command specified")
@@ -110,18 +113,34 @@ func main() {
 	// Instantiate the service controller
 	var serviceControl svcControl.ServiceControl
 
+	cliCtx := withInitiator(context.Background(), cliInitiator())
 	cmd := strings.ToLower(os.Args[1])
 	switch cmd {
 	case "debug":
 		runService(common.WatchdogSvcName, true)
 	case "install":
 		err = serviceControl.Install(common.WatchdogSvcName, common.WatchdogSvcDisplayName, common.WatchdogSvcDescription)
+		recordAudit(cliCtx, "watchdog-install", err)
 	case "remove":
 		err = serviceControl.Remove(common.WatchdogSvcName)
+		recordAudit(cliCtx, "watchdog-remove", err)
 	case "start":
 		err = serviceControl.Start(common.WatchdogSvcName)
+		recordAudit(cliCtx, "watchdog-start", err)
 	case "stop":
 		err = serviceControl.Stop(common.WatchdogSvcName)
+		recordAudit(cliCtx, "watchdog-stop", err)
+	case "diagnostics":
+		var zipPath string
+		if len(os.Args) > 2 {
+			zipPath = os.Args[2]
+		}
+		err = runDiagnostics(zipPath)
+	case "seal-license-key":
+		err = sealConfigLicenseKey()
+		recordAudit(cliCtx, "license-key-sealed", err)
+	case "audit":
+		err = runAuditCommand(os.Args[2:])
 	case "is":
 		// In this case there needs to be more command line arguments, such as "auto-started"
 		if len(os.Args) < 3 {
@@ -158,7 +177,7 @@ func main() {
 
 // Make sure that Watchdog stops in a timely fashion. This is really important because it is
 // running as a service, and if the service fails to stop it can mess up our Palette Insight
-// Agent update process.
+// Agent update process. Running jobs are cancelled on stop, so this is only the last resort.
 func shutdownInTime() {
 	go func() {
 		tickShutdown := time.Tick(shutdownTimer)
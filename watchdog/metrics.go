@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+)
+
+const defaultMetricsPort = 9211
+
+// Metrics of the watchdog jobs
+var (
+	updateChecks = common.NewCounter("palette_watchdog_update_checks_total",
+		"Number of agent update checks by result.", "result")
+	verificationFailures = common.NewCounter("palette_watchdog_update_verification_failures_total",
+		"Number of downloaded update files which failed verification.", "algorithm")
+	agentRestarts = common.NewCounter("palette_watchdog_agent_restarts_total",
+		"Number of agent restarts performed by the alive check.")
+	crashLoops = common.NewCounter("palette_watchdog_agent_crash_loops_total",
+		"Number of detected agent crash loops.")
+	commandsProcessed = common.NewCounter("palette_watchdog_commands_total",
+		"Number of remote commands processed by type and result.", "command", "result")
+	managerResults = common.NewCounter("palette_watchdog_manager_results_total",
+		"Number of manager commands by command and result class.", "command", "class")
+	healthCheckFailures = common.NewCounter("palette_watchdog_health_check_failures_total",
+		"Number of failed agent health checks by probe.", "probe")
+	agentMemoryBytes = common.NewGauge("palette_watchdog_agent_memory_bytes",
+		"Resident memory of the agent process at the last sample.")
+	agentCpuPercent = common.NewGauge("palette_watchdog_agent_cpu_percent",
+		"CPU usage of the agent process between the last two samples in percent of a core.")
+	agentHandles = common.NewGauge("palette_watchdog_agent_handles",
+		"Open handles (file descriptors on Linux) of the agent process at the last sample.")
+	resourceLimitBreaches = common.NewCounter("palette_watchdog_agent_resource_limit_breaches_total",
+		"Number of agent resource samples exceeding a limit by resource.", "resource")
+	policyDenials = common.NewCounter("palette_watchdog_policy_denials_total",
+		"Number of remote commands and updates denied by the local policy by action.", "action")
+)
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// Starts serving the metrics in Prometheus text format. The returned listener needs
+// to be closed in order to stop serving requests.
+func startMetricsServer(config common.Metrics) (net.Listener, error) {
+	address := config.ListenAddress
+	if len(address) == 0 {
+		address = "127.0.0.1"
+	}
+	port := config.Port
+	if port == 0 {
+		port = defaultMetricsPort
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		log.Errorf("Failed to listen on %s:%d for metrics! Error: %v", address, port, err)
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		common.WriteMetrics(w)
+	})
+
+	go func() {
+		// Serve returns with an error when the listener gets closed
+		err := http.Serve(listener, mux)
+		log.Debug("Metrics server stopped serving requests: ", err)
+	}()
+
+	log.Info("Metrics are served on ", listener.Addr())
+	return listener, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/palette-software/palette-updater/common"
+)
+
+// Reported to the Insight Server when the local policy denies a remote command or an update
+type policyDenial struct {
+	Hostname       string    `json:"hostname"`
+	Action         string    `json:"action"`
+	Command        string    `json:"command,omitempty"`
+	CommandId      string    `json:"commandId,omitempty"`
+	Version        string    `json:"version,omitempty"`
+	CurrentVersion string    `json:"currentVersion,omitempty"`
+	Reason         string    `json:"reason"`
+	Time           time.Time `json:"time"`
+}
+
+// The same update is denied in every update check, but it is reported only once. Only the last
+// denial of each action is remembered, so that the memory use does not grow.
+var reportedDenials = struct {
+	sync.Mutex
+	lastByAction map[string]string
+}{lastByAction: make(map[string]string)}
+
+// Reads the local policy. It is read every time, so that changes apply without a restart.
+func loadPolicy(ctx context.Context) common.Policy {
+	policy, err := common.LoadPolicy(baseFolder)
+	if err != nil {
+		common.Log(ctx).Error(err)
+	}
+	return policy
+}
+
+// Logs, audits and reports a denied action to the Insight Server, unless the previous denial of
+// the action had the same key
+func reportPolicyDenial(ctx context.Context, client *common.ApiClient, key string, denial policyDenial) {
+	reportedDenials.Lock()
+	reported := reportedDenials.lastByAction[denial.Action] == key
+	reportedDenials.lastByAction[denial.Action] = key
+	reportedDenials.Unlock()
+	if reported {
+		return
+	}
+
+	logger := common.Log(ctx)
+	logger.Warning(denial.Reason)
+	policyDenials.Inc(denial.Action)
+	recordAudit(ctx, "policy-denied", nil, "action", denial.Action, "command", denial.Command,
+		"version", denial.Version, "reason", denial.Reason)
+
+	denial.Hostname, _ = os.Hostname()
+	denial.Time = time.Now()
+	if client == nil {
+		return
+	}
+	if err := client.PostJSON(ctx, "/alerts/policy-denied", denial); err != nil {
+		logger.Error("Failed to report policy denial to the Insight Server! Error: ", err)
+	}
+}
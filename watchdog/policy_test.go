@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/palette-software/palette-updater/common"
+)
+
+func TestReportPolicyDenial_repeated(t *testing.T) {
+	var reports int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/alerts/policy-denied" {
+			reports++
+		}
+	}))
+	defer server.Close()
+	var config common.Config
+	config.Webservice.Endpoint = server.URL
+	client, err := common.NewApiClientWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"2.0.0", "2.0.0", "2.1.0", "2.1.0", "2.0.0"} {
+		reportPolicyDenial(context.Background(), client, version, policyDenial{Action: "update", Version: version})
+	}
+	if reports != 3 {
+		t.Fatalf("Reported %d denials instead of 3", reports)
+	}
+	if last := reportedDenials.lastByAction["update"]; last != "2.0.0" {
+		t.Fatalf("Remembered %s instead of the last denied update", last)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/palette-software/palette-updater/common"
+	procStats "github.com/palette-software/palette-updater/process_stats"
+	svcControl "github.com/palette-software/palette-updater/service_control"
+	servdis "github.com/palette-software/palette-updater/services-discovery"
+)
+
+// Resource limit defaults
+const (
+	defaultResourceSampleInterval = time.Minute
+	defaultResourceLogInterval    = 15 * time.Minute
+	defaultResourceTolerance      = 3
+)
+
+// Samples the resource usage of the agent process. Only used by the resource monitor job,
+// which never runs in parallel with itself.
+type resourceMonitor struct {
+	limits         common.ResourceLimits
+	sampleInterval time.Duration
+	logInterval    time.Duration
+	tolerance      int
+
+	// CPU usage is calculated from the difference of two samples
+	previous     *procStats.Stats
+	breachStreak int
+	lastLogged   time.Time
+}
+
+func newResourceMonitor(limits common.ResourceLimits) *resourceMonitor {
+	monitor := &resourceMonitor{
+		limits:         limits,
+		sampleInterval: limits.SampleInterval,
+		logInterval:    limits.LogInterval,
+		tolerance:      limits.Tolerance,
+	}
+	if monitor.sampleInterval <= 0 {
+		monitor.sampleInterval = defaultResourceSampleInterval
+	}
+	if monitor.logInterval <= 0 {
+		monitor.logInterval = defaultResourceLogInterval
+	}
+	if monitor.tolerance <= 0 {
+		monitor.tolerance = defaultResourceTolerance
+	}
+	return monitor
+}
+
+// Records the sample and returns the limits it breaches by resource name
+func (m *resourceMonitor) sample(stats procStats.Stats) map[string]string {
+	previous := m.previous
+	m.previous = &stats
+
+	breaches := make(map[string]string)
+	memoryMB := stats.MemoryBytes / 1024 / 1024
+	if m.limits.MaxMemoryMB > 0 && memoryMB > uint64(m.limits.MaxMemoryMB) {
+		breaches["memory"] = fmt.Sprintf("memory usage is %d MB, the limit is %d MB", memoryMB, m.limits.MaxMemoryMB)
+	}
+	if m.limits.MaxHandles > 0 && stats.Handles > m.limits.MaxHandles {
+		breaches["handles"] = fmt.Sprintf("%d handles are open, the limit is %d", stats.Handles, m.limits.MaxHandles)
+	}
+	if previous != nil {
+		cpuPercent := procStats.CpuPercent(*previous, stats)
+		agentCpuPercent.Set(cpuPercent)
+		if m.limits.MaxCpuPercent > 0 && cpuPercent > m.limits.MaxCpuPercent {
+			breaches["cpu"] = fmt.Sprintf("CPU usage is %.1f%%, the limit is %.1f%%", cpuPercent, m.limits.MaxCpuPercent)
+		}
+	}
+	agentMemoryBytes.Set(float64(stats.MemoryBytes))
+	agentHandles.Set(float64(stats.Handles))
+
+	if len(breaches) > 0 {
+		m.breachStreak++
+	} else {
+		m.breachStreak = 0
+	}
+	return breaches
+}
+
+func (pws *paletteWatchdogService) checkResources(ctx context.Context) error {
+	logger := common.Log(ctx)
+	if pws.status.getLastCommand().Cmd == "stop" {
+		logger.Debugf("Skipped resource check for %s, since it is commanded to be stopped.", common.AgentSvcName)
+		return nil
+	}
+	monitor := pws.resources
+	now := time.Now()
+
+	pid, err := servdis.GetServiceProcessId(common.AgentSvcName)
+	if err != nil {
+		// Restarting a stopped agent is the job of the alive check
+		monitor.previous = nil
+		monitor.breachStreak = 0
+		return err
+	}
+	stats, err := procStats.GetStats(pid)
+	if err != nil {
+		logger.Errorf("Failed to get resource usage of %s! Error: %v", common.AgentSvcName, err)
+		return err
+	}
+
+	breaches := monitor.sample(stats)
+	if time.Since(monitor.lastLogged) >= monitor.logInterval {
+		monitor.lastLogged = time.Now()
+		logger.Infof("Resource usage of %s (pid %d): memory: %d MB, CPU time: %v, handles: %d", common.AgentSvcName,
+			pid, stats.MemoryBytes/1024/1024, stats.CpuTime, stats.Handles)
+	}
+	for resource, breach := range breaches {
+		logger.Warningf("%s exceeds its %s limit (%d/%d): %s", common.AgentSvcName, resource,
+			monitor.breachStreak, monitor.tolerance, breach)
+		resourceLimitBreaches.Inc(resource)
+	}
+	if monitor.breachStreak < monitor.tolerance {
+		return nil
+	}
+
+	if inBackoff, until := pws.crashLoop.InBackoff(now); inBackoff {
+		logger.Errorf("%s exceeds its resource limits, but restarts are backed off until %s because of a crash loop.",
+			common.AgentSvcName, until.Format(time.RFC3339))
+		return nil
+	}
+	monitor.previous = nil
+	monitor.breachStreak = 0
+	var serviceControl svcControl.ServiceControl
+	return pws.restartAgentOnce(ctx, now, func() {
+		restartAgentGracefully(ctx, serviceControl, "it exceeded its resource limits")
+	})
+}
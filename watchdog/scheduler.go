@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+)
+
+// The number of past runs kept for each job
+const jobHistoryLength = 10
+
+// Tells what to do if a job is due while its previous run is still in progress
+type overlapPolicy int
+
+const (
+	// Drop the run
+	skipIfRunning overlapPolicy = iota
+	// Run once more right after the running one finishes
+	queueIfRunning
+)
+
+type job struct {
+	name     string
+	interval time.Duration
+	// The context of the job gets cancelled after this much time
+	timeout time.Duration
+	policy  overlapPolicy
+	run     func(ctx context.Context) error
+
+	trigger chan struct{}
+
+	mutex   sync.Mutex
+	running bool
+	queued  bool
+	nextRun time.Time
+	history []jobRun
+}
+
+type jobRun struct {
+	Trigger string `json:"trigger"`
+	// Appears in every log line of the run, including the ones of the manager
+	OperationId string    `json:"operationId,omitempty"`
+	Start       time.Time `json:"start"`
+	Duration    string    `json:"duration"`
+	Skipped     bool      `json:"skipped,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+type jobReport struct {
+	Name     string    `json:"name"`
+	Interval string    `json:"interval"`
+	Running  bool      `json:"running"`
+	NextRun  time.Time `json:"nextRun"`
+	History  []jobRun  `json:"history"`
+}
+
+// Runs the registered jobs periodically, making sure that a job never runs in parallel with itself
+type scheduler struct {
+	jobs    []*job
+	running sync.WaitGroup
+}
+
+func (s *scheduler) add(j *job) {
+	j.trigger = make(chan struct{}, 1)
+	s.jobs = append(s.jobs, j)
+}
+
+func (s *scheduler) find(name string) *job {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// Starts scheduling the jobs until the context gets cancelled
+func (s *scheduler) start(ctx context.Context) {
+	for _, j := range s.jobs {
+		go s.schedule(ctx, j)
+	}
+}
+
+// Requests an immediate run of the job
+func (s *scheduler) runNow(name string) error {
+	j := s.find(name)
+	if j == nil {
+		return fmt.Errorf("Unknown job: %s", name)
+	}
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+		// There is already a pending request
+	}
+	return nil
+}
+
+func (s *scheduler) schedule(ctx context.Context, j *job) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	j.setNextRun(time.Now().Add(j.interval))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.setNextRun(time.Now().Add(j.interval))
+			s.dispatch(ctx, j, "schedule")
+		case <-j.trigger:
+			s.dispatch(ctx, j, "manual")
+		}
+	}
+}
+
+func (s *scheduler) dispatch(ctx context.Context, j *job, trigger string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.running {
+		if j.policy == queueIfRunning {
+			log.Debugf("Job %s is still running. Queued the next run.", j.name)
+			j.queued = true
+			return
+		}
+		log.Infof("Job %s is still running. Skipped the next run.", j.name)
+		j.record(jobRun{Trigger: trigger, Start: time.Now(), Skipped: true})
+		return
+	}
+
+	j.running = true
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		for {
+			j.execute(ctx, trigger)
+
+			j.mutex.Lock()
+			if !j.queued || ctx.Err() != nil {
+				j.running = false
+				j.queued = false
+				j.mutex.Unlock()
+				return
+			}
+			j.queued = false
+			j.mutex.Unlock()
+			trigger = "queued"
+		}
+	}()
+}
+
+// Waits until the running jobs finish, but at most for the given time
+func (s *scheduler) wait(timeout time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		log.Debug("All running jobs have finished.")
+	case <-time.After(timeout):
+		log.Warning("Running jobs did not finish in time after cancellation.")
+	}
+}
+
+func (s *scheduler) report() []jobReport {
+	reports := make([]jobReport, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		reports = append(reports, j.report())
+	}
+	return reports
+}
+
+type serviceContextKey struct{}
+
+// Returns the context of the service, which is only cancelled when the service stops. Commands
+// which have to finish even if the job times out wait on this one.
+func serviceContext(ctx context.Context) context.Context {
+	if serviceCtx, ok := ctx.Value(serviceContextKey{}).(context.Context); ok {
+		return serviceCtx
+	}
+	return ctx
+}
+
+func (j *job) execute(ctx context.Context, trigger string) {
+	ctx = context.WithValue(ctx, serviceContextKey{}, ctx)
+	if j.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+		defer cancel()
+	}
+
+	operationId := common.NewOperationId()
+	ctx = common.WithOperationId(ctx, operationId)
+	common.Log(ctx).Debugf("Running job %s (trigger: %s)", j.name, trigger)
+
+	start := time.Now()
+	err := j.run(ctx)
+	run := jobRun{
+		Trigger:     trigger,
+		OperationId: operationId,
+		Start:       start,
+		Duration:    time.Since(start).String(),
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.record(run)
+}
+
+// Needs to be called with the mutex held
+func (j *job) record(run jobRun) {
+	j.history = append(j.history, run)
+	if len(j.history) > jobHistoryLength {
+		j.history = j.history[len(j.history)-jobHistoryLength:]
+	}
+}
+
+func (j *job) setNextRun(next time.Time) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.nextRun = next
+}
+
+// Returns the last completed (not skipped) run, if there is any
+func (j *job) lastRun() (jobRun, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for i := len(j.history) - 1; i >= 0; i-- {
+		if !j.history[i].Skipped {
+			return j.history[i], true
+		}
+	}
+	return jobRun{}, false
+}
+
+func (j *job) report() jobReport {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return jobReport{
+		Name:     j.name,
+		Interval: j.interval.String(),
+		Running:  j.running,
+		NextRun:  j.nextRun,
+		History:  append([]jobRun(nil), j.history...),
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs the job, which blocks until released
+func blockingJob(policy overlapPolicy) (*job, chan struct{}, *int) {
+	release := make(chan struct{})
+	runs := 0
+	var mutex sync.Mutex
+	j := &job{
+		name:     "test",
+		interval: time.Hour,
+		policy:   policy,
+		run: func(ctx context.Context) error {
+			mutex.Lock()
+			runs++
+			mutex.Unlock()
+			<-release
+			return nil
+		},
+	}
+	return j, release, &runs
+}
+
+func TestScheduler_skipIfRunning(t *testing.T) {
+	var s scheduler
+	j, release, runs := blockingJob(skipIfRunning)
+	s.add(j)
+
+	ctx := context.Background()
+	s.dispatch(ctx, j, "manual")
+	s.dispatch(ctx, j, "manual")
+	close(release)
+	s.wait(time.Second)
+
+	if *runs != 1 {
+		t.Fatalf("Job ran %d times instead of once", *runs)
+	}
+	history := j.report().History
+	if len(history) != 2 || !history[0].Skipped || history[1].Skipped {
+		t.Fatalf("Unexpected history: %v", history)
+	}
+}
+
+func TestScheduler_queueIfRunning(t *testing.T) {
+	var s scheduler
+	j, release, runs := blockingJob(queueIfRunning)
+	s.add(j)
+
+	ctx := context.Background()
+	s.dispatch(ctx, j, "manual")
+	// Multiple requests during a run are collapsed into a single queued run
+	s.dispatch(ctx, j, "manual")
+	s.dispatch(ctx, j, "manual")
+	close(release)
+	s.wait(time.Second)
+
+	if *runs != 2 {
+		t.Fatalf("Job ran %d times instead of twice", *runs)
+	}
+	if last, _ := j.lastRun(); last.Trigger != "queued" {
+		t.Fatalf("Last run was triggered by %s instead of the queue", last.Trigger)
+	}
+}
+
+func TestScheduler_timeout(t *testing.T) {
+	var s scheduler
+	s.add(&job{
+		name:     "slow",
+		interval: time.Hour,
+		timeout:  10 * time.Millisecond,
+		run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	s.dispatch(context.Background(), s.find("slow"), "manual")
+	s.wait(time.Second)
+
+	last, ok := s.find("slow").lastRun()
+	if !ok || last.Error != context.DeadlineExceeded.Error() {
+		t.Fatalf("Job did not time out: %v", last)
+	}
+}
+
+func TestScheduler_historyLength(t *testing.T) {
+	var s scheduler
+	s.add(&job{name: "quick", interval: time.Hour, run: func(ctx context.Context) error { return nil }})
+
+	for i := 0; i < jobHistoryLength+5; i++ {
+		s.dispatch(context.Background(), s.find("quick"), "manual")
+		s.wait(time.Second)
+	}
+
+	if length := len(s.find("quick").report().History); length != jobHistoryLength {
+		t.Fatalf("History has %d entries instead of %d", length, jobHistoryLength)
+	}
+}
+
+func TestJob_serviceContextOutlivesTimeout(t *testing.T) {
+	serviceCtx, cancel := context.WithCancel(context.Background())
+	var jobDeadline, serviceDeadline bool
+	var fromService context.Context
+	j := &job{
+		name:    "test",
+		timeout: time.Minute,
+		run: func(ctx context.Context) error {
+			_, jobDeadline = ctx.Deadline()
+			fromService = serviceContext(ctx)
+			_, serviceDeadline = fromService.Deadline()
+			return nil
+		},
+	}
+	j.execute(serviceCtx, "manual")
+
+	if !jobDeadline || serviceDeadline {
+		t.Fatalf("Expected a deadline only for the job (job: %v, service: %v)", jobDeadline, serviceDeadline)
+	}
+	cancel()
+	if fromService.Err() == nil {
+		t.Fatal("Expected the service context to be cancelled with the service")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	insight "github.com/palette-software/insight-server/lib"
+	log "github.com/palette-software/go-log-targets"
+	"github.com/palette-software/palette-updater/common"
+	svcControl "github.com/palette-software/palette-updater/service_control"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+const defaultStatusApiPort = 9210
+
+// The token of the POST endpoints is kept next to Config.yml, but not in it, so that a remote
+// config cannot change it
+const statusApiTokenFileName = "StatusApi.token"
+
+// Holds what the watchdog has been doing recently, so that it can be reported by the status API.
+type watchdogStatus struct {
+	mutex sync.Mutex
+
+	startTime       time.Time
+	lastCommand     insight.AgentCommand
+	lastCommandTime time.Time
+	// The last command handled, even if it was denied, so that it is not handled again
+	lastSeenCommand insight.AgentCommand
+}
+
+type statusReport struct {
+	StartTime       time.Time            `json:"startTime"`
+	AgentService    string               `json:"agentService"`
+	LastCommand     insight.AgentCommand `json:"lastCommand"`
+	LastCommandTime *time.Time           `json:"lastCommandTime"`
+	LastUpdateCheck *jobRun              `json:"lastUpdateCheck"`
+	Jobs            []jobReport          `json:"jobs"`
+	ConfigSource    string               `json:"configSource"`
+}
+
+func (ws *watchdogStatus) setLastCommand(command insight.AgentCommand) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.lastCommand = command
+	ws.lastCommandTime = time.Now()
+	ws.lastSeenCommand = command
+}
+
+func (ws *watchdogStatus) getLastCommand() insight.AgentCommand {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	return ws.lastCommand
+}
+
+// Records a command which was not performed
+func (ws *watchdogStatus) setLastSeenCommand(command insight.AgentCommand) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.lastSeenCommand = command
+}
+
+func (ws *watchdogStatus) getLastSeenCommand() insight.AgentCommand {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	return ws.lastSeenCommand
+}
+
+func (ws *watchdogStatus) report() statusReport {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	report := statusReport{
+		StartTime:   ws.startTime,
+		LastCommand: ws.lastCommand,
+	}
+	if !ws.lastCommandTime.IsZero() {
+		lastCommandTime := ws.lastCommandTime
+		report.LastCommandTime = &lastCommandTime
+	}
+	return report
+}
+
+func serviceStateToString(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "stopped"
+	case svc.StartPending:
+		return "start-pending"
+	case svc.StopPending:
+		return "stop-pending"
+	case svc.Running:
+		return "running"
+	case svc.ContinuePending:
+		return "continue-pending"
+	case svc.PausePending:
+		return "pause-pending"
+	case svc.Paused:
+		return "paused"
+	}
+	return fmt.Sprintf("unknown (%d)", state)
+}
+
+// Starts the loopback-only status API. The returned listener needs to be closed
+// in order to stop serving requests.
+func (pws *paletteWatchdogService) startStatusApi(config common.StatusApi) (net.Listener, error) {
+	port := config.Port
+	if port == 0 {
+		port = defaultStatusApiPort
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		log.Errorf("Failed to listen on port %d for status API! Error: %v", port, err)
+		return nil, err
+	}
+
+	handler := pws.statusApiHandler(filepath.Join(baseFolder, "Config", statusApiTokenFileName))
+
+	go func() {
+		// Serve returns with an error when the listener gets closed
+		err := http.Serve(listener, handler)
+		log.Debug("Status API stopped serving requests: ", err)
+	}()
+
+	log.Info("Status API is listening on ", listener.Addr())
+	return listener, nil
+}
+
+func (pws *paletteWatchdogService) statusApiHandler(tokenPath string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", pws.handleStatus)
+	mux.HandleFunc("/update-check", requireToken(tokenPath, func() {
+		pws.scheduler.runNow(updateJobName)
+	}))
+	mux.HandleFunc("/command-poll", requireToken(tokenPath, func() {
+		pws.scheduler.runNow(commandJobName)
+	}))
+	return mux
+}
+
+func (pws *paletteWatchdogService) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := pws.status.report()
+	report.Jobs = pws.scheduler.report()
+	if lastUpdateCheck, ok := pws.scheduler.find(updateJobName).lastRun(); ok {
+		report.LastUpdateCheck = &lastUpdateCheck
+	}
+	report.ConfigSource, _ = common.FindAgentConfigFile(baseFolder)
+
+	var serviceControl svcControl.ServiceControl
+	svcStatus, err := serviceControl.Query(common.AgentSvcName)
+	if err != nil {
+		report.AgentService = fmt.Sprintf("unknown (%v)", err)
+	} else {
+		report.AgentService = serviceStateToString(svcStatus.State)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error("Failed to write status API response! Error: ", err)
+	}
+}
+
+// Returns the token of the status API, or an empty string if there is none
+func readStatusApiToken(tokenPath string) string {
+	tokenBytes, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to read status API token from %s! Error: %v", tokenPath, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(tokenBytes))
+}
+
+// Wraps an action into a handler which only accepts POST requests authenticated with the token
+// of the file. The file is read by every request, so the token can be changed without a restart.
+func requireToken(tokenPath string, action func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := readStatusApiToken(tokenPath)
+		if len(token) == 0 {
+			http.Error(w, "No token is configured for the status API", http.StatusForbidden)
+			return
+		}
+		expected := []byte(fmt.Sprintf("Token %s", token))
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			log.Warningf("Unauthorized status API request: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		log.Infof("Status API request: %s %s", r.Method, r.URL.Path)
+		action()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
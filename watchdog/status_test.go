@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A watchdog whose jobs are not started, so the requested runs stay pending
+func newStatusApiTestService() *paletteWatchdogService {
+	pws := &paletteWatchdogService{}
+	for _, name := range []string{updateJobName, commandJobName} {
+		pws.scheduler.add(&job{name: name, interval: time.Hour})
+	}
+	return pws
+}
+
+// Writes the token file into a temporary folder. No file is written for an empty token.
+func tempTokenFile(t *testing.T, token string) (string, func()) {
+	folder, err := ioutil.TempDir("", "status-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(folder, statusApiTokenFileName)
+	if len(token) > 0 {
+		if err := ioutil.WriteFile(path, []byte(token+"\r\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, func() { os.RemoveAll(folder) }
+}
+
+// Sends the request to the status API, and returns the status code and whether the job was triggered
+func statusApiRequest(t *testing.T, tokenPath, method, path, authorization string) (int, bool) {
+	pws := newStatusApiTestService()
+	req := httptest.NewRequest(method, path, nil)
+	if len(authorization) > 0 {
+		req.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	pws.statusApiHandler(tokenPath).ServeHTTP(recorder, req)
+
+	jobName := updateJobName
+	if path == "/command-poll" {
+		jobName = commandJobName
+	}
+	return recorder.Code, len(pws.scheduler.find(jobName).trigger) > 0
+}
+
+var statusApiPostPaths = []string{"/update-check", "/command-poll"}
+
+func TestStatusApi_validToken(t *testing.T) {
+	tokenPath, cleanup := tempTokenFile(t, "secret")
+	defer cleanup()
+
+	for _, path := range statusApiPostPaths {
+		code, triggered := statusApiRequest(t, tokenPath, http.MethodPost, path, "Token secret")
+		if code != http.StatusAccepted || !triggered {
+			t.Errorf("POST %s: expected status %d, got %d (triggered: %v)", path, http.StatusAccepted, code, triggered)
+		}
+	}
+}
+
+func TestStatusApi_missingOrWrongToken(t *testing.T) {
+	tokenPath, cleanup := tempTokenFile(t, "secret")
+	defer cleanup()
+
+	for _, path := range statusApiPostPaths {
+		for _, testCase := range []struct {
+			method        string
+			authorization string
+			code          int
+		}{
+			{http.MethodPost, "", http.StatusUnauthorized},
+			{http.MethodPost, "Token wrong", http.StatusUnauthorized},
+			{http.MethodPost, "Token secretsecret", http.StatusUnauthorized},
+			{http.MethodPost, "Bearer secret", http.StatusUnauthorized},
+			{http.MethodGet, "Token secret", http.StatusMethodNotAllowed},
+		} {
+			code, triggered := statusApiRequest(t, tokenPath, testCase.method, path, testCase.authorization)
+			if code != testCase.code || triggered {
+				t.Errorf("%s %s with %q: expected status %d, got %d (triggered: %v)",
+					testCase.method, path, testCase.authorization, testCase.code, code, triggered)
+			}
+		}
+	}
+}
+
+func TestStatusApi_withoutTokenFile(t *testing.T) {
+	tokenPath, cleanup := tempTokenFile(t, "")
+	defer cleanup()
+
+	for _, path := range statusApiPostPaths {
+		for _, authorization := range []string{"", "Token ", "Token secret"} {
+			code, triggered := statusApiRequest(t, tokenPath, http.MethodPost, path, authorization)
+			if code != http.StatusForbidden || triggered {
+				t.Errorf("POST %s with %q: expected status %d, got %d (triggered: %v)",
+					path, authorization, http.StatusForbidden, code, triggered)
+			}
+		}
+	}
+}
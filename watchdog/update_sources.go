@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/palette-software/palette-updater/common"
+
+	gocp "github.com/cleversoap/go-cp"
+)
+
+// Older Insight Servers do not serve the update manifest. Once the API client has seen that,
+// there is no need to ask again. A new client, e.g. for another Insight Server, asks again.
+var manifestUnsupported = struct {
+	sync.Mutex
+	client *common.ApiClient
+}{}
+
+func isManifestUnsupported(client *common.ApiClient) bool {
+	manifestUnsupported.Lock()
+	defer manifestUnsupported.Unlock()
+	return manifestUnsupported.client == client
+}
+
+func setManifestUnsupported(client *common.ApiClient) {
+	manifestUnsupported.Lock()
+	defer manifestUnsupported.Unlock()
+	manifestUnsupported.client = client
+}
+
+// Source of the agent updates
+type updateSource interface {
+	getLatestArtifact(ctx context.Context, product string) (common.UpdateArtifact, error)
+	// Places the given artifact to destinationPath
+	fetch(ctx context.Context, artifact common.UpdateArtifact, destinationPath string) error
+	String() string
+}
+
+// Returns the folder based update source if it is configured, otherwise the Insight Server
+func newUpdateSource(config common.Config) (updateSource, error) {
+	offlineFolder := config.Watchdog.Updates.OfflineFolder
+	if len(offlineFolder) > 0 {
+		return &folderUpdateSource{folder: offlineFolder}, nil
+	}
+
+	client, err := common.SharedApiClientWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &serverUpdateSource{client: client}, nil
+}
+
+type serverUpdateSource struct {
+	client *common.ApiClient
+}
+
+func (s *serverUpdateSource) getLatestArtifact(ctx context.Context, product string) (common.UpdateArtifact, error) {
+	logger := common.Log(ctx)
+	if !isManifestUnsupported(s.client) {
+		manifest, err := getUpdateManifest(ctx, s.client)
+		if err == nil {
+			return manifest.FindArtifact(product, runtime.GOOS, runtime.GOARCH)
+		}
+		if !common.IsNotFound(err) {
+			return common.UpdateArtifact{}, err
+		}
+		logger.Info("Insight Server does not serve update manifest. Falling back to the legacy version endpoint.")
+		setManifestUnsupported(s.client)
+	}
+
+	latestUpdate, err := getLatestVersion(ctx, s.client)
+	if err != nil {
+		return common.UpdateArtifact{}, err
+	}
+	return common.LegacyUpdateArtifact(product, latestUpdate), nil
+}
+
+func (s *serverUpdateSource) fetch(ctx context.Context, artifact common.UpdateArtifact, destinationPath string) error {
+	return s.client.DownloadFile(ctx, artifact.Url, destinationPath)
+}
+
+func (s *serverUpdateSource) String() string {
+	return "Insight Server"
+}
+
+// Reads updates from a local folder or a network share (UNC or NFS path)
+type folderUpdateSource struct {
+	folder string
+}
+
+func (s *folderUpdateSource) getLatestArtifact(ctx context.Context, product string) (common.UpdateArtifact, error) {
+	artifact, err := common.FindOfflineArtifact(ctx, s.folder, product, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		common.Log(ctx).Error(err)
+		return common.UpdateArtifact{}, err
+	}
+	common.Log(ctx).Infof("Latest available version in %s: %s", s.folder, artifact.Version)
+	return artifact, nil
+}
+
+func (s *folderUpdateSource) fetch(ctx context.Context, artifact common.UpdateArtifact, destinationPath string) error {
+	logger := common.Log(ctx)
+	// Copying cannot be interrupted, but at least do not start it if we are being stopped
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sourcePath := artifact.Url
+	if !filepath.IsAbs(sourcePath) {
+		sourcePath = filepath.Join(s.folder, sourcePath)
+	}
+
+	err := os.MkdirAll(filepath.Dir(destinationPath), 0777)
+	if err != nil {
+		logger.Errorf("Failed to create folders for path: '%s' Error: %v", destinationPath, err)
+		return err
+	}
+
+	err = gocp.Copy(sourcePath, destinationPath)
+	if err != nil {
+		logger.Errorf("Failed to copy offline update file: %s to %s! Error: %v", sourcePath, destinationPath, err)
+		return err
+	}
+	return nil
+}
+
+func (s *folderUpdateSource) String() string {
+	return fmt.Sprintf("offline folder %s", s.folder)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/palette-software/palette-updater/common"
+)
+
+func TestNewUpdateSource_offlineFolder(t *testing.T) {
+	var config common.Config
+	config.Webservice.Endpoint = "https://insight.example.com"
+	config.Watchdog.Updates.OfflineFolder = `\\fileserver\palette-updates`
+
+	source, err := newUpdateSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folderSource, ok := source.(*folderUpdateSource)
+	if !ok || folderSource.folder != config.Watchdog.Updates.OfflineFolder {
+		t.Fatalf("Expected the offline folder as update source, got %v", source)
+	}
+}
+
+func TestNewUpdateSource_insightServer(t *testing.T) {
+	var config common.Config
+	config.Webservice.Endpoint = "https://insight.example.com"
+
+	source, err := newUpdateSource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := source.(*serverUpdateSource); !ok {
+		t.Fatalf("Expected the Insight Server as update source, got %v", source)
+	}
+}
+
+func TestServerUpdateSource_manifestUnsupportedPerClient(t *testing.T) {
+	manifestRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/updates/manifest":
+			manifestRequests++
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/v1/agent/version":
+			w.Write([]byte(`{"Major": 2, "Minor": 1, "Patch": 0, "Url": "/agent.msi"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var config common.Config
+	config.Webservice.Endpoint = server.URL
+	getLatest := func(client *common.ApiClient) {
+		source := &serverUpdateSource{client: client}
+		artifact, err := source.getLatestArtifact(context.Background(), "agent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if artifact.Version != "2.1.0" {
+			t.Fatalf("Expected the legacy version, got %s", artifact.Version)
+		}
+	}
+
+	client, err := common.NewApiClientWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getLatest(client)
+	getLatest(client)
+	if manifestRequests != 1 {
+		t.Fatalf("The client asked for the manifest %d times instead of once", manifestRequests)
+	}
+
+	// A new client, e.g. after the Insight Server changed, asks again
+	newClient, err := common.NewApiClientWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getLatest(newClient)
+	if manifestRequests != 2 {
+		t.Fatalf("The new client did not ask for the manifest")
+	}
+}
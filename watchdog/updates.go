@@ -1,154 +1,196 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
-	"strings"
 
 	insight "github.com/palette-software/insight-server/lib"
-	log "github.com/palette-software/go-log-targets"
 	"github.com/palette-software/palette-updater/common"
 	servdis "github.com/palette-software/palette-updater/services-discovery"
 )
 
-func getLatestVersion(client *common.ApiClient) (insight.UpdateVersion, error) {
-	log.Debugf("Getting latest agent version...")
+func getLatestVersion(ctx context.Context, client *common.ApiClient) (insight.UpdateVersion, error) {
+	logger := common.Log(ctx)
+	logger.Debugf("Getting latest agent version...")
 
 	version := insight.UpdateVersion{}
-	resp, err := client.Get("/agent/version")
+	body, changed, err := client.GetWithCache(ctx, "/agent/version")
 	if err != nil {
 		return version, err
 	}
 
 	// Decode the JSON in the response
-	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+	if err := json.Unmarshal(body, &version); err != nil {
 		return version, fmt.Errorf("Error while deserializing version response body. Error message: %v", err)
 	}
 
-	log.Info("Latest available version on Insight Server: ", version)
+	if changed {
+		logger.Info("Latest available version on Insight Server: ", version)
+	} else {
+		logger.Debug("Latest available version on Insight Server has not changed: ", version)
+	}
 	return version, nil
 }
 
-func getCurrentVersion(product string) (currentVersion insight.Version, err error) {
+func getUpdateManifest(ctx context.Context, client *common.ApiClient) (common.UpdateManifest, error) {
+	logger := common.Log(ctx)
+	logger.Debugf("Getting update manifest...")
+
+	manifest := common.UpdateManifest{}
+	body, _, err := client.GetWithCache(ctx, "/updates/manifest")
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return manifest, fmt.Errorf("Error while deserializing update manifest. Error message: %v", err)
+	}
+	return manifest, nil
+}
+
+func getCurrentVersion(ctx context.Context, product string) (insight.Version, error) {
+	logger := common.Log(ctx)
 	var svcToLookUp string
 
 	switch product {
 	case "agent":
 		svcToLookUp = common.AgentSvcName
 	default:
-		err = fmt.Errorf("Unexpected product! Failed to map %s to service name!", product)
-		log.Error(err)
-		return insight.Version{0, 0, 0}, err
+		err := fmt.Errorf("Unexpected product! Failed to map %s to service name!", product)
+		logger.Error(err)
+		return insight.Version{}, err
 	}
 
 	versionStr, err := servdis.GetServiceVersion(svcToLookUp)
 	if err != nil {
-		return insight.Version{0, 0, 0}, err
+		return insight.Version{}, err
 	}
 
-	// Handle panics during parsing the version string
-	defer func() {
-		if r := recover(); r != nil {
-			// Set the return values
-			currentVersion = insight.Version{0, 0, 0}
-			err = fmt.Errorf("Panic recovered while getting current version of %s. Recovered value: %s", product, r)
-			log.Error(err)
-		}
-	}()
-
-	// Convert string version into Version
-	versionNumbers := strings.Split(versionStr, ".")
-	currentVersion.Major, err = strconv.Atoi(versionNumbers[0])
+	currentVersion, err := common.ParseVersion(versionStr)
 	if err != nil {
-		log.Errorf("Failed to retrieve major version for %s! Error message: %s", product, err)
-		return insight.Version{0, 0, 0}, err
+		logger.Errorf("Failed to parse the installed version of %s! Error message: %s", product, err)
+		return insight.Version{}, err
 	}
 
-	currentVersion.Minor, err = strconv.Atoi(versionNumbers[1])
+	logger.Infof("Currently installed %s version: %s", product, currentVersion)
+	return currentVersion, nil
+}
+
+func checkForUpdates(ctx context.Context) error {
+	logger := common.Log(ctx)
+	config, err := common.ParseAgentConfig(baseFolder)
 	if err != nil {
-		log.Errorf("Failed to retrieve minor version for %s! Error message: %s", product, err)
-		return insight.Version{0, 0, 0}, err
+		logger.Error("Check agent update failed! Unable to parse config. Error: ", err)
+		return err
 	}
-
-	currentVersion.Patch, err = strconv.Atoi(versionNumbers[2])
+	source, err := newUpdateSource(config)
 	if err != nil {
-		log.Errorf("Failed to retrieve patch version for %s! Error message: %s", product, err)
-		return insight.Version{0, 0, 0}, err
+		logger.Error("Check agent update failed! Unable to create update source. Error: ", err)
+		return err
 	}
-
-	log.Infof("Currently installed %s version: %s", product, currentVersion)
-	return currentVersion, err
-}
-
-func checkForUpdates() {
-	client, err := common.NewApiClient(baseFolder)
+	// Check the latest version available in the update source
+	latestUpdate, err := source.getLatestArtifact(ctx, "agent")
 	if err != nil {
-		log.Error("Check agent update failed! Unable to create API client. Error: ", err)
-		return
+		logger.Error("Failed to retrieve latest agent version. Error message: ", err)
+		return err
 	}
-	// Check the latest version available on the server
-	latestUpdate, err := getLatestVersion(client)
+	latestVersion, err := common.ParseVersion(latestUpdate.Version)
 	if err != nil {
-		log.Error("Failed to retrieve latest agent version. Error message: ", err)
-		return
+		logger.Error("Failed to parse latest agent version. Error message: ", err)
+		return err
 	}
-	latestVersion := latestUpdate.Version
 
 	// Obtain the currently installed version
-	currentVersion, err := getCurrentVersion("agent")
+	currentVersion, err := getCurrentVersion(ctx, "agent")
 	if err != nil {
 		// Errors are logged inside the function
-		return
+		return err
 	}
 
-	// Perform the update, if there is a newer version
-	if insight.IsNewerVersion(latestVersion, currentVersion) {
-		log.Infof("Found newer agent version (%s) on server. Current version is %s",
-			latestVersion, currentVersion)
+	if !insight.IsNewerVersion(latestVersion, currentVersion) {
+		logger.Infof("Current version is %s. Latest available version: %s is not newer. No need to update.",
+			currentVersion, latestVersion)
+		return nil
+	}
 
-		// Download the latest version
-		updateFileName := fmt.Sprintf("agent-%s", latestVersion)
-		updateFilePath := filepath.Join(updatesFolder, updateFileName)
-		log.Info("Downloading agent version: ", latestVersion)
-		err = client.DownloadFile(latestUpdate.Url, updateFilePath)
-		if err != nil {
-			log.Errorf("Failed to donwload latest version (%s)! Error: %v", latestVersion, err)
-			return
-		}
-		log.Infof("Saved update file: %s", updateFilePath)
+	logger.Infof("Found newer agent version (%s) in %s. Current version is %s",
+		latestVersion, source, currentVersion)
+	if len(latestUpdate.ReleaseNotesUrl) > 0 {
+		logger.Info("Release notes of agent version ", latestVersion, ": ", latestUpdate.ReleaseNotesUrl)
+	}
+
+	if isBlockedVersion(latestVersion) {
+		logger.Warningf("Agent version %s was rolled back because of a crash loop. Skipping it.", latestVersion)
+		return nil
+	}
+
+	if !latestUpdate.Mandatory && !config.Watchdog.Updates.InstallOptional {
+		logger.Infof("Agent version %s is an optional update and installing optional updates is disabled. Skipping it.",
+			latestVersion)
+		return nil
+	}
 
-		// Check the MD5 hash of the downloaded file. If it is not right, retry the download in the next update round.
-		updateFileBytes, err := ioutil.ReadFile(updateFilePath)
+	if err = loadPolicy(ctx).CheckUpdate(currentVersion, latestVersion); err != nil {
+		// Reported to the Insight Server even if the updates come from an offline folder
+		client, _ := common.SharedApiClientWithConfig(config)
+		reportPolicyDenial(ctx, client, latestVersion.String(), policyDenial{
+			Action:         "update",
+			Version:        latestVersion.String(),
+			CurrentVersion: currentVersion.String(),
+			Reason:         err.Error(),
+		})
+		return nil
+	}
+
+	if len(latestUpdate.MinimumVersion) > 0 {
+		minimumVersion, err := common.ParseVersion(latestUpdate.MinimumVersion)
 		if err != nil {
-			log.Errorf("Failed to read the contents of the newly donwloaded agent update file: %s! Error: %v",
-				updateFileName, err)
+			logger.Error("Failed to parse minimum version of the update. Error message: ", err)
+			return err
 		}
-		downloadedFileHash := md5.Sum(updateFileBytes)
-		downloadedHash := fmt.Sprintf("%32x", downloadedFileHash)
-		log.Infof("MD5 hash of %s: %s", updateFileName, downloadedHash)
-
-		if downloadedHash != latestUpdate.Md5 {
-			err = fmt.Errorf("MD5 hash mismatch for file: %s! Expected hash is %s, but calculated is %s.",
-				updateFileName, latestUpdate.Md5, downloadedHash)
-			log.Error(err)
-			// The downloaded file is corrupted, so delete it
-			os.Remove(updateFilePath)
-			return
+		if insight.IsNewerVersion(minimumVersion, currentVersion) {
+			err = fmt.Errorf("Agent version %s requires at least version %s to be installed, but current version is %s!",
+				latestVersion, minimumVersion, currentVersion)
+			logger.Error(err)
+			return err
 		}
+	}
 
-		err = performCommand("update", updateFilePath)
-		if err != nil {
-			log.Errorf("Failed to perform the agent update: %s", err)
-			return
+	// Download the latest version
+	updateFileName := fmt.Sprintf("agent-%s", latestVersion)
+	updateFilePath := filepath.Join(updatesFolder, updateFileName)
+	logger.Info("Downloading agent version: ", latestVersion)
+	err = source.fetch(ctx, latestUpdate, updateFilePath)
+	if err != nil {
+		logger.Errorf("Failed to donwload latest version (%s)! Error: %v", latestVersion, err)
+		return err
+	}
+	logger.Infof("Saved update file: %s", updateFilePath)
+
+	// Check the hash of the downloaded file. If it is not right, retry the download in the next update round.
+	err = common.VerifyArtifactFile(updateFilePath, latestUpdate)
+	if err != nil {
+		logger.Error(err)
+		if verificationErr, ok := err.(*common.VerificationError); ok {
+			verificationFailures.Inc(verificationErr.Algorithm)
 		}
-		return
+		// The downloaded file is corrupted, so delete it
+		os.Remove(updateFilePath)
+		return err
 	}
 
-	log.Infof("Current version is %s. Latest available version: %s is not newer. No need to update.",
-		currentVersion, latestVersion)
+	keepInstallerForRollback(ctx, updateFilePath, latestVersion)
+	err = performCommand(ctx, "update", updateFilePath)
+	if err != nil {
+		logger.Errorf("Failed to perform the agent update: %s", err)
+		if managerErr, ok := err.(*common.ManagerError); ok && managerErr.ExitCode == common.ManagerExitInvalidPackage {
+			// Download it again in the next update round
+			os.Remove(updateFilePath)
+		}
+		return err
+	}
+	return nil
 }
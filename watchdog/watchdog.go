@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
+	"net"
 	"os"
+	"sync"
 	"time"
 
-	insight "github.com/palette-software/insight-server/lib"
 	log "github.com/palette-software/go-log-targets"
 	"github.com/palette-software/palette-updater/common"
 	svcControl "github.com/palette-software/palette-updater/service_control"
@@ -18,80 +20,299 @@ const updateTimer = 3 * time.Minute
 const commandTimer = 2 * time.Minute
 const aliveTimer = 5 * time.Minute
 
+// Job timeouts. The update job includes downloading the installer, which may be slow.
+const updateTimeout = 30 * time.Minute
+const commandTimeout = 10 * time.Minute
+const aliveTimeout = 2 * time.Minute
+const resourcesTimeout = time.Minute
+
+// The time the running jobs get to finish after they are cancelled. It must be lower than
+// shutdownTimer defined in watchdog/main.go, as that is the last resort for stopping.
+const jobsStopTimeout = 5 * time.Second
+
+// Job names, these can be triggered by the status API as well
+const (
+	updateJobName    = "update-check"
+	commandJobName   = "command-poll"
+	aliveJobName     = "alive-check"
+	resourcesJobName = "resource-monitor"
+)
+
 // Defining the watchdog service
 type paletteWatchdogService struct {
-	lastPerformedCommand insight.AgentCommand
+	status    watchdogStatus
+	scheduler scheduler
+	crashLoop *common.CrashLoopDetector
+
+	// Only accessed by the alive check, which never runs in parallel with itself
+	healthProbes        []healthProbe
+	healthFailureStreak int
+	resources           *resourceMonitor
+
+	// Only accessed by the command poll, which never runs in parallel with itself
+	commandAuth *commandAuthenticator
+
+	// Held while the alive check or the resource monitor restarts the agent
+	restartMutex sync.Mutex
+	lastRestart  time.Time
+
+	// The config at the time the service started
+	config common.Config
+
+	// These are replaceable for testing
+	queryAgent   func() (svc.Status, error)
+	recoverAgent func(ctx context.Context, state svc.State)
+}
+
+func newPaletteWatchdogService() *paletteWatchdogService {
+	pws := &paletteWatchdogService{
+		status:       watchdogStatus{startTime: time.Now()},
+		queryAgent:   queryAgentService,
+		recoverAgent: recoverAgentService,
+	}
+
+	// Configuration problems are logged by the jobs too, so only the defaults are needed in that case
+	config, err := common.ParseAgentConfig(baseFolder)
+	if err != nil {
+		log.Error("Failed to parse config for the watchdog service! Using defaults. Error: ", err)
+	}
+	pws.config = config
+	checkLeftoverManagerResult()
+	pws.crashLoop = newCrashLoopDetector(config.Watchdog.CrashLoop)
+	pws.healthProbes = newHealthProbes(config)
+	pws.commandAuth = newCommandAuthenticator()
+
+	pws.scheduler.add(&job{
+		name:     updateJobName,
+		interval: updateTimer,
+		timeout:  updateTimeout,
+		policy:   skipIfRunning,
+		run:      pws.runUpdateCheck,
+	})
+	pws.scheduler.add(&job{
+		name:     commandJobName,
+		interval: commandTimer,
+		timeout:  commandTimeout,
+		// A command poll requested during a running one may be for a new command
+		policy: queueIfRunning,
+		run:    pws.checkForCommand,
+	})
+	pws.scheduler.add(&job{
+		name:     aliveJobName,
+		interval: aliveTimer,
+		timeout:  aliveTimeout,
+		policy:   skipIfRunning,
+		run:      pws.checkAlive,
+	})
+	if config.Watchdog.ResourceLimits.Enabled {
+		pws.resources = newResourceMonitor(config.Watchdog.ResourceLimits)
+		pws.scheduler.add(&job{
+			name:     resourcesJobName,
+			interval: pws.resources.sampleInterval,
+			timeout:  resourcesTimeout,
+			policy:   skipIfRunning,
+			run:      pws.checkResources,
+		})
+	}
+	return pws
 }
 
 func (pws *paletteWatchdogService) Execute(args []string, changeRequest <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
 	changes <- svc.Status{State: svc.StartPending}
-	tickUpdate := time.Tick(updateTimer)
-	tickCommand := time.Tick(commandTimer)
-	tickAlive := time.Tick(aliveTimer)
+	// Cancelled when the service is stopped, so that the running jobs can quit in time
+	ctx, cancel := context.WithCancel(context.Background())
+	pws.scheduler.start(ctx)
+
+	for _, listener := range pws.startLocalServers() {
+		defer listener.Close()
+	}
+
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 loop:
 	for {
-		select {
-		case <-tickUpdate:
-			// Do the checks in a different thread so that the main thread may remain responsive
-			go func() {
-				// Remove the updates folder to make sure the disk is not going to filled
-				// with orphaned update files
-				os.RemoveAll(updatesFolder)
-
-				checkForUpdates()
-			}()
-
-		case <-tickCommand:
-			// Do the checks in a different thread so that the main thread may remain responsive
-			go func() {
-				pws.checkForCommand()
-			}()
-
-		case <-tickAlive:
-			go func() {
-				if pws.lastPerformedCommand.Cmd == "stop" {
-					log.Debugf("Skipped alive check for %s, since it is commanded to be stopped.", common.AgentSvcName)
-					return
-				}
-				var serviceControl svcControl.ServiceControl
-				svcStatus, err := serviceControl.Query(common.AgentSvcName)
-				if err != nil {
-					log.Errorf("Failed to query status of service: %s! Error message: %v", common.AgentSvcName, err)
-					return
-				}
-
-				// Restart the agent service if it is not running and it is not commanded to stop
-				if svcStatus.State == svc.Stopped {
-					agentSvcMutex.Lock()
-					defer agentSvcMutex.Unlock()
-					serviceControl.Start(common.AgentSvcName)
-					log.Warningf("Watchdog found %s in stopped state. Restarted it.", common.AgentSvcName)
-				} else {
-					log.Infof("%s is still alive. (Service state: %d)", common.AgentSvcName, svcStatus.State)
-				}
-			}()
-
-		case cr := <-changeRequest:
-			switch cr.Cmd {
-			case svc.Interrogate:
-				changes <- cr.CurrentStatus
-				// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
-				time.Sleep(100 * time.Millisecond)
-				changes <- cr.CurrentStatus
-			case svc.Stop, svc.Shutdown:
-				log.Infof("Stopping %s...", common.WatchdogSvcDisplayName)
-				break loop
-			default:
-				log.Errorf("unexpected control request #%d", cr)
-			}
+		cr := <-changeRequest
+		switch cr.Cmd {
+		case svc.Interrogate:
+			changes <- cr.CurrentStatus
+			// Testing deadlock from https://code.google.com/p/winsvc/issues/detail?id=4
+			time.Sleep(100 * time.Millisecond)
+			changes <- cr.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Infof("Stopping %s...", common.WatchdogSvcDisplayName)
+			break loop
+		default:
+			log.Errorf("unexpected control request #%d", cr)
 		}
 	}
 	changes <- svc.Status{State: svc.StopPending}
+	cancel()
+	pws.scheduler.wait(jobsStopTimeout)
 	return
 }
 
+// Starts the enabled local HTTP servers (status API, metrics). These are optional, so failing
+// to start them must not prevent the watchdog from working.
+func (pws *paletteWatchdogService) startLocalServers() []net.Listener {
+	config := pws.config
+	var listeners []net.Listener
+	if config.Watchdog.StatusApi.Enabled {
+		listener, err := pws.startStatusApi(config.Watchdog.StatusApi)
+		// The error has already been logged
+		if err == nil {
+			listeners = append(listeners, listener)
+		}
+	}
+	if config.Watchdog.Metrics.Enabled {
+		listener, err := startMetricsServer(config.Watchdog.Metrics)
+		if err == nil {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners
+}
+
+func (pws *paletteWatchdogService) runUpdateCheck(ctx context.Context) error {
+	// Remove the updates folder to make sure the disk is not going to filled
+	// with orphaned update files. The scheduler makes sure that no other update check is running.
+	os.RemoveAll(updatesFolder)
+
+	err := checkForUpdates(ctx)
+	updateChecks.Inc(resultLabel(err))
+	return err
+}
+
+func (pws *paletteWatchdogService) checkAlive(ctx context.Context) error {
+	logger := common.Log(ctx)
+	if pws.status.getLastCommand().Cmd == "stop" {
+		logger.Debugf("Skipped alive check for %s, since it is commanded to be stopped.", common.AgentSvcName)
+		return nil
+	}
+	now := time.Now()
+	svcStatus, err := pws.queryAgent()
+	if err != nil {
+		logger.Errorf("Failed to query status of service: %s! Error message: %v", common.AgentSvcName, err)
+		return err
+	}
+
+	// Restart the agent service if it is not running and it is not commanded to stop
+	if svcStatus.State != svc.Stopped {
+		if svcStatus.State != svc.Running || pws.isHealthy(ctx) {
+			pws.crashLoop.RecordRunning(now)
+			logger.Infof("%s is still alive. (Service state: %d)", common.AgentSvcName, svcStatus.State)
+			return nil
+		}
+	}
+
+	if inBackoff, until := pws.crashLoop.InBackoff(now); inBackoff {
+		logger.Errorf("Watchdog found %s unhealthy or stopped, but restarts are backed off until %s because of a crash loop.",
+			common.AgentSvcName, until.Format(time.RFC3339))
+		return nil
+	}
+
+	return pws.restartAgentOnce(ctx, now, func() {
+		pws.recoverAgent(ctx, svcStatus.State)
+	})
+}
+
+func queryAgentService() (svc.Status, error) {
+	var serviceControl svcControl.ServiceControl
+	return serviceControl.Query(common.AgentSvcName)
+}
+
+// Starts the stopped agent, or restarts the unhealthy one
+func recoverAgentService(ctx context.Context, state svc.State) {
+	var serviceControl svcControl.ServiceControl
+	if state == svc.Stopped {
+		restartAgent(ctx, serviceControl)
+	} else {
+		restartAgentGracefully(ctx, serviceControl, "it failed the health checks")
+	}
+}
+
+// Restarts the agent, unless it has been restarted since the problem was found. The alive check
+// and the resource monitor may find the same problem, but the agent is restarted only once, and
+// the restart is counted only once towards the crash loop detection.
+func (pws *paletteWatchdogService) restartAgentOnce(ctx context.Context, found time.Time, restart func()) error {
+	pws.restartMutex.Lock()
+	defer pws.restartMutex.Unlock()
+	if pws.lastRestart.After(found) {
+		common.Log(ctx).Infof("%s has been restarted since the problem was found. Not restarting it again.",
+			common.AgentSvcName)
+		return nil
+	}
+	restart()
+	pws.lastRestart = time.Now()
+	return pws.recordRestart(ctx, found)
+}
+
+// Feeds an agent restart to the crash loop detection
+func (pws *paletteWatchdogService) recordRestart(ctx context.Context, now time.Time) error {
+	logger := common.Log(ctx)
+	if pws.crashLoop.RecordRestart(now) {
+		config, err := common.ParseAgentConfig(baseFolder)
+		if err != nil {
+			logger.Error("Failed to parse config for handling crash loop! Error: ", err)
+			return err
+		}
+		pws.handleCrashLoop(ctx, config)
+	}
+	return nil
+}
+
+func restartAgent(ctx context.Context, serviceControl svcControl.ServiceControl) {
+	logger := common.Log(ctx)
+	agentSvcMutex.Lock()
+	defer agentSvcMutex.Unlock()
+	err := serviceControl.Start(common.AgentSvcName)
+	recordAudit(ctx, "agent-restart", err, "reason", "it was stopped")
+	agentRestarts.Inc()
+	logger.Warningf("Watchdog found %s in stopped state. Restarted it.", common.AgentSvcName)
+}
+
+// Runs the configured health probes. Returns false once the agent failed the probes
+// as many times in a row as the failure threshold.
+func (pws *paletteWatchdogService) isHealthy(ctx context.Context) bool {
+	logger := common.Log(ctx)
+	if len(pws.healthProbes) == 0 {
+		return true
+	}
+	failures := runHealthProbes(ctx, pws.healthProbes)
+	if len(failures) == 0 {
+		pws.healthFailureStreak = 0
+		return true
+	}
+
+	pws.healthFailureStreak++
+	threshold := pws.config.Watchdog.HealthChecks.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultHealthFailureThreshold
+	}
+	if pws.healthFailureStreak < threshold {
+		logger.Warningf("%s failed %d health checks. Consecutive failures: %d/%d", common.AgentSvcName,
+			len(failures), pws.healthFailureStreak, threshold)
+		return true
+	}
+	pws.healthFailureStreak = 0
+	return false
+}
+
+// Stops the agent service, so that it can shut down cleanly, then starts it again
+func restartAgentGracefully(ctx context.Context, serviceControl svcControl.ServiceControl, reason string) {
+	logger := common.Log(ctx)
+	agentSvcMutex.Lock()
+	defer agentSvcMutex.Unlock()
+	err := serviceControl.Stop(common.AgentSvcName)
+	if err != nil {
+		logger.Errorf("Failed to stop %s service! Error: %v", common.AgentSvcName, err)
+		// Try to start anyway
+	}
+	err = serviceControl.Start(common.AgentSvcName)
+	recordAudit(ctx, "agent-restart", err, "reason", reason)
+	agentRestarts.Inc()
+	logger.Warningf("Restarted %s, because %s.", common.AgentSvcName, reason)
+}
+
 func runService(name string, isDebug bool) {
 	var err error
 
@@ -100,7 +321,7 @@ func runService(name string, isDebug bool) {
 	if isDebug {
 		run = debug.Run
 	}
-	err = run(name, &paletteWatchdogService{})
+	err = run(name, newPaletteWatchdogService())
 	if err != nil {
 		log.Errorf("%s service failed: %v", name, err)
 		return